@@ -0,0 +1,80 @@
+package client
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+// errors
+var (
+	ErrListenerAccepted = errors.New("socks: BIND accepts one connection only")
+	ErrListenerClosed   = errors.New("socks: listener closed")
+)
+
+// Listener is the socket the proxy listens on for BIND. The proxy replies a
+// second time once the remote host connects, the connection to the proxy
+// is the connection to the remote host from then on.
+type Listener struct {
+	conn net.Conn
+	addr net.Addr
+
+	mu       sync.Mutex
+	accepted bool
+	// conn is handed over to the caller of Accept
+	handedOver bool
+	closed     bool
+}
+
+// Accept waits for the second reply of the proxy.
+func (l *Listener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil, ErrListenerClosed
+	}
+	if l.accepted {
+		l.mu.Unlock()
+		return nil, ErrListenerAccepted
+	}
+	l.accepted = true
+	l.mu.Unlock()
+
+	rep, err := readReply(l.conn)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil, ErrListenerClosed
+	}
+	if err != nil {
+		l.conn.Close()
+		return nil, err
+	}
+	l.handedOver = true
+	return &Conn{
+		Conn:       l.conn,
+		boundAddr:  l.addr,
+		remoteAddr: newAddr("tcp", rep.BindAddr),
+	}, nil
+}
+
+// Close closes the connection to the proxy unless it is accepted, it
+// interrupts a pending Accept.
+func (l *Listener) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	if l.handedOver {
+		return nil
+	}
+	return l.conn.Close()
+}
+
+// Addr is the address the proxy listens on, which is to be told to the
+// remote host.
+func (l *Listener) Addr() net.Addr {
+	return l.addr
+}
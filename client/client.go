@@ -0,0 +1,322 @@
+// Package client dials through SOCKS5 proxies, it shares the codec of the
+// requests and replies with the server in package proxy.
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/remones/gsocks/proxy"
+)
+
+// errors
+var (
+	ErrNoAcceptableAuth = errors.New("socks: no acceptable authentication methods")
+	ErrAuthFailed       = errors.New("socks: username/password authentication failed")
+	ErrNetwork          = errors.New("socks: network not supported")
+)
+
+var aLongTimeAgo = time.Unix(1, 0)
+
+// ReplyError is a failure replied by the proxy.
+type ReplyError struct {
+	Code proxy.ReplyCode
+}
+
+func (e *ReplyError) Error() string {
+	return "socks: " + e.Code.String()
+}
+
+// Auth is the credential of the username/password method, see RFC 1929.
+type Auth struct {
+	Username string
+	Password string
+}
+
+// Dialer dials through a SOCKS5 proxy.
+type Dialer struct {
+	ProxyNetwork string
+	ProxyAddress string
+	// Auth is offered besides no authentication if not nil
+	Auth *Auth
+	// ProxyDial dials the proxy, a net.Dialer is used if nil.
+	ProxyDial func(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// NewDialer returns a Dialer of the proxy listening on address.
+func NewDialer(network, address string, auth *Auth) *Dialer {
+	return &Dialer{
+		ProxyNetwork: network,
+		ProxyAddress: address,
+		Auth:         auth,
+	}
+}
+
+// Dial connects to address through the proxy.
+func (d *Dialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// DialContext connects to address through the proxy with the CONNECT
+// command. The context only bounds the dial and the negotiation.
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if !isNetwork(network, "tcp") {
+		return nil, ErrNetwork
+	}
+	dest, err := proxy.ParseAddrSpec(address)
+	if err != nil {
+		return nil, err
+	}
+	conn, rep, err := d.request(ctx, proxy.CmdConnect, dest)
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{
+		Conn:       conn,
+		boundAddr:  newAddr("tcp", rep.BindAddr),
+		remoteAddr: newAddr("tcp", dest),
+	}, nil
+}
+
+// Listen asks the proxy to listen for the connection of address with the
+// BIND command, address is the host the application tells to connect back,
+// e.g. the FTP server. The listener accepts that one connection only.
+func (d *Dialer) Listen(ctx context.Context, network, address string) (net.Listener, error) {
+	if !isNetwork(network, "tcp") {
+		return nil, ErrNetwork
+	}
+	dest, err := proxy.ParseAddrSpec(address)
+	if err != nil {
+		return nil, err
+	}
+	conn, rep, err := d.request(ctx, proxy.CmdBind, dest)
+	if err != nil {
+		return nil, err
+	}
+	return &Listener{
+		conn: conn,
+		addr: newAddr("tcp", proxyHost(conn, rep.BindAddr)),
+	}, nil
+}
+
+// request connects to the proxy, authenticates and sends the request of
+// cmd, the connection is returned with the first reply.
+func (d *Dialer) request(ctx context.Context, cmd uint8, dest *proxy.AddrSpec) (net.Conn, *proxy.Reply, error) {
+	conn, err := d.dialProxy(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	var rep *proxy.Reply
+	err = withContext(ctx, conn, func() error {
+		if err := d.authenticate(conn); err != nil {
+			return err
+		}
+		req := &proxy.Request{
+			Version:  proxy.Socks5Version,
+			Command:  cmd,
+			DestAddr: dest,
+		}
+		if _, err := req.WriteTo(conn); err != nil {
+			return err
+		}
+		rep, err = readReply(conn)
+		return err
+	})
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, rep, nil
+}
+
+func (d *Dialer) dialProxy(ctx context.Context) (net.Conn, error) {
+	return dialProxy(ctx, d.ProxyDial, d.ProxyNetwork, d.ProxyAddress)
+}
+
+// dialProxy connects to the proxy with dial, or a net.Dialer if it is nil.
+func dialProxy(ctx context.Context, dial func(ctx context.Context, network, address string) (net.Conn, error), network, address string) (net.Conn, error) {
+	if network == "" {
+		network = "tcp"
+	}
+	if dial != nil {
+		return dial(ctx, network, address)
+	}
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, network, address)
+}
+
+/*
+The client offers its methods:
++----+----------+----------+
+|VER | NMETHODS | METHODS  |
++----+----------+----------+
+| 1  |    1     | 1 to 255 |
++----+----------+----------+
+
+and the username/password method goes on with:
++----+------+----------+------+----------+
+|VER | ULEN |  UNAME   | PLEN |  PASSWD  |
++----+------+----------+------+----------+
+| 1  |  1   | 1 to 255 |  1   | 1 to 255 |
++----+------+----------+------+----------+
+*/
+func (d *Dialer) authenticate(rw io.ReadWriter) error {
+	methods := []byte{byte(proxy.AuthNoRequried)}
+	if d.Auth != nil {
+		if len(d.Auth.Username) == 0 || len(d.Auth.Username) > 0xFF || len(d.Auth.Password) > 0xFF {
+			return errors.New("socks: invalid username/password")
+		}
+		methods = append(methods, byte(proxy.AuthUserPass))
+	}
+	msg := append([]byte{proxy.Socks5Version, byte(len(methods))}, methods...)
+	if _, err := rw.Write(msg); err != nil {
+		return err
+	}
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(rw, b); err != nil {
+		return err
+	}
+	if b[0] != proxy.Socks5Version {
+		return fmt.Errorf("socks: invalid version %#x", b[0])
+	}
+
+	switch proxy.AuthType(b[1]) {
+	case proxy.AuthNoRequried:
+		return nil
+	case proxy.AuthNoAccetable:
+		return ErrNoAcceptableAuth
+	case proxy.AuthUserPass:
+		if d.Auth == nil {
+			break
+		}
+		msg = []byte{proxy.UserPassVersion, byte(len(d.Auth.Username))}
+		msg = append(msg, d.Auth.Username...)
+		msg = append(msg, byte(len(d.Auth.Password)))
+		msg = append(msg, d.Auth.Password...)
+		if _, err := rw.Write(msg); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(rw, b); err != nil {
+			return err
+		}
+		if b[1] != proxy.UserPassSuccess {
+			return ErrAuthFailed
+		}
+		return nil
+	}
+	return fmt.Errorf("socks: unexpected method %#x", b[1])
+}
+
+func readReply(r io.Reader) (*proxy.Reply, error) {
+	rep, err := proxy.NewReply(r)
+	if err != nil {
+		return nil, err
+	}
+	if rep.Version != proxy.Socks5Version {
+		return nil, fmt.Errorf("socks: invalid version %#x", rep.Version)
+	}
+	if rep.Code != proxy.ReplySuccessed {
+		return nil, &ReplyError{Code: rep.Code}
+	}
+	return rep, nil
+}
+
+// withContext runs f on conn, the cancellation of ctx interrupts it.
+func withContext(ctx context.Context, conn net.Conn, f func() error) error {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(aLongTimeAgo)
+		case <-done:
+		}
+	}()
+	err := f()
+	close(done)
+	<-stopped
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		if err != nil {
+			return ctxErr
+		}
+		// f is done before the deadline is set
+		conn.SetDeadline(time.Time{})
+	}
+	return err
+}
+
+func isNetwork(network, prefix string) bool {
+	switch network {
+	case prefix, prefix + "4", prefix + "6":
+		return true
+	}
+	return false
+}
+
+// proxyHost replaces the unspecified IP of a bound address with the one of
+// the proxy, the proxy listens on all its interfaces then.
+func proxyHost(conn net.Conn, as *proxy.AddrSpec) *proxy.AddrSpec {
+	if as.FQDN != "" || !as.IP.IsUnspecified() {
+		return as
+	}
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return as
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return &proxy.AddrSpec{IP: ip, Port: as.Port}
+	}
+	return as
+}
+
+// Addr is an address replied by the proxy whose host is a domain name.
+type Addr struct {
+	Net  string
+	Host string
+	Port int
+}
+
+// Network ...
+func (a *Addr) Network() string {
+	return a.Net
+}
+
+func (a *Addr) String() string {
+	return net.JoinHostPort(a.Host, strconv.Itoa(a.Port))
+}
+
+// newAddr returns as as a *net.TCPAddr or *net.UDPAddr, or an *Addr if its
+// host is a domain name.
+func newAddr(network string, as *proxy.AddrSpec) net.Addr {
+	switch {
+	case as.FQDN != "":
+		return &Addr{Net: network, Host: as.FQDN, Port: as.Port}
+	case network == "udp":
+		return &net.UDPAddr{IP: as.IP, Port: as.Port}
+	}
+	return &net.TCPAddr{IP: as.IP, Port: as.Port}
+}
+
+// Conn is a connection through the proxy.
+type Conn struct {
+	net.Conn
+	boundAddr  net.Addr
+	remoteAddr net.Addr
+}
+
+// BoundAddr is the address the proxy connects to the remote host from, or
+// the one it listened on for BIND.
+func (c *Conn) BoundAddr() net.Addr {
+	return c.boundAddr
+}
+
+// RemoteAddr is the address of the remote host rather than the proxy.
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
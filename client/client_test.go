@@ -0,0 +1,244 @@
+package client
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/remones/gsocks/config"
+	"github.com/remones/gsocks/proxy"
+	"github.com/stretchr/testify/assert"
+)
+
+var testAuth = &Auth{Username: "test", Password: "s3cret"}
+
+// startServer serves a gsocks server requiring testAuth on loopback.
+func startServer(t *testing.T) (string, func()) {
+	cfg := config.NewConfig()
+	cfg.Auth = config.Auth{
+		UserPasswd: &config.UserPasswd{
+			Enable: true,
+			Account: []config.Account{
+				{Username: testAuth.Username, Password: testAuth.Password},
+			},
+		},
+	}
+	srv := serveConfig(t, cfg)
+	return srv.addr, srv.stop
+}
+
+type testServer struct {
+	*proxy.Server
+	addr     string
+	accepted int32
+}
+
+func (srv *testServer) stop() {
+	srv.Close(context.Background())
+}
+
+// serveConfig serves a gsocks server of cfg on loopback.
+func serveConfig(t *testing.T, cfg *config.Config) *testServer {
+	cfg.Host = "127.0.0.1"
+	s, err := proxy.NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &testServer{Server: s, addr: ln.Addr().String()}
+	go s.Serve(&countingListener{Listener: ln, n: &srv.accepted})
+	return srv
+}
+
+type countingListener struct {
+	net.Listener
+	n *int32
+}
+
+func (ln *countingListener) Accept() (net.Conn, error) {
+	conn, err := ln.Listener.Accept()
+	if err == nil {
+		atomic.AddInt32(ln.n, 1)
+	}
+	return conn, err
+}
+
+func startEchoServer(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln
+}
+
+func TestDialer_DialContext(t *testing.T) {
+	addr, stop := startServer(t)
+	defer stop()
+	echo := startEchoServer(t)
+	defer echo.Close()
+
+	d := NewDialer("tcp", addr, testAuth)
+	conn, err := d.DialContext(context.Background(), "tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	assert.Equal(t, echo.Addr().String(), conn.RemoteAddr().String())
+	assert.NotNil(t, conn.(*Conn).BoundAddr())
+
+	_, err = conn.Write([]byte("ping"))
+	assert.NoError(t, err)
+	b := make([]byte, 4)
+	_, err = io.ReadFull(conn, b)
+	assert.NoError(t, err)
+	assert.Equal(t, "ping", string(b))
+}
+
+func TestDialer_DialContextErrors(t *testing.T) {
+	addr, stop := startServer(t)
+	defer stop()
+
+	// a closed port
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := ln.Addr().String()
+	ln.Close()
+
+	tests := []struct {
+		name    string
+		auth    *Auth
+		network string
+		wantErr error
+	}{
+		{"wrong_password", &Auth{Username: "test", Password: "wrong"}, "tcp", ErrAuthFailed},
+		{"no_auth", nil, "tcp", ErrNoAcceptableAuth},
+		{"refused", testAuth, "tcp", &ReplyError{Code: proxy.ReplyConnectionRefused}},
+		{"network", testAuth, "udp", ErrNetwork},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := NewDialer("tcp", addr, tt.auth)
+			_, err := d.DialContext(context.Background(), tt.network, closed)
+			assert.Equal(t, tt.wantErr, err)
+		})
+	}
+}
+
+func TestDialer_DialContextTimeout(t *testing.T) {
+	// a proxy which never replies
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			defer conn.Close()
+			io.Copy(io.Discard, conn)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	d := NewDialer("tcp", ln.Addr().String(), nil)
+	_, err = d.DialContext(ctx, "tcp", "127.0.0.1:80")
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestDialer_Listen(t *testing.T) {
+	addr, stop := startServer(t)
+	defer stop()
+
+	d := NewDialer("tcp", addr, testAuth)
+	ln, err := d.Listen(context.Background(), "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	peer, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	assert.Equal(t, peer.LocalAddr().String(), conn.RemoteAddr().String())
+
+	_, err = ln.Accept()
+	assert.Equal(t, ErrListenerAccepted, err)
+
+	go peer.Write([]byte("ping"))
+	b := make([]byte, 4)
+	_, err = io.ReadFull(conn, b)
+	assert.NoError(t, err)
+	assert.Equal(t, "ping", string(b))
+}
+
+func TestDialer_ListenPacket(t *testing.T) {
+	addr, stop := startServer(t)
+	defer stop()
+
+	target, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		b := make([]byte, 1024)
+		for {
+			n, from, err := target.ReadFromUDP(b)
+			if err != nil {
+				return
+			}
+			target.WriteToUDP(b[:n], from)
+		}
+	}()
+
+	// the replies carry the destination address in the form it is sent
+	d := NewDialer("tcp", addr, testAuth)
+	for _, dst := range []net.Addr{
+		target.LocalAddr(),
+		&Addr{Net: "udp", Host: "localhost", Port: target.LocalAddr().(*net.UDPAddr).Port},
+	} {
+		pc, err := d.ListenPacket(context.Background(), "udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = pc.WriteTo([]byte("ping"), dst)
+		assert.NoError(t, err)
+
+		b := make([]byte, 1024)
+		pc.SetReadDeadline(time.Now().Add(time.Second))
+		n, from, err := pc.ReadFrom(b)
+		assert.NoError(t, err)
+		assert.Equal(t, "ping", string(b[:n]))
+		assert.Equal(t, dst.String(), from.String())
+		pc.Close()
+	}
+}
@@ -0,0 +1,89 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/remones/gsocks/proxy"
+)
+
+// HTTPDialer dials through the CONNECT method of an HTTP proxy.
+type HTTPDialer struct {
+	ProxyNetwork string
+	ProxyAddress string
+	// Auth is sent as the Basic Proxy-Authorization if not nil
+	Auth *Auth
+	// ProxyDial dials the proxy, a net.Dialer is used if nil.
+	ProxyDial func(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// DialContext connects to address through the proxy, domain names are
+// resolved by the proxy.
+func (d *HTTPDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if !isNetwork(network, "tcp") {
+		return nil, ErrNetwork
+	}
+	dest, err := proxy.ParseAddrSpec(address)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := dialProxy(ctx, d.ProxyDial, d.ProxyNetwork, d.ProxyAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	var br *bufio.Reader
+	err = withContext(ctx, conn, func() error {
+		req := &http.Request{
+			Method: http.MethodConnect,
+			URL:    &url.URL{Opaque: dest.String()},
+			Host:   dest.String(),
+			Header: make(http.Header),
+		}
+		if d.Auth != nil {
+			cred := base64.StdEncoding.EncodeToString([]byte(d.Auth.Username + ":" + d.Auth.Password))
+			req.Header.Set("Proxy-Authorization", "Basic "+cred)
+		}
+		if err := req.Write(conn); err != nil {
+			return err
+		}
+		br = bufio.NewReader(conn)
+		// the body of a successful response is the tunnel, it is not read
+		resp, err := http.ReadResponse(br, req)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("http: CONNECT %s: %s", dest, resp.Status)
+		}
+		return nil
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	var c net.Conn = conn
+	// the proxy may have sent the first bytes of the target already
+	if br.Buffered() > 0 {
+		c = &bufferedConn{Conn: conn, r: br}
+	}
+	return &Conn{
+		Conn:       c,
+		remoteAddr: newAddr("tcp", dest),
+	}, nil
+}
+
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
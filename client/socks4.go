@@ -0,0 +1,85 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/remones/gsocks/proxy"
+)
+
+// errors
+var (
+	ErrSocks4IPv6 = errors.New("socks4: IPv6 addresses are not supported")
+)
+
+// Socks4Dialer dials through a SOCKS4a proxy, which only supports CONNECT.
+type Socks4Dialer struct {
+	ProxyNetwork string
+	ProxyAddress string
+	UserID       string
+	// ProxyDial dials the proxy, a net.Dialer is used if nil.
+	ProxyDial func(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// DialContext connects to address through the proxy, domain names are
+// resolved by the proxy.
+func (d *Socks4Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if !isNetwork(network, "tcp") {
+		return nil, ErrNetwork
+	}
+	dest, err := proxy.ParseAddrSpec(address)
+	if err != nil {
+		return nil, err
+	}
+	msg, err := d.request(dest)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := dialProxy(ctx, d.ProxyDial, d.ProxyNetwork, d.ProxyAddress)
+	if err != nil {
+		return nil, err
+	}
+	err = withContext(ctx, conn, func() error {
+		if _, err := conn.Write(msg); err != nil {
+			return err
+		}
+		rep := make([]byte, 8)
+		if _, err := io.ReadFull(conn, rep); err != nil {
+			return err
+		}
+		if rep[1] != proxy.Socks4Granted {
+			return fmt.Errorf("socks4: request rejected (%#x)", rep[1])
+		}
+		return nil
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &Conn{
+		Conn:       conn,
+		remoteAddr: newAddr("tcp", dest),
+	}, nil
+}
+
+// request builds the CONNECT request of dest, a domain name is appended as
+// SOCKS4a does, with DSTIP 0.0.0.1.
+func (d *Socks4Dialer) request(dest *proxy.AddrSpec) ([]byte, error) {
+	ip := net.IPv4(0, 0, 0, 1).To4()
+	if dest.FQDN == "" {
+		if ip = dest.IP.To4(); ip == nil {
+			return nil, ErrSocks4IPv6
+		}
+	}
+	msg := []byte{proxy.Socks4Version, proxy.CmdConnect, uint8(dest.Port >> 8), uint8(dest.Port)}
+	msg = append(msg, ip...)
+	msg = append(append(msg, d.UserID...), 0x00)
+	if dest.FQDN != "" {
+		msg = append(append(msg, dest.FQDN...), 0x00)
+	}
+	return msg, nil
+}
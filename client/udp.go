@@ -0,0 +1,170 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/remones/gsocks/proxy"
+)
+
+// udpMaxHeader is the longest UDP request header, with a FQDN of 255 octets.
+const udpMaxHeader = 4 + 1 + 255 + 2
+
+// ListenPacket associates a UDP relay of the proxy with the UDP ASSOCIATE
+// command, address is the local address to send the datagrams from, any
+// address is picked if it is empty. The association lasts until the returned
+// connection is closed, or the proxy closes the TCP connection.
+func (d *Dialer) ListenPacket(ctx context.Context, network, address string) (net.PacketConn, error) {
+	if !isNetwork(network, "udp") {
+		return nil, ErrNetwork
+	}
+	var laddr *net.UDPAddr
+	if address != "" {
+		var err error
+		if laddr, err = net.ResolveUDPAddr(network, address); err != nil {
+			return nil, err
+		}
+	}
+	pc, err := net.ListenUDP(network, laddr)
+	if err != nil {
+		return nil, err
+	}
+
+	// the proxy takes the IP of the TCP connection if the local address is
+	// unspecified.
+	local := pc.LocalAddr().(*net.UDPAddr)
+	dest := &proxy.AddrSpec{IP: local.IP, Port: local.Port}
+	if local.IP.IsUnspecified() {
+		dest.IP = net.IPv4zero
+	}
+	conn, rep, err := d.request(ctx, proxy.CmdUDP, dest)
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+	relay := proxyHost(conn, rep.BindAddr)
+	if relay.FQDN != "" {
+		ip, err := net.ResolveIPAddr("ip", relay.FQDN)
+		if err != nil {
+			conn.Close()
+			pc.Close()
+			return nil, err
+		}
+		relay = &proxy.AddrSpec{IP: ip.IP, Port: relay.Port}
+	}
+
+	c := &PacketConn{
+		conn:  pc,
+		ctrl:  conn,
+		relay: &net.UDPAddr{IP: relay.IP, Port: relay.Port},
+	}
+	go c.watchControl()
+	return c, nil
+}
+
+/*
+PacketConn sends and receives datagrams through the UDP relay of the proxy,
+every datagram carries the header:
++----+------+------+----------+----------+----------+
+|RSV | FRAG | ATYP | DST.ADDR | DST.PORT |   DATA   |
++----+------+------+----------+----------+----------+
+| 2  |  1   |  1   | Variable |    2     | Variable |
++----+------+------+----------+----------+----------+
+Fragments are not sent, and the ones received are dropped.
+*/
+type PacketConn struct {
+	conn  *net.UDPConn
+	ctrl  net.Conn
+	relay *net.UDPAddr
+
+	once     sync.Once
+	closeErr error
+}
+
+// watchControl closes the association once the proxy closes the TCP
+// connection.
+func (c *PacketConn) watchControl() {
+	io.Copy(ioutil.Discard, c.ctrl)
+	c.Close()
+}
+
+// ReadFrom reads a datagram relayed by the proxy, addr is the host which
+// sent it.
+func (c *PacketConn) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
+	buf := make([]byte, udpMaxHeader+len(b))
+	for {
+		n, from, err := c.conn.ReadFromUDP(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		if !from.IP.Equal(c.relay.IP) || from.Port != c.relay.Port {
+			continue
+		}
+		if n < 4 || buf[0] != 0x00 || buf[1] != 0x00 || buf[2] != 0x00 {
+			continue
+		}
+		r := bytes.NewReader(buf[3:n])
+		as, err := proxy.NewAddrSpec(r)
+		if err != nil {
+			continue
+		}
+		return copy(b, buf[n-r.Len():n]), newAddr("udp", as), nil
+	}
+}
+
+// WriteTo sends b to addr through the proxy, addr may be an *Addr to let
+// the proxy resolve the domain name.
+func (c *PacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	as, err := proxy.ParseAddrSpec(addr.String())
+	if err != nil {
+		return 0, err
+	}
+	header, err := as.MarshalBinary()
+	if err != nil {
+		return 0, err
+	}
+	msg := append([]byte{0x00, 0x00, 0x00}, header...)
+	if _, err := c.conn.WriteToUDP(append(msg, b...), c.relay); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close ends the association.
+func (c *PacketConn) Close() error {
+	c.once.Do(func() {
+		c.ctrl.Close()
+		c.closeErr = c.conn.Close()
+	})
+	return c.closeErr
+}
+
+// LocalAddr ...
+func (c *PacketConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+// RelayAddr is the address of the UDP relay of the proxy.
+func (c *PacketConn) RelayAddr() net.Addr {
+	return c.relay
+}
+
+// SetDeadline ...
+func (c *PacketConn) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+// SetReadDeadline ...
+func (c *PacketConn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline ...
+func (c *PacketConn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
@@ -0,0 +1,68 @@
+package client
+
+import (
+	"context"
+	"net"
+
+	"github.com/remones/gsocks/config"
+	"github.com/remones/gsocks/proxy"
+)
+
+// The Dialers of this package serve as the upstream proxies of the server,
+// a program using them in the config imports this package.
+func init() {
+	proxy.RegisterUpstream("socks5", newSocks5Upstream)
+	proxy.RegisterUpstream("socks4a", newSocks4Upstream)
+	proxy.RegisterUpstream("http", newHTTPUpstream)
+}
+
+func forwardDial(forward proxy.Dialer) func(ctx context.Context, network, address string) (net.Conn, error) {
+	if forward == nil {
+		return nil
+	}
+	return forward.DialContext
+}
+
+func newSocks5Upstream(cfg *config.Upstream, forward proxy.Dialer) (proxy.Dialer, error) {
+	d := &Dialer{
+		ProxyAddress: cfg.Address,
+		ProxyDial:    forwardDial(forward),
+	}
+	if cfg.Username != "" {
+		d.Auth = &Auth{Username: cfg.Username, Password: cfg.Password}
+	}
+	if forward != nil {
+		// the datagrams can not reach a relay behind other proxies
+		return &chainedDialer{d}, nil
+	}
+	return d, nil
+}
+
+func newSocks4Upstream(cfg *config.Upstream, forward proxy.Dialer) (proxy.Dialer, error) {
+	return &Socks4Dialer{
+		ProxyAddress: cfg.Address,
+		UserID:       cfg.Username,
+		ProxyDial:    forwardDial(forward),
+	}, nil
+}
+
+func newHTTPUpstream(cfg *config.Upstream, forward proxy.Dialer) (proxy.Dialer, error) {
+	d := &HTTPDialer{
+		ProxyAddress: cfg.Address,
+		ProxyDial:    forwardDial(forward),
+	}
+	if cfg.Username != "" {
+		d.Auth = &Auth{Username: cfg.Username, Password: cfg.Password}
+	}
+	return d, nil
+}
+
+// chainedDialer hides ListenPacket of a Dialer reached through other
+// proxies.
+type chainedDialer struct {
+	d *Dialer
+}
+
+func (c *chainedDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return c.d.DialContext(ctx, network, address)
+}
@@ -0,0 +1,229 @@
+package client
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/remones/gsocks/config"
+	"github.com/remones/gsocks/proxy"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpstreamChain(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+	_, port, _ := net.SplitHostPort(echo.Addr().String())
+
+	// open serves every method without authentication, locked requires
+	// testAuth.
+	open := serveConfig(t, config.NewConfig())
+	defer open.stop()
+	lockedCfg := config.NewConfig()
+	lockedCfg.Auth = config.Auth{
+		UserPasswd: &config.UserPasswd{
+			Enable:  true,
+			Account: []config.Account{{Username: testAuth.Username, Password: testAuth.Password}},
+		},
+	}
+	locked := serveConfig(t, lockedCfg)
+	defer locked.stop()
+
+	tests := []struct {
+		name     string
+		upstream []config.Upstream
+		via      []*testServer
+	}{
+		{
+			name:     "socks5",
+			upstream: []config.Upstream{{Type: "socks5", Address: open.addr}},
+			via:      []*testServer{open},
+		},
+		{
+			name: "socks5_auth",
+			upstream: []config.Upstream{
+				{Type: "socks5", Address: locked.addr, Username: testAuth.Username, Password: testAuth.Password},
+			},
+			via: []*testServer{locked},
+		},
+		{
+			name:     "socks4a",
+			upstream: []config.Upstream{{Type: "socks4a", Address: open.addr}},
+			via:      []*testServer{open},
+		},
+		{
+			name: "http_auth",
+			upstream: []config.Upstream{
+				{Type: "http", Address: locked.addr, Username: testAuth.Username, Password: testAuth.Password},
+			},
+			via: []*testServer{locked},
+		},
+		{
+			name: "socks5_http",
+			upstream: []config.Upstream{
+				{Type: "socks5", Address: open.addr},
+				{Type: "http", Address: locked.addr, Username: testAuth.Username, Password: testAuth.Password},
+			},
+			via: []*testServer{open, locked},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.NewConfig()
+			cfg.Upstream = tt.upstream
+			entry := serveConfig(t, cfg)
+			defer entry.stop()
+			before := make([]int32, len(tt.via))
+			for i, srv := range tt.via {
+				before[i] = atomic.LoadInt32(&srv.accepted)
+			}
+
+			// the domain name is resolved by the last upstream
+			conn, err := NewDialer("tcp", entry.addr, nil).Dial("tcp", net.JoinHostPort("localhost", port))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			_, err = conn.Write([]byte("ping"))
+			assert.NoError(t, err)
+			b := make([]byte, 4)
+			_, err = io.ReadFull(conn, b)
+			assert.NoError(t, err)
+			assert.Equal(t, "ping", string(b))
+
+			for i, srv := range tt.via {
+				assert.Equal(t, before[i]+1, atomic.LoadInt32(&srv.accepted), "upstream %d", i)
+			}
+		})
+	}
+}
+
+func TestUpstreamUDP(t *testing.T) {
+	target, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		b := make([]byte, 1024)
+		for {
+			n, from, err := target.ReadFromUDP(b)
+			if err != nil {
+				return
+			}
+			target.WriteToUDP(b[:n], from)
+		}
+	}()
+
+	upstream := serveConfig(t, config.NewConfig())
+	defer upstream.stop()
+	cfg := config.NewConfig()
+	cfg.Upstream = []config.Upstream{{Type: "socks5", Address: upstream.addr}}
+	entry := serveConfig(t, cfg)
+	defer entry.stop()
+
+	pc, err := NewDialer("tcp", entry.addr, nil).ListenPacket(context.Background(), "udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	_, err = pc.WriteTo([]byte("ping"), target.LocalAddr())
+	assert.NoError(t, err)
+	b := make([]byte, 1024)
+	pc.SetReadDeadline(time.Now().Add(time.Second))
+	n, from, err := pc.ReadFrom(b)
+	assert.NoError(t, err)
+	assert.Equal(t, "ping", string(b[:n]))
+	assert.Equal(t, target.LocalAddr().String(), from.String())
+
+	// the datagrams went through the relay of the upstream
+	mappings := upstream.UDPMappings()
+	if assert.Len(t, mappings, 1) {
+		assert.Equal(t, target.LocalAddr().String(), mappings[0].Destination.String())
+	}
+}
+
+func TestUpstreamUDPChainRefused(t *testing.T) {
+	first := serveConfig(t, config.NewConfig())
+	defer first.stop()
+	second := serveConfig(t, config.NewConfig())
+	defer second.stop()
+	cfg := config.NewConfig()
+	cfg.Upstream = []config.Upstream{
+		{Type: "socks5", Address: first.addr},
+		{Type: "socks5", Address: second.addr},
+	}
+	entry := serveConfig(t, cfg)
+	defer entry.stop()
+
+	_, err := NewDialer("tcp", entry.addr, nil).ListenPacket(context.Background(), "udp", "127.0.0.1:0")
+	assert.Equal(t, &ReplyError{Code: proxy.ReplyNotAllowed}, err)
+}
+
+func TestUpstreamRoutes(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+	_, port, _ := net.SplitHostPort(echo.Addr().String())
+	closed := startEchoServer(t)
+	_, closedPort, _ := net.SplitHostPort(closed.Addr().String())
+	closed.Close()
+
+	upstream := serveConfig(t, config.NewConfig())
+	defer upstream.stop()
+	cfg := config.NewConfig()
+	cfg.Outbound = []config.Outbound{
+		{Name: "via", Type: "upstream", Upstream: []config.Upstream{{Type: "socks5", Address: upstream.addr}}},
+	}
+	cfg.Route = []config.Route{
+		{Outbound: "reject", Ports: []string{closedPort}},
+		{Outbound: "via", Domains: []string{"localhost"}},
+	}
+	entry := serveConfig(t, cfg)
+	defer entry.stop()
+	d := NewDialer("tcp", entry.addr, nil)
+
+	tests := []struct {
+		name    string
+		addr    string
+		via     int32
+		wantErr error
+	}{
+		{"direct", net.JoinHostPort("127.0.0.1", port), 0, nil},
+		{"upstream", net.JoinHostPort("localhost", port), 1, nil},
+		{"reject", net.JoinHostPort("localhost", closedPort), 0, &ReplyError{Code: proxy.ReplyNotAllowed}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := atomic.LoadInt32(&upstream.accepted)
+			conn, err := d.Dial("tcp", tt.addr)
+			assert.Equal(t, tt.wantErr, err)
+			if err == nil {
+				conn.Close()
+			}
+			assert.Equal(t, before+tt.via, atomic.LoadInt32(&upstream.accepted))
+		})
+	}
+}
+
+func TestSocks4Dialer_request(t *testing.T) {
+	tests := []struct {
+		addr    string
+		want    []byte
+		wantErr error
+	}{
+		{"10.0.0.1:80", []byte{4, 1, 0, 80, 10, 0, 0, 1, 'u', 0}, nil},
+		{"example.com:80", append([]byte{4, 1, 0, 80, 0, 0, 0, 1, 'u', 0}, "example.com\x00"...), nil},
+		{"[::1]:80", nil, ErrSocks4IPv6},
+	}
+	d := &Socks4Dialer{UserID: "u"}
+	for _, tt := range tests {
+		dest, err := proxy.ParseAddrSpec(tt.addr)
+		assert.NoError(t, err)
+		got, err := d.request(dest)
+		assert.Equal(t, tt.wantErr, err, tt.addr)
+		assert.Equal(t, tt.want, got, tt.addr)
+	}
+}
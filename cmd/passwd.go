@@ -0,0 +1,54 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/remones/gsocks/proxy"
+	"github.com/spf13/cobra"
+)
+
+var (
+	passwdAlgorithm string
+	passwdUsername  string
+)
+
+var passwdCmd = &cobra.Command{
+	Use:   "passwd [password]",
+	Short: "Hash a password for the config or an htpasswd file",
+	Long: `Hash a password for the password of an account, or a line of an htpasswd
+file with --username. The password is read from the standard input if not
+given.`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		var password string
+		if len(args) > 0 {
+			password = args[0]
+		} else {
+			line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+			if err != nil && line == "" {
+				fmt.Println("Can't read password: ", err)
+				os.Exit(1)
+			}
+			password = strings.TrimRight(line, "\r\n")
+		}
+		hashed, err := proxy.HashPassword(passwdAlgorithm, password)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if passwdUsername != "" {
+			fmt.Printf("%s:%s\n", passwdUsername, hashed)
+			return
+		}
+		fmt.Println(hashed)
+	},
+}
+
+func init() {
+	passwdCmd.Flags().StringVar(&passwdAlgorithm, "algorithm", proxy.HashBcrypt,
+		"hash algorithm: bcrypt, argon2id, sha256-crypt or sha512-crypt")
+	passwdCmd.Flags().StringVar(&passwdUsername, "username", "", "print an htpasswd line of the username")
+}
@@ -7,6 +7,8 @@ import (
 	"os/signal"
 	"syscall"
 
+	// registers the upstream proxy types
+	_ "github.com/remones/gsocks/client"
 	"github.com/remones/gsocks/config"
 	"github.com/remones/gsocks/proxy"
 	"github.com/spf13/cobra"
@@ -27,9 +29,23 @@ var (
 		Short: "start a gsocks server",
 		Long:  `start a gsocks sever`,
 		Run: func(cmd *cobra.Command, args []string) {
-			srv := proxy.NewServer(cfg)
+			srv, err := proxy.NewServer(cfg)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
 			idleConnsClosed := make(chan struct{})
 
+			go func() {
+				hupCh := make(chan os.Signal, 1)
+				signal.Notify(hupCh, syscall.SIGHUP)
+				for range hupCh {
+					if err := srv.ReloadTLS(); err != nil {
+						fmt.Println(err)
+					}
+				}
+			}()
+
 			go func() {
 				sigCh := make(chan os.Signal, 1)
 				signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
@@ -41,7 +57,9 @@ var (
 				close(idleConnsClosed)
 			}()
 
-			if err := srv.ListenAndServe(); err != nil {
+			// the server is closed by the signal handler, which returns once
+			// the sessions ended.
+			if err := srv.ListenAndServe(); err != nil && err != proxy.ErrServerClosed {
 				fmt.Println(err)
 				os.Exit(1)
 			}
@@ -62,6 +80,7 @@ func init() {
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file")
 	rootCmd.AddCommand(serveCmd)
 	rootCmd.AddCommand(versionCmd)
+	rootCmd.AddCommand(passwdCmd)
 }
 
 func initConfig() {
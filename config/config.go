@@ -2,6 +2,10 @@ package config
 
 import (
 	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
 
 	"github.com/BurntSushi/toml"
 )
@@ -12,6 +16,264 @@ type Config struct {
 	Port        uint   `toml:"port"`
 	DialTimeout int    `toml:"dial_timeout"`
 	Auth        Auth   `toml:"auth"`
+	Bind        Bind   `toml:"bind"`
+	UDP         UDP    `toml:"udp"`
+	ACL         ACL    `toml:"acl"`
+	Client      Client `toml:"client"`
+	// TLS serves the clients over TLS, plain TCP if nil
+	TLS *TLS `toml:"tls"`
+	// ProxyProtocol reads the address of the clients of load balancers
+	// from their PROXY protocol header.
+	ProxyProtocol *ProxyProtocol `toml:"proxy_protocol"`
+	// Unix is the socket file of a Host of "unix:///path", Port is ignored
+	// then.
+	Unix *UnixSocket `toml:"unix"`
+	// Listener are the addresses served instead of Host and Port, with
+	// their own TLS, PROXY protocol, methods and policy. The sessions of
+	// all of them count toward the same limits.
+	Listener []Listener `toml:"listener"`
+	// Upstream is the chain of proxies the requests are forwarded through,
+	// the first one is dialed directly and every next one through the
+	// previous ones.
+	Upstream []Upstream `toml:"upstream"`
+	// Outbound declares the named outbounds the routes pick, besides the
+	// builtin "direct" and "reject".
+	Outbound []Outbound `toml:"outbound"`
+	// Route is the routing table, the first matching route picks the
+	// outbound of a request. The requests matching none go through the
+	// upstream chain, or directly if there is none.
+	Route []Route `toml:"route"`
+	// Policy are the authorization policies of the users
+	Policy []Policy `toml:"policy"`
+}
+
+// Policy restricts the sessions of the users it applies to
+type Policy struct {
+	Name string `toml:"name"`
+	// Users are the users of the policy besides the accounts naming it,
+	// e.g. Kerberos principals.
+	Users []string `toml:"users"`
+	// Groups are the groups of the users of the policy, the policy of a
+	// user is picked before the policies of its groups.
+	Groups []string `toml:"groups"`
+	// Commands are the commands allowed, "connect", "bind" or "udp", all
+	// of them if empty.
+	Commands []string `toml:"commands"`
+	// Rule are the destination rules checked before the rules of [acl],
+	// which apply to the requests matching none.
+	Rule []ACLRule `toml:"rule"`
+	// Outbound is the outbound of the requests matching no route, instead
+	// of the upstream proxies.
+	Outbound string `toml:"outbound"`
+	// MaxSessions is the max concurrent sessions of each user, 0 is
+	// unlimited.
+	MaxSessions int `toml:"max_sessions"`
+}
+
+// Outbound is a named way to reach the targets
+type Outbound struct {
+	Name string `toml:"name"`
+	// Type is "direct", "reject" or "upstream"
+	Type string `toml:"type"`
+	// Source is the local IP the direct outbound connects from, e.g. to
+	// leave through a specific interface.
+	Source string `toml:"source"`
+	// Upstream is the chain of proxies of the upstream outbound
+	Upstream []Upstream `toml:"upstream"`
+	// ProxyProtocol, "v1" or "v2", sends the targets a PROXY protocol
+	// header of the address of the client first. The destination of a
+	// domain name the upstream proxies resolve is sent as 0.0.0.0 or ::.
+	ProxyProtocol string `toml:"proxy_protocol"`
+	// ProxyProtocolUserTLV, if not 0, is the type of the TLV of the v2
+	// header carrying the authenticated username, in the custom range
+	// 0xE0-0xEF.
+	ProxyProtocolUserTLV int `toml:"proxy_protocol_user_tlv"`
+}
+
+// Route picks the outbound of the requests matching all its conditions,
+// a condition which is not set matches any request.
+type Route struct {
+	Outbound string `toml:"outbound"`
+	// Domains match the domain names and their subdomains, e.g.
+	// "example.com" matches "www.example.com".
+	Domains     []string `toml:"domains"`
+	DomainRegex []string `toml:"domain_regex"`
+	// Networks are the CIDRs of the destination IP, domain names are
+	// resolved to be matched.
+	Networks []string `toml:"networks"`
+	// Ports are ports or port ranges, e.g. "443" or "8000-8999".
+	Ports []string `toml:"ports"`
+	// Users are the authenticated usernames, and Groups their groups, a
+	// request matches if its user is in either.
+	Users  []string `toml:"users"`
+	Groups []string `toml:"groups"`
+	// Sources are the CIDRs of the client address
+	Sources []string `toml:"sources"`
+}
+
+// Client limits the clients of the server, the connections are checked
+// before anything is read from them.
+type Client struct {
+	// Allow are the CIDRs of the clients served, every client is if empty
+	Allow []string `toml:"allow"`
+	// Deny are the CIDRs of the clients refused, even if allowed
+	Deny []string `toml:"deny"`
+	// MaxSessionsPerIP is the max concurrent sessions of a client IP, and
+	// MaxSessions of all the clients, 0 is unlimited.
+	MaxSessionsPerIP int `toml:"max_sessions_per_ip"`
+	MaxSessions      int `toml:"max_sessions"`
+}
+
+// TLS is the TLS of the listener.
+type TLS struct {
+	Enable bool `toml:"enable"`
+	// CertFile and KeyFile are the PEM certificate chain and key of the
+	// server.
+	CertFile string `toml:"cert_file"`
+	KeyFile  string `toml:"key_file"`
+	// ClientCA is the PEM certificates of the CAs the client certificates
+	// are verified with, the clients are not asked for one if empty.
+	ClientCA string `toml:"client_ca"`
+	// RequireClientCert refuses the clients without a valid certificate
+	RequireClientCert bool `toml:"require_client_cert"`
+	// MinVersion is the min TLS version, "1.0", "1.1", "1.2" (the
+	// default) or "1.3".
+	MinVersion string `toml:"min_version"`
+	// ALPN are the application protocols offered, in preference order
+	ALPN []string `toml:"alpn"`
+	// ClientIdentity, if set, authenticates the clients with a verified
+	// certificate as its "subject" common name or its "san", the first
+	// email address, DNS name or URI, and the organizational units of the
+	// subject as the groups. They are served as such when they offer no
+	// authentication, without a password.
+	ClientIdentity string `toml:"client_identity"`
+	// HandshakeTimeout is the timeout of the handshake in ms, 0 is the
+	// default.
+	HandshakeTimeout int `toml:"handshake_timeout"`
+	// ReloadInterval is how often in ms the certificate and client CA files
+	// are checked for changes to reload them, 0 only reloads them on
+	// SIGHUP.
+	ReloadInterval int `toml:"reload_interval"`
+}
+
+// Listener is an address the server is served on.
+type Listener struct {
+	// Name names the listener in the logs, its address if empty
+	Name string `toml:"name"`
+	// Address is the "host:port" listened on, e.g. "[::1]:1080", or the
+	// path of a unix socket, e.g. "unix:///run/gsocks.sock".
+	Address string `toml:"address"`
+	// Unix is the socket file of a unix address
+	Unix *UnixSocket `toml:"unix"`
+	// TLS and ProxyProtocol are those of the listener, [tls] and
+	// [proxy_protocol] only apply to Host and Port.
+	TLS           *TLS           `toml:"tls"`
+	ProxyProtocol *ProxyProtocol `toml:"proxy_protocol"`
+	// Methods are the methods of the clients of the listener in the order
+	// of preference, instead of those of [auth] and its networks.
+	Methods []string `toml:"methods"`
+	// Policy is the policy of the sessions whose user and groups have none
+	Policy string `toml:"policy"`
+}
+
+// UnixSocket is the socket file of a unix listener, which is created by
+// the server.
+type UnixSocket struct {
+	// Mode is the octal permissions of the file, e.g. "0660"
+	Mode string `toml:"mode"`
+	// Owner and Group are the user and group names or IDs the file is
+	// chowned to, if set.
+	Owner string `toml:"owner"`
+	Group string `toml:"group"`
+	// PeerIdentity authenticates the clients as the user of their process,
+	// by its credentials, when they offer no authentication. Only on
+	// Linux.
+	PeerIdentity bool `toml:"peer_identity"`
+}
+
+// ProxyProtocol is the PROXY protocol v1 and v2 of the listener.
+type ProxyProtocol struct {
+	Enable bool `toml:"enable"`
+	// Trusted are the IPs and networks of the load balancers, which must
+	// send a header, the other clients are served as they connect.
+	Trusted []string `toml:"trusted"`
+	// Timeout is the timeout of the header in ms, 0 is the default.
+	Timeout int `toml:"timeout"`
+}
+
+// ACL decides which destinations the clients may reach, the first matching
+// rule applies.
+type ACL struct {
+	// Default is the action of the requests matching no rule, "allow" (the
+	// default) or "deny".
+	Default string `toml:"default"`
+	// DenyPrivate denies the loopback, link-local, private and other
+	// special-purpose addresses, unless a rule allows their network.
+	DenyPrivate bool      `toml:"deny_private"`
+	Rule        []ACLRule `toml:"rule"`
+}
+
+// ACLRule applies its action to the requests matching all its conditions,
+// a condition which is not set matches any request.
+type ACLRule struct {
+	// Action is "allow" or "deny"
+	Action string `toml:"action"`
+	// Networks are the CIDRs of the destination IP, domain names are
+	// checked once resolved.
+	Networks []string `toml:"networks"`
+	// Domains match the domain names and their subdomains, a domain with
+	// wildcards, e.g. "*.internal", is a pattern.
+	Domains []string `toml:"domains"`
+	// Ports are ports or port ranges, e.g. "443" or "8000-8999".
+	Ports []string `toml:"ports"`
+	// Commands are "connect", "bind" or "udp"
+	Commands []string `toml:"commands"`
+}
+
+// Upstream is a proxy the requests are forwarded through
+type Upstream struct {
+	// Type is "socks5", "socks4a" or "http", which the programs embedding
+	// the server register by importing github.com/remones/gsocks/client.
+	Type    string `toml:"type"`
+	Address string `toml:"address"`
+	// Username and Password authenticate to the proxy if not empty, the
+	// Username is sent as the USERID of SOCKS4a.
+	Username string `toml:"username"`
+	Password string `toml:"password"`
+}
+
+// Bind is the setting of the BIND command
+type Bind struct {
+	// Address is the host to listen on for the incoming connections,
+	// the host of the server is used if empty.
+	Address string `toml:"address"`
+	// AcceptTimeout is the time in milliseconds to wait for the incoming
+	// connection.
+	AcceptTimeout int `toml:"accept_timeout"`
+}
+
+// UDP is the setting of the UDP ASSOCIATE command
+type UDP struct {
+	// Address is the host to relay the datagrams on, the host of the
+	// server is used if empty.
+	Address string `toml:"address"`
+	// Advertise is the IP replied to clients, e.g. the public IP of a
+	// server behind NAT.
+	Advertise string `toml:"advertise"`
+	// FragQueueSize is the max bytes of a reassembly queue of fragmented
+	// datagrams.
+	FragQueueSize int `toml:"frag_queue_size"`
+	// FragTimeout is the reassembly timer in milliseconds, it can not be
+	// less than 5 seconds.
+	FragTimeout int `toml:"frag_timeout"`
+	// MappingTimeout is the idle time in milliseconds after which the
+	// mapping of a destination expires, 2 minutes if 0.
+	MappingTimeout int `toml:"mapping_timeout"`
+	// Filter decides which hosts may reply through the mapping of a
+	// destination: "address-and-port-dependent" (the default) only the
+	// destination, "address-dependent" any port of the destination host,
+	// and "endpoint-independent" any host.
+	Filter string `toml:"filter"`
 }
 
 // Auth ...
@@ -19,11 +281,56 @@ type Auth struct {
 	*UserPasswd `toml:"username_password"`
 	*GssAPI     `toml:"gss_api"`
 	*NoRequired `toml:"no_required"`
+	// Methods are the methods enabled in the order the server prefers
+	// them: "gss_api", "username_password" and "no_required". The method
+	// picked is the first offered by the client, the most secure first if
+	// empty.
+	Methods []string `toml:"methods"`
+	// Network overrides Methods for the clients of networks, the first
+	// matching a client applies.
+	Network []AuthNetwork `toml:"network"`
+	Lockout *Lockout      `toml:"lockout"`
+}
+
+// AuthNetwork are the methods of the clients of networks.
+type AuthNetwork struct {
+	// Networks are the CIDRs of the clients
+	Networks []string `toml:"networks"`
+	// Methods are the methods of the clients, in the order of preference
+	Methods []string `toml:"methods"`
+}
+
+// Lockout slows down and bans the source IPs and the usernames failing the
+// username/password authentication.
+type Lockout struct {
+	Enable bool `toml:"enable"`
+	// MaxFailures in the Window bans the IP or the username, 5 if 0
+	MaxFailures int `toml:"max_failures"`
+	// Window in milliseconds the failures are counted in, 15 minutes if 0
+	Window int `toml:"window"`
+	// Backoff in milliseconds the next attempt is refused after a failure,
+	// doubled by every failure up to MaxBackoff. 1 second and 1 minute if 0.
+	Backoff    int `toml:"backoff"`
+	MaxBackoff int `toml:"max_backoff"`
+	// BanTime in milliseconds, 1 hour if 0
+	BanTime int `toml:"ban_time"`
+	// BanFile keeps the bans across restarts, more bans may be added to it
+	// by hand.
+	BanFile string `toml:"ban_file"`
 }
 
 // GssAPI ...
 type GssAPI struct {
 	Enable bool `toml:"enable"`
+	// Keytab is the path of the Kerberos keytab of the service
+	Keytab string `toml:"keytab"`
+	// ServicePrincipal selects the keytab entry, e.g. "rcmd/proxy.example.com",
+	// the service name of the client's ticket is used if empty.
+	ServicePrincipal string `toml:"service_principal"`
+	// Protection is the per-message protection level the server selects:
+	// "integrity", "confidentiality" or "selective". The level requested by
+	// the client is accepted if empty.
+	Protection string `toml:"protection"`
 }
 
 // NoRequired ...
@@ -33,14 +340,80 @@ type NoRequired struct {
 
 // UserPasswd ...
 type UserPasswd struct {
-	Enable  bool      `toml:"enable"`
+	Enable bool `toml:"enable"`
+	// File is the path of an htpasswd file of more accounts, its hashes are
+	// those of the passwords of Account.
+	File    string    `toml:"file"`
 	Account []Account `toml:"account"`
+	// LDAP, Exec and Webhook verify the accounts which are not in the file
+	// nor in the list, in this order.
+	LDAP    *LDAP              `toml:"ldap"`
+	Exec    *CredentialExec    `toml:"exec"`
+	Webhook *CredentialWebhook `toml:"webhook"`
+}
+
+// LDAP verifies the accounts of a directory server: the entry of the user is
+// searched, then bound to with the password.
+type LDAP struct {
+	// URL of the server, ldap://host[:389] or ldaps://host[:636]
+	URL string `toml:"url"`
+	// StartTLS upgrades an ldap:// connection to TLS
+	StartTLS bool `toml:"start_tls"`
+	// CACert is the path of the PEM certificates of the CAs the server is
+	// verified with, the CAs of the system if empty.
+	CACert             string `toml:"ca_cert"`
+	InsecureSkipVerify bool   `toml:"insecure_skip_verify"`
+	// BindDN and BindPassword are the account the search is done with, an
+	// anonymous search if empty.
+	BindDN       string `toml:"bind_dn"`
+	BindPassword string `toml:"bind_password"`
+	BaseDN       string `toml:"base_dn"`
+	// UserFilter finds the entry of {username}, "(uid={username})" if empty
+	UserFilter string `toml:"user_filter"`
+	// GroupFilter, if not empty, must match an entry under GroupBaseDN,
+	// BaseDN if empty, for the user to be accepted, e.g.
+	// "(&(cn=proxy-users)(member={dn}))".
+	GroupBaseDN string `toml:"group_base_dn"`
+	GroupFilter string `toml:"group_filter"`
+	// CacheTTL in milliseconds the successful verifications are cached, no
+	// cache if 0.
+	CacheTTL int `toml:"cache_ttl"`
+	// Timeout in milliseconds, 5 seconds if 0
+	Timeout int `toml:"timeout"`
+}
+
+// CredentialExec runs a command to verify an account, the username and the
+// password are written to its stdin line by line and the exit code 0 accepts
+// them. The exit code 3 reports an unknown user, which the webhook is asked
+// for then, and any other rejects them.
+type CredentialExec struct {
+	// Command is the path and the arguments of the command
+	Command []string `toml:"command"`
+	// Timeout in milliseconds, 5 seconds if 0
+	Timeout int `toml:"timeout"`
+}
+
+// CredentialWebhook posts {"username": ..., "password": ...} to a URL to
+// verify an account, a 2xx status accepts it, 401, 403 and 404 reject it.
+type CredentialWebhook struct {
+	URL string `toml:"url"`
+	// Headers are added to the requests, e.g. Authorization
+	Headers map[string]string `toml:"headers"`
+	// Timeout in milliseconds, 5 seconds if 0
+	Timeout int `toml:"timeout"`
 }
 
 // Account ...
 type Account struct {
 	Username string `toml:"username"`
+	// Password is a bcrypt, argon2 or SHA-crypt hash, or the plaintext
+	// password.
 	Password string `toml:"password"`
+	// Policy is the name of the [[policy]] of the account, if any
+	Policy string `toml:"policy"`
+	// Groups are the groups of the account, for the policies and the
+	// routes.
+	Groups []string `toml:"groups"`
 }
 
 var defaultConf = Config{
@@ -53,9 +426,21 @@ var defaultConf = Config{
 	},
 }
 
+// UnixScheme prefixes the paths of the unix sockets listened on
+const UnixScheme = "unix://"
+
+// IsUnixAddress reports whether addr is the path of a unix socket, e.g.
+// "unix:///run/gsocks.sock".
+func IsUnixAddress(addr string) bool {
+	return strings.HasPrefix(addr, UnixScheme)
+}
+
 // NewConfig ...
 func NewConfig() *Config {
 	conf := defaultConf
+	// loading a file must not change the defaults of the next configs
+	noRequired := *defaultConf.Auth.NoRequired
+	conf.Auth.NoRequired = &noRequired
 	return &conf
 }
 
@@ -74,6 +459,328 @@ func (c *Config) validate() error {
 			if account.Username == "" {
 				return fmt.Errorf("[auth]: account username can not be empty string")
 			}
+			for _, prefix := range unsupportedHashPrefixes {
+				if strings.HasPrefix(account.Password, prefix) {
+					return fmt.Errorf("[auth]: password hash %s... of account %s is not supported", prefix, account.Username)
+				}
+			}
+		}
+		if ldap := c.Auth.UserPasswd.LDAP; ldap != nil {
+			if u, err := url.Parse(ldap.URL); err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") || u.Host == "" {
+				return fmt.Errorf("[auth.username_password.ldap]: url %q is not an LDAP URL", ldap.URL)
+			}
+			if ldap.StartTLS && strings.HasPrefix(ldap.URL, "ldaps:") {
+				return fmt.Errorf("[auth.username_password.ldap]: start_tls can not be used with ldaps")
+			}
+			if ldap.BaseDN == "" {
+				return fmt.Errorf("[auth.username_password.ldap]: base_dn can not be empty string")
+			}
+			if ldap.CacheTTL < 0 || ldap.Timeout < 0 {
+				return fmt.Errorf("[auth.username_password.ldap]: cache_ttl and timeout can not be negative")
+			}
+		}
+		if exec := c.Auth.UserPasswd.Exec; exec != nil {
+			if len(exec.Command) == 0 || exec.Command[0] == "" {
+				return fmt.Errorf("[auth.username_password.exec]: command can not be empty")
+			}
+			if exec.Timeout < 0 {
+				return fmt.Errorf("[auth.username_password.exec]: timeout can not be negative")
+			}
+		}
+		if hook := c.Auth.UserPasswd.Webhook; hook != nil {
+			if u, err := url.Parse(hook.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("[auth.username_password.webhook]: url %q is not an HTTP URL", hook.URL)
+			}
+			if hook.Timeout < 0 {
+				return fmt.Errorf("[auth.username_password.webhook]: timeout can not be negative")
+			}
+		}
+	}
+	if c.UDP.Advertise != "" && net.ParseIP(c.UDP.Advertise) == nil {
+		return fmt.Errorf("[udp]: advertise %q is not an IP address", c.UDP.Advertise)
+	}
+	if c.UDP.FragTimeout != 0 && c.UDP.FragTimeout < 5000 {
+		return fmt.Errorf("[udp]: frag_timeout can not be less than 5000")
+	}
+	if c.UDP.MappingTimeout < 0 {
+		return fmt.Errorf("[udp]: mapping_timeout can not be negative")
+	}
+	switch c.UDP.Filter {
+	case "", "address-and-port-dependent", "address-dependent", "endpoint-independent":
+	default:
+		return fmt.Errorf("[udp]: unknown filter %q", c.UDP.Filter)
+	}
+	for _, cidr := range append(append([]string(nil), c.Client.Allow...), c.Client.Deny...) {
+		if _, _, err := net.ParseCIDR(cidr); err != nil && net.ParseIP(cidr) == nil {
+			return fmt.Errorf("[client]: invalid CIDR %q", cidr)
+		}
+	}
+	if c.Client.MaxSessionsPerIP < 0 || c.Client.MaxSessions < 0 {
+		return fmt.Errorf("[client]: max sessions can not be negative")
+	}
+	switch c.ACL.Default {
+	case "", "allow", "deny":
+	default:
+		return fmt.Errorf("[acl]: unknown default %q", c.ACL.Default)
+	}
+	if err := validateACLRules("[[acl.rule]]", c.ACL.Rule); err != nil {
+		return err
+	}
+	if err := validateUpstream("[[upstream]]", c.Upstream); err != nil {
+		return err
+	}
+	outbounds := map[string]bool{"direct": true, "reject": true}
+	for _, ob := range c.Outbound {
+		if ob.Name == "" || outbounds[ob.Name] {
+			return fmt.Errorf("[[outbound]]: name %q is empty or duplicated", ob.Name)
+		}
+		outbounds[ob.Name] = true
+		switch ob.Type {
+		case "direct":
+			if ob.Source != "" && net.ParseIP(ob.Source) == nil {
+				return fmt.Errorf("[[outbound]]: source %q of %s is not an IP address", ob.Source, ob.Name)
+			}
+		case "reject":
+		case "upstream":
+			if len(ob.Upstream) == 0 {
+				return fmt.Errorf("[[outbound]]: upstream of %s can not be empty", ob.Name)
+			}
+			if err := validateUpstream("[[outbound.upstream]]", ob.Upstream); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("[[outbound]]: unknown type %q of %s", ob.Type, ob.Name)
+		}
+		switch ob.ProxyProtocol {
+		case "", "v1", "v2":
+		default:
+			return fmt.Errorf("[[outbound]]: unknown proxy_protocol %q of %s", ob.ProxyProtocol, ob.Name)
+		}
+		if tlv := ob.ProxyProtocolUserTLV; tlv != 0 && (ob.ProxyProtocol != "v2" || tlv < 0xE0 || tlv > 0xEF) {
+			return fmt.Errorf("[[outbound]]: proxy_protocol_user_tlv of %s must be 0xE0-0xEF with proxy_protocol v2", ob.Name)
+		}
+	}
+	for i, route := range c.Route {
+		if !outbounds[route.Outbound] {
+			return fmt.Errorf("[[route]]: unknown outbound %q of route %d", route.Outbound, i)
+		}
+	}
+	policies := make(map[string]bool)
+	for _, policy := range c.Policy {
+		if policy.Name == "" || policies[policy.Name] {
+			return fmt.Errorf("[[policy]]: name %q is empty or duplicated", policy.Name)
+		}
+		policies[policy.Name] = true
+		for _, cmd := range policy.Commands {
+			if !isCommand(cmd) {
+				return fmt.Errorf("[[policy]]: unknown command %q of %s", cmd, policy.Name)
+			}
+		}
+		if err := validateACLRules("[[policy.rule]]", policy.Rule); err != nil {
+			return err
+		}
+		if policy.Outbound != "" && !outbounds[policy.Outbound] {
+			return fmt.Errorf("[[policy]]: unknown outbound %q of %s", policy.Outbound, policy.Name)
+		}
+		if policy.MaxSessions < 0 {
+			return fmt.Errorf("[[policy]]: max_sessions of %s can not be negative", policy.Name)
+		}
+	}
+	if c.Auth.UserPasswd != nil {
+		for _, account := range c.Auth.UserPasswd.Account {
+			if account.Policy != "" && !policies[account.Policy] {
+				return fmt.Errorf("[auth]: unknown policy %q of account %s", account.Policy, account.Username)
+			}
+		}
+	}
+	if err := validateTLS("[tls]", c.TLS); err != nil {
+		return err
+	}
+	if err := validateProxyProtocol("[proxy_protocol]", c.ProxyProtocol); err != nil {
+		return err
+	}
+	if err := c.Auth.validateMethods("[auth]", c.Auth.Methods); err != nil {
+		return err
+	}
+	names := make(map[string]bool)
+	if IsUnixAddress(c.Host) && strings.TrimPrefix(c.Host, UnixScheme) == "" {
+		return fmt.Errorf("host: empty path of unix socket")
+	}
+	if err := validateUnix("[unix]", c.Unix); err != nil {
+		return err
+	}
+	for i, l := range c.Listener {
+		if !IsUnixAddress(l.Address) {
+			if _, _, err := net.SplitHostPort(l.Address); err != nil {
+				return fmt.Errorf("[[listener]]: invalid address %q of listener %d", l.Address, i)
+			}
+		} else if strings.TrimPrefix(l.Address, UnixScheme) == "" {
+			return fmt.Errorf("[[listener]]: empty path of unix listener %d", i)
+		}
+		if err := validateUnix("[listener.unix]", l.Unix); err != nil {
+			return err
+		}
+		name := l.Name
+		if name == "" {
+			name = l.Address
+		}
+		if names[name] {
+			return fmt.Errorf("[[listener]]: name %q is duplicated", name)
+		}
+		names[name] = true
+		if err := validateTLS("[listener.tls]", l.TLS); err != nil {
+			return err
+		}
+		if err := validateProxyProtocol("[listener.proxy_protocol]", l.ProxyProtocol); err != nil {
+			return err
+		}
+		if err := c.Auth.validateMethods("[[listener]]", l.Methods); err != nil {
+			return err
+		}
+		if l.Policy != "" && !policies[l.Policy] {
+			return fmt.Errorf("[[listener]]: unknown policy %q of %s", l.Policy, name)
+		}
+	}
+	for i, an := range c.Auth.Network {
+		if len(an.Networks) == 0 || len(an.Methods) == 0 {
+			return fmt.Errorf("[[auth.network]]: networks and methods of network %d can not be empty", i)
+		}
+		for _, cidr := range an.Networks {
+			if _, _, err := net.ParseCIDR(cidr); err != nil && net.ParseIP(cidr) == nil {
+				return fmt.Errorf("[[auth.network]]: invalid CIDR %q", cidr)
+			}
+		}
+		if err := c.Auth.validateMethods("[[auth.network]]", an.Methods); err != nil {
+			return err
+		}
+	}
+	if lo := c.Auth.Lockout; lo != nil {
+		if lo.MaxFailures < 0 || lo.Window < 0 || lo.Backoff < 0 || lo.MaxBackoff < 0 || lo.BanTime < 0 {
+			return fmt.Errorf("[auth.lockout]: max_failures and times can not be negative")
+		}
+	}
+	if c.Auth.GssAPI != nil && c.Auth.GssAPI.Enable {
+		if c.Auth.GssAPI.Keytab == "" {
+			return fmt.Errorf("[auth.gss_api]: keytab can not be empty string")
+		}
+		switch c.Auth.GssAPI.Protection {
+		case "", "integrity", "confidentiality", "selective":
+		default:
+			return fmt.Errorf("[auth.gss_api]: unknown protection %q", c.Auth.GssAPI.Protection)
+		}
+	}
+	return nil
+}
+
+// validateMethods checks that the methods are known and enabled.
+func (a *Auth) validateMethods(section string, methods []string) error {
+	for _, m := range methods {
+		var enabled bool
+		switch m {
+		case "gss_api":
+			enabled = a.GssAPI != nil && a.GssAPI.Enable
+		case "username_password":
+			enabled = a.UserPasswd != nil && a.UserPasswd.Enable
+		case "no_required":
+			enabled = a.NoRequired != nil && a.NoRequired.Enable
+		default:
+			return fmt.Errorf("%s: unknown method %q", section, m)
+		}
+		if !enabled {
+			return fmt.Errorf("%s: method %q is not enabled", section, m)
+		}
+	}
+	return nil
+}
+
+func validateTLS(section string, t *TLS) error {
+	if t == nil || !t.Enable {
+		return nil
+	}
+	if t.CertFile == "" || t.KeyFile == "" {
+		return fmt.Errorf("%s: cert_file and key_file can not be empty", section)
+	}
+	switch t.MinVersion {
+	case "", "1.0", "1.1", "1.2", "1.3":
+	default:
+		return fmt.Errorf("%s: unknown min_version %q", section, t.MinVersion)
+	}
+	switch t.ClientIdentity {
+	case "", "subject", "san":
+	default:
+		return fmt.Errorf("%s: unknown client_identity %q", section, t.ClientIdentity)
+	}
+	if (t.RequireClientCert || t.ClientIdentity != "") && t.ClientCA == "" {
+		return fmt.Errorf("%s: client_ca is required to verify the client certificates", section)
+	}
+	if t.HandshakeTimeout < 0 {
+		return fmt.Errorf("%s: handshake_timeout can not be negative", section)
+	}
+	if t.ReloadInterval < 0 {
+		return fmt.Errorf("%s: reload_interval can not be negative", section)
+	}
+	return nil
+}
+
+func validateUnix(section string, u *UnixSocket) error {
+	if u == nil || u.Mode == "" {
+		return nil
+	}
+	if mode, err := strconv.ParseUint(u.Mode, 8, 32); err != nil || mode > 0777 {
+		return fmt.Errorf("%s: invalid mode %q", section, u.Mode)
+	}
+	return nil
+}
+
+func validateProxyProtocol(section string, pp *ProxyProtocol) error {
+	if pp == nil || !pp.Enable {
+		return nil
+	}
+	if len(pp.Trusted) == 0 {
+		return fmt.Errorf("%s: trusted can not be empty", section)
+	}
+	for _, cidr := range pp.Trusted {
+		if _, _, err := net.ParseCIDR(cidr); err != nil && net.ParseIP(cidr) == nil {
+			return fmt.Errorf("%s: invalid CIDR %q", section, cidr)
+		}
+	}
+	if pp.Timeout < 0 {
+		return fmt.Errorf("%s: timeout can not be negative", section)
+	}
+	return nil
+}
+
+func validateACLRules(section string, rules []ACLRule) error {
+	for i, rule := range rules {
+		if rule.Action != "allow" && rule.Action != "deny" {
+			return fmt.Errorf("%s: unknown action %q of rule %d", section, rule.Action, i)
+		}
+		for _, cmd := range rule.Commands {
+			if !isCommand(cmd) {
+				return fmt.Errorf("%s: unknown command %q of rule %d", section, cmd, i)
+			}
+		}
+	}
+	return nil
+}
+
+// unsupportedHashPrefixes are the prefixes of the MD5-crypt, Apache MD5 and
+// SHA-1 hashes of htpasswd, which the passwords can not be.
+var unsupportedHashPrefixes = []string{"$1$", "$apr1$", "{SHA}"}
+
+func isCommand(cmd string) bool {
+	return cmd == "connect" || cmd == "bind" || cmd == "udp"
+}
+
+func validateUpstream(section string, upstreams []Upstream) error {
+	for i, up := range upstreams {
+		switch up.Type {
+		case "socks5", "socks4a", "http":
+		default:
+			return fmt.Errorf("%s: unknown type %q of upstream %d", section, up.Type, i)
+		}
+		if up.Address == "" {
+			return fmt.Errorf("%s: address of upstream %d can not be empty string", section, i)
 		}
 	}
 	return nil
@@ -13,3 +13,377 @@ func TestConfigLoad(t *testing.T) {
 	assert.Equal(t, "0.0.0.0", cfg.Host)
 	assert.Equal(t, uint(1080), cfg.Port)
 }
+
+// validateTest is a case of validate, setup changes the default config and
+// wantErr is a part of the error, empty if the config is valid.
+type validateTest struct {
+	name    string
+	setup   func(c *Config)
+	wantErr string
+}
+
+func testValidate(t *testing.T, tests []validateTest) {
+	t.Helper()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := NewConfig()
+			tt.setup(cfg)
+			err := cfg.validate()
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+			} else if assert.Error(t, err) {
+				assert.Contains(t, err.Error(), tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestConfig_validateACL(t *testing.T) {
+	testValidate(t, []validateTest{
+		{"default_deny", func(c *Config) {
+			c.ACL = ACL{Default: "deny", DenyPrivate: true}
+		}, ""},
+		{"rules", func(c *Config) {
+			c.ACL.Rule = []ACLRule{
+				{Action: "allow", Networks: []string{"10.0.0.0/8"}, Ports: []string{"80", "8000-8999"}},
+				{Action: "deny", Domains: []string{"*.internal"}, Commands: []string{"bind", "udp"}},
+			}
+		}, ""},
+		{"unknown_default", func(c *Config) {
+			c.ACL.Default = "reject"
+		}, `[acl]: unknown default "reject"`},
+		{"unknown_action", func(c *Config) {
+			c.ACL.Rule = []ACLRule{{Action: "drop"}}
+		}, `[[acl.rule]]: unknown action "drop" of rule 0`},
+		{"unknown_command", func(c *Config) {
+			c.ACL.Rule = []ACLRule{{Action: "deny", Commands: []string{"associate"}}}
+		}, `[[acl.rule]]: unknown command "associate" of rule 0`},
+	})
+}
+
+func TestConfig_validateClient(t *testing.T) {
+	testValidate(t, []validateTest{
+		{"lists_and_limits", func(c *Config) {
+			c.Client = Client{
+				Allow:            []string{"10.0.0.0/8", "192.0.2.1"},
+				Deny:             []string{"10.0.66.0/24"},
+				MaxSessionsPerIP: 16,
+				MaxSessions:      1024,
+			}
+		}, ""},
+		{"invalid_allow", func(c *Config) {
+			c.Client.Allow = []string{"10.0.0.0/33"}
+		}, `[client]: invalid CIDR "10.0.0.0/33"`},
+		{"invalid_deny", func(c *Config) {
+			c.Client.Deny = []string{"example.com"}
+		}, `[client]: invalid CIDR "example.com"`},
+		{"negative_max_sessions_per_ip", func(c *Config) {
+			c.Client.MaxSessionsPerIP = -1
+		}, "[client]: max sessions can not be negative"},
+		{"negative_max_sessions", func(c *Config) {
+			c.Client.MaxSessions = -1
+		}, "[client]: max sessions can not be negative"},
+	})
+}
+
+func TestConfig_validatePolicy(t *testing.T) {
+	testValidate(t, []validateTest{
+		{"policies", func(c *Config) {
+			c.Outbound = []Outbound{{Name: "office", Type: "direct"}}
+			c.Policy = []Policy{
+				{Name: "admins", Users: []string{"alice@EXAMPLE.COM"}},
+				{Name: "guests", Commands: []string{"connect"}, Outbound: "office", MaxSessions: 4,
+					Rule: []ACLRule{{Action: "deny", Ports: []string{"25"}}}},
+			}
+			c.Auth.UserPasswd = &UserPasswd{Enable: true, Account: []Account{{Username: "si.li", Password: "1234", Policy: "guests"}}}
+		}, ""},
+		{"empty_name", func(c *Config) {
+			c.Policy = []Policy{{}}
+		}, `[[policy]]: name "" is empty or duplicated`},
+		{"duplicated_name", func(c *Config) {
+			c.Policy = []Policy{{Name: "guests"}, {Name: "guests"}}
+		}, `[[policy]]: name "guests" is empty or duplicated`},
+		{"unknown_command", func(c *Config) {
+			c.Policy = []Policy{{Name: "guests", Commands: []string{"associate"}}}
+		}, `[[policy]]: unknown command "associate" of guests`},
+		{"unknown_rule_action", func(c *Config) {
+			c.Policy = []Policy{{Name: "guests", Rule: []ACLRule{{Action: "drop"}}}}
+		}, `[[policy.rule]]: unknown action "drop" of rule 0`},
+		{"unknown_outbound", func(c *Config) {
+			c.Policy = []Policy{{Name: "guests", Outbound: "office"}}
+		}, `[[policy]]: unknown outbound "office" of guests`},
+		{"negative_max_sessions", func(c *Config) {
+			c.Policy = []Policy{{Name: "guests", MaxSessions: -1}}
+		}, "[[policy]]: max_sessions of guests can not be negative"},
+		{"unknown_account_policy", func(c *Config) {
+			c.Auth.UserPasswd = &UserPasswd{Enable: true, Account: []Account{{Username: "si.li", Password: "1234", Policy: "guests"}}}
+		}, `[auth]: unknown policy "guests" of account si.li`},
+	})
+}
+
+func TestConfig_validateAccounts(t *testing.T) {
+	testValidate(t, []validateTest{
+		{"hashes_and_file", func(c *Config) {
+			c.Auth.UserPasswd = &UserPasswd{
+				Enable: true,
+				File:   "/etc/gsocks/htpasswd",
+				Account: []Account{
+					{Username: "alice", Password: "$2y$10$2b2cu2a6YjdwQqN3QP1PxOqUf1fR2pHzqNdT3Ey5L4ryQmwJbqHya"},
+					{Username: "bob", Password: "plaintext"},
+				},
+			}
+		}, ""},
+		{"empty_username", func(c *Config) {
+			c.Auth.UserPasswd = &UserPasswd{Enable: true, Account: []Account{{Password: "1234"}}}
+		}, "[auth]: account username can not be empty string"},
+		{"apache_md5", func(c *Config) {
+			c.Auth.UserPasswd = &UserPasswd{Enable: true, Account: []Account{{Username: "alice", Password: "$apr1$salt$hash"}}}
+		}, "[auth]: password hash $apr1$... of account alice is not supported"},
+		{"sha1", func(c *Config) {
+			c.Auth.UserPasswd = &UserPasswd{Enable: true, Account: []Account{{Username: "alice", Password: "{SHA}hash"}}}
+		}, "[auth]: password hash {SHA}... of account alice is not supported"},
+	})
+}
+
+func TestConfig_validateCredentialStores(t *testing.T) {
+	testValidate(t, []validateTest{
+		{"exec_and_webhook", func(c *Config) {
+			c.Auth.UserPasswd = &UserPasswd{
+				Enable:  true,
+				Exec:    &CredentialExec{Command: []string{"/usr/local/bin/gsocks-auth"}, Timeout: 1000},
+				Webhook: &CredentialWebhook{URL: "https://id.example.com/v1/verify", Timeout: 1000},
+			}
+		}, ""},
+		{"empty_command", func(c *Config) {
+			c.Auth.UserPasswd = &UserPasswd{Enable: true, Exec: &CredentialExec{}}
+		}, "[auth.username_password.exec]: command can not be empty"},
+		{"negative_exec_timeout", func(c *Config) {
+			c.Auth.UserPasswd = &UserPasswd{Enable: true, Exec: &CredentialExec{Command: []string{"true"}, Timeout: -1}}
+		}, "[auth.username_password.exec]: timeout can not be negative"},
+		{"webhook_url", func(c *Config) {
+			c.Auth.UserPasswd = &UserPasswd{Enable: true, Webhook: &CredentialWebhook{URL: "ftp://id.example.com"}}
+		}, `[auth.username_password.webhook]: url "ftp://id.example.com" is not an HTTP URL`},
+		{"negative_webhook_timeout", func(c *Config) {
+			c.Auth.UserPasswd = &UserPasswd{Enable: true, Webhook: &CredentialWebhook{URL: "http://127.0.0.1:8080", Timeout: -1}}
+		}, "[auth.username_password.webhook]: timeout can not be negative"},
+	})
+}
+
+func TestConfig_validateLDAP(t *testing.T) {
+	ldap := func(l LDAP) func(c *Config) {
+		return func(c *Config) {
+			c.Auth.UserPasswd = &UserPasswd{Enable: true, LDAP: &l}
+		}
+	}
+	testValidate(t, []validateTest{
+		{"ldaps", ldap(LDAP{URL: "ldaps://ldap.example.com", BaseDN: "dc=example,dc=com", CacheTTL: 60000}), ""},
+		{"start_tls", ldap(LDAP{URL: "ldap://ldap.example.com:389", StartTLS: true, BaseDN: "dc=example,dc=com"}), ""},
+		{"not_ldap_url", ldap(LDAP{URL: "http://ldap.example.com", BaseDN: "dc=example,dc=com"}),
+			`[auth.username_password.ldap]: url "http://ldap.example.com" is not an LDAP URL`},
+		{"no_host", ldap(LDAP{URL: "ldap://", BaseDN: "dc=example,dc=com"}),
+			`[auth.username_password.ldap]: url "ldap://" is not an LDAP URL`},
+		{"start_tls_ldaps", ldap(LDAP{URL: "ldaps://ldap.example.com", StartTLS: true, BaseDN: "dc=example,dc=com"}),
+			"[auth.username_password.ldap]: start_tls can not be used with ldaps"},
+		{"empty_base_dn", ldap(LDAP{URL: "ldap://ldap.example.com"}),
+			"[auth.username_password.ldap]: base_dn can not be empty string"},
+		{"negative_timeout", ldap(LDAP{URL: "ldap://ldap.example.com", BaseDN: "dc=example,dc=com", Timeout: -1}),
+			"[auth.username_password.ldap]: cache_ttl and timeout can not be negative"},
+	})
+}
+
+func TestConfig_validateLockout(t *testing.T) {
+	testValidate(t, []validateTest{
+		{"lockout", func(c *Config) {
+			c.Auth.Lockout = &Lockout{Enable: true, MaxFailures: 3, Window: 60000, Backoff: 500,
+				MaxBackoff: 30000, BanTime: 3600000, BanFile: "/var/lib/gsocks/bans"}
+		}, ""},
+		{"defaults", func(c *Config) {
+			c.Auth.Lockout = &Lockout{Enable: true}
+		}, ""},
+		{"negative_max_failures", func(c *Config) {
+			c.Auth.Lockout = &Lockout{Enable: true, MaxFailures: -1}
+		}, "[auth.lockout]: max_failures and times can not be negative"},
+		{"negative_ban_time", func(c *Config) {
+			c.Auth.Lockout = &Lockout{Enable: true, BanTime: -1}
+		}, "[auth.lockout]: max_failures and times can not be negative"},
+	})
+}
+
+func TestConfig_validateGroups(t *testing.T) {
+	testValidate(t, []validateTest{
+		{"groups", func(c *Config) {
+			c.Auth.UserPasswd = &UserPasswd{Enable: true, Account: []Account{
+				{Username: "si.li", Password: "1234", Groups: []string{"staff", "ops"}},
+			}}
+			c.Policy = []Policy{{Name: "staff", Groups: []string{"staff"}, Users: []string{"alice@EXAMPLE.COM"}}}
+			c.Route = []Route{{Outbound: "direct", Users: []string{"si.li"}, Groups: []string{"ops"}}}
+		}, ""},
+		// the groups name the policy of their users, not the policy itself
+		{"unknown_policy_of_grouped_account", func(c *Config) {
+			c.Auth.UserPasswd = &UserPasswd{Enable: true, Account: []Account{
+				{Username: "si.li", Password: "1234", Groups: []string{"staff"}, Policy: "staff"},
+			}}
+		}, `[auth]: unknown policy "staff" of account si.li`},
+	})
+}
+
+func TestConfig_validateMethods(t *testing.T) {
+	userPasswd := func(c *Config) {
+		c.Auth.UserPasswd = &UserPasswd{Enable: true}
+	}
+	testValidate(t, []validateTest{
+		{"methods_and_networks", func(c *Config) {
+			userPasswd(c)
+			c.Auth.Methods = []string{"username_password", "no_required"}
+			c.Auth.Network = []AuthNetwork{{Networks: []string{"10.0.0.0/8", "192.0.2.1"}, Methods: []string{"no_required"}}}
+		}, ""},
+		{"unknown_method", func(c *Config) {
+			c.Auth.Methods = []string{"password"}
+		}, `[auth]: unknown method "password"`},
+		{"method_not_enabled", func(c *Config) {
+			c.Auth.Methods = []string{"username_password"}
+		}, `[auth]: method "username_password" is not enabled`},
+		{"empty_network", func(c *Config) {
+			c.Auth.Network = []AuthNetwork{{Methods: []string{"no_required"}}}
+		}, "[[auth.network]]: networks and methods of network 0 can not be empty"},
+		{"empty_network_methods", func(c *Config) {
+			c.Auth.Network = []AuthNetwork{{Networks: []string{"10.0.0.0/8"}}}
+		}, "[[auth.network]]: networks and methods of network 0 can not be empty"},
+		{"invalid_network", func(c *Config) {
+			c.Auth.Network = []AuthNetwork{{Networks: []string{"10.0.0.0/33"}, Methods: []string{"no_required"}}}
+		}, `[[auth.network]]: invalid CIDR "10.0.0.0/33"`},
+		{"network_method_not_enabled", func(c *Config) {
+			c.Auth.Network = []AuthNetwork{{Networks: []string{"10.0.0.0/8"}, Methods: []string{"gss_api"}}}
+		}, `[[auth.network]]: method "gss_api" is not enabled`},
+	})
+}
+
+func TestConfig_validateTLS(t *testing.T) {
+	tls := func(tc TLS) func(c *Config) {
+		return func(c *Config) {
+			tc.Enable = true
+			c.TLS = &tc
+		}
+	}
+	testValidate(t, []validateTest{
+		{"server_cert", tls(TLS{CertFile: "server.crt", KeyFile: "server.key", MinVersion: "1.3", ALPN: []string{"socks"}}), ""},
+		{"client_certs", tls(TLS{CertFile: "server.crt", KeyFile: "server.key", ClientCA: "ca.crt",
+			RequireClientCert: true, ClientIdentity: "san", HandshakeTimeout: 5000}), ""},
+		{"disabled", func(c *Config) {
+			c.TLS = &TLS{}
+		}, ""},
+		{"no_key", tls(TLS{CertFile: "server.crt"}), "[tls]: cert_file and key_file can not be empty"},
+		{"unknown_min_version", tls(TLS{CertFile: "server.crt", KeyFile: "server.key", MinVersion: "1.4"}),
+			`[tls]: unknown min_version "1.4"`},
+		{"unknown_client_identity", tls(TLS{CertFile: "server.crt", KeyFile: "server.key", ClientCA: "ca.crt", ClientIdentity: "cn"}),
+			`[tls]: unknown client_identity "cn"`},
+		{"client_identity_without_ca", tls(TLS{CertFile: "server.crt", KeyFile: "server.key", ClientIdentity: "subject"}),
+			"[tls]: client_ca is required to verify the client certificates"},
+		{"require_client_cert_without_ca", tls(TLS{CertFile: "server.crt", KeyFile: "server.key", RequireClientCert: true}),
+			"[tls]: client_ca is required to verify the client certificates"},
+		{"negative_handshake_timeout", tls(TLS{CertFile: "server.crt", KeyFile: "server.key", HandshakeTimeout: -1}),
+			"[tls]: handshake_timeout can not be negative"},
+		{"reload_interval", tls(TLS{CertFile: "server.crt", KeyFile: "server.key", ReloadInterval: 60000}), ""},
+		{"negative_reload_interval", tls(TLS{CertFile: "server.crt", KeyFile: "server.key", ReloadInterval: -1}),
+			"[tls]: reload_interval can not be negative"},
+	})
+}
+
+func TestConfig_validateProxyProtocol(t *testing.T) {
+	pp := func(p ProxyProtocol) func(c *Config) {
+		return func(c *Config) {
+			p.Enable = true
+			c.ProxyProtocol = &p
+		}
+	}
+	testValidate(t, []validateTest{
+		{"trusted", pp(ProxyProtocol{Trusted: []string{"10.0.0.0/8", "192.0.2.1"}, Timeout: 3000}), ""},
+		{"disabled", func(c *Config) {
+			c.ProxyProtocol = &ProxyProtocol{}
+		}, ""},
+		{"empty_trusted", pp(ProxyProtocol{}), "[proxy_protocol]: trusted can not be empty"},
+		{"invalid_trusted", pp(ProxyProtocol{Trusted: []string{"lb.example.com"}}),
+			`[proxy_protocol]: invalid CIDR "lb.example.com"`},
+		{"negative_timeout", pp(ProxyProtocol{Trusted: []string{"10.0.0.0/8"}, Timeout: -1}),
+			"[proxy_protocol]: timeout can not be negative"},
+	})
+}
+
+func TestConfig_validateOutboundProxyProtocol(t *testing.T) {
+	outbound := func(version string, tlv int) func(c *Config) {
+		return func(c *Config) {
+			c.Outbound = []Outbound{{Name: "backend", Type: "direct", ProxyProtocol: version, ProxyProtocolUserTLV: tlv}}
+		}
+	}
+	testValidate(t, []validateTest{
+		{"v1", outbound("v1", 0), ""},
+		{"v2_user_tlv", outbound("v2", 0xE0), ""},
+		{"unknown_version", outbound("v3", 0), `[[outbound]]: unknown proxy_protocol "v3" of backend`},
+		{"user_tlv_v1", outbound("v1", 0xE0),
+			"[[outbound]]: proxy_protocol_user_tlv of backend must be 0xE0-0xEF with proxy_protocol v2"},
+		{"user_tlv_out_of_range", outbound("v2", 0xF0),
+			"[[outbound]]: proxy_protocol_user_tlv of backend must be 0xE0-0xEF with proxy_protocol v2"},
+	})
+}
+
+func TestConfig_validateListener(t *testing.T) {
+	testValidate(t, []validateTest{
+		{"listeners", func(c *Config) {
+			c.Auth.UserPasswd = &UserPasswd{Enable: true}
+			c.Policy = []Policy{{Name: "guests", Commands: []string{"connect"}}}
+			c.Listener = []Listener{
+				{Name: "public", Address: "0.0.0.0:1080", Methods: []string{"username_password"},
+					TLS: &TLS{Enable: true, CertFile: "server.crt", KeyFile: "server.key"}},
+				{Name: "local", Address: "[::1]:1081", Methods: []string{"no_required"}, Policy: "guests",
+					ProxyProtocol: &ProxyProtocol{Enable: true, Trusted: []string{"::1"}}},
+				// named by its address
+				{Address: "127.0.0.1:1082"},
+			}
+		}, ""},
+		{"invalid_address", func(c *Config) {
+			c.Listener = []Listener{{Address: "1080"}}
+		}, `[[listener]]: invalid address "1080" of listener 0`},
+		{"duplicated_name", func(c *Config) {
+			c.Listener = []Listener{{Name: "public", Address: ":1080"}, {Name: "public", Address: ":1081"}}
+		}, `[[listener]]: name "public" is duplicated`},
+		{"duplicated_address", func(c *Config) {
+			c.Listener = []Listener{{Address: ":1080"}, {Address: ":1080"}}
+		}, `[[listener]]: name ":1080" is duplicated`},
+		{"tls", func(c *Config) {
+			c.Listener = []Listener{{Address: ":1080", TLS: &TLS{Enable: true}}}
+		}, "[listener.tls]: cert_file and key_file can not be empty"},
+		{"proxy_protocol", func(c *Config) {
+			c.Listener = []Listener{{Address: ":1080", ProxyProtocol: &ProxyProtocol{Enable: true}}}
+		}, "[listener.proxy_protocol]: trusted can not be empty"},
+		{"method_not_enabled", func(c *Config) {
+			c.Listener = []Listener{{Address: ":1080", Methods: []string{"gss_api"}}}
+		}, `[[listener]]: method "gss_api" is not enabled`},
+		{"unknown_policy", func(c *Config) {
+			c.Listener = []Listener{{Name: "local", Address: ":1080", Policy: "guests"}}
+		}, `[[listener]]: unknown policy "guests" of local`},
+	})
+}
+
+func TestConfig_validateUnix(t *testing.T) {
+	testValidate(t, []validateTest{
+		{"host", func(c *Config) {
+			c.Host = "unix:///run/gsocks.sock"
+			c.Unix = &UnixSocket{Mode: "0660", Owner: "gsocks", Group: "1000", PeerIdentity: true}
+		}, ""},
+		{"listener", func(c *Config) {
+			c.Listener = []Listener{{Address: "unix:///run/gsocks.sock", Unix: &UnixSocket{Mode: "600"}}}
+		}, ""},
+		{"empty_host_path", func(c *Config) {
+			c.Host = "unix://"
+		}, "host: empty path of unix socket"},
+		{"empty_listener_path", func(c *Config) {
+			c.Listener = []Listener{{Address: "unix://"}}
+		}, "[[listener]]: empty path of unix listener 0"},
+		{"not_octal_mode", func(c *Config) {
+			c.Unix = &UnixSocket{Mode: "0689"}
+		}, `[unix]: invalid mode "0689"`},
+		{"mode_out_of_range", func(c *Config) {
+			c.Listener = []Listener{{Address: "unix:///run/gsocks.sock", Unix: &UnixSocket{Mode: "1777"}}}
+		}, `[listener.unix]: invalid mode "1777"`},
+	})
+}
@@ -0,0 +1,277 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/remones/gsocks/config"
+)
+
+// errors
+var (
+	ErrACLDenied = errors.New("socks: destination denied by the ACL")
+)
+
+// privateNetworks are the special-purpose networks denied by deny_private,
+// e.g. the cloud metadata endpoints are in the link-local network.
+var privateNetworks = mustParseCIDRs(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"64:ff9b::/96",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+)
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets, err := parseCIDRs(cidrs)
+	if err != nil {
+		panic(err)
+	}
+	return nets
+}
+
+var aclCommands = map[string]uint8{
+	"connect": CmdConnect,
+	"bind":    CmdBind,
+	"udp":     CmdUDP,
+}
+
+// aclVerdict is the decision of the ACL on a request, it is unknown until
+// the destination is resolved if a rule needs its IP.
+type aclVerdict int
+
+const (
+	aclUnknown aclVerdict = iota
+	aclAllow
+	aclDeny
+)
+
+type acl struct {
+	denyDefault bool
+	denyPrivate bool
+	rules       []*aclRule
+}
+
+type aclRule struct {
+	allow    bool
+	networks []*net.IPNet
+	domains  []string
+	ports    []portRange
+	commands map[uint8]bool
+}
+
+// newACL compiles the ACL of cfg, nil is returned if it allows everything.
+func newACL(cfg *config.ACL) (*acl, error) {
+	if cfg.Default != "deny" && !cfg.DenyPrivate && len(cfg.Rule) == 0 {
+		return nil, nil
+	}
+	rules, err := newACLRules(cfg.Rule)
+	if err != nil {
+		return nil, err
+	}
+	return &acl{
+		denyDefault: cfg.Default == "deny",
+		denyPrivate: cfg.DenyPrivate,
+		rules:       rules,
+	}, nil
+}
+
+func newACLRules(cfg []config.ACLRule) ([]*aclRule, error) {
+	var rules []*aclRule
+	for i, rc := range cfg {
+		r := &aclRule{
+			allow:   rc.Action == "allow",
+			domains: normalizeDomains(rc.Domains),
+		}
+		var err error
+		if r.networks, err = parseCIDRs(rc.Networks); err != nil {
+			return nil, fmt.Errorf("socks: networks of ACL rule %d: %v", i, err)
+		}
+		for _, p := range rc.Ports {
+			pr, err := parsePortRange(p)
+			if err != nil {
+				return nil, fmt.Errorf("socks: ports of ACL rule %d: %v", i, err)
+			}
+			r.ports = append(r.ports, pr)
+		}
+		if len(rc.Commands) > 0 {
+			r.commands = make(map[uint8]bool)
+			for _, name := range rc.Commands {
+				cmd, ok := aclCommands[name]
+				if !ok {
+					return nil, fmt.Errorf("socks: unknown command %q of ACL rule %d", name, i)
+				}
+				r.commands[cmd] = true
+			}
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// check decides on the request cmd to dest, ip is the resolved IP of dest
+// or nil if it is not resolved yet. A nil dest is not known yet, e.g. the
+// destinations of UDP ASSOCIATE. A nil ACL allows everything.
+func (a *acl) check(cmd uint8, dest *AddrSpec, ip net.IP) aclVerdict {
+	if a == nil {
+		return aclAllow
+	}
+	ip = destIP(dest, ip)
+	if verdict, ok := a.checkRules(a.rules, cmd, dest, ip); ok {
+		return verdict
+	}
+	if a.denyPrivate {
+		if ip == nil {
+			return aclUnknown
+		}
+		if containsIP(privateNetworks, ip) {
+			return aclDeny
+		}
+	}
+	if a.denyDefault {
+		return aclDeny
+	}
+	return aclAllow
+}
+
+// checkRules applies the first of rules matching the request, ok is false
+// if none does. The rules of a nil ACL are checked as if it was empty.
+func (a *acl) checkRules(rules []*aclRule, cmd uint8, dest *AddrSpec, ip net.IP) (verdict aclVerdict, ok bool) {
+	denyPrivate := a != nil && a.denyPrivate
+	ip = destIP(dest, ip)
+	for _, r := range rules {
+		matched, known := r.match(cmd, dest, ip)
+		if !known {
+			return aclUnknown, true
+		}
+		if !matched {
+			continue
+		}
+		if !r.allow {
+			return aclDeny, true
+		}
+		// a private destination is only allowed by its network
+		if denyPrivate && len(r.networks) == 0 {
+			if ip == nil {
+				return aclUnknown, true
+			}
+			if containsIP(privateNetworks, ip) {
+				continue
+			}
+		}
+		return aclAllow, true
+	}
+	return aclUnknown, false
+}
+
+// destIP is ip, or the IP of dest if it is not a domain name.
+func destIP(dest *AddrSpec, ip net.IP) net.IP {
+	if ip == nil && dest != nil && dest.FQDN == "" {
+		return dest.IP
+	}
+	return ip
+}
+
+// match reports whether the rule matches the request, known is false if it
+// depends on what is not known yet.
+func (r *aclRule) match(cmd uint8, dest *AddrSpec, ip net.IP) (matched, known bool) {
+	if r.commands != nil && !r.commands[cmd] {
+		return false, true
+	}
+	known = true
+	if len(r.ports) > 0 || len(r.domains) > 0 {
+		if dest == nil {
+			known = false
+		} else {
+			if len(r.ports) > 0 && !portsContain(r.ports, dest.Port) {
+				return false, true
+			}
+			if len(r.domains) > 0 && !matchDomain(r.domains, dest.FQDN) {
+				return false, true
+			}
+		}
+	}
+	if len(r.networks) > 0 {
+		if ip == nil {
+			return false, false
+		}
+		if !containsIP(r.networks, ip) {
+			return false, true
+		}
+	}
+	return known, known
+}
+
+// checkRequestACL checks the request once parsed, the destinations which
+// are not resolved yet are checked again when they are.
+func (s *Session) checkRequestACL(req *Request) error {
+	switch req.Command {
+	case CmdConnect, CmdBind:
+		return s.checkACL(req.Command, req.DestAddr, nil)
+	case CmdUDP:
+		// the destinations of the datagrams are checked one by one
+		return s.checkACL(CmdUDP, nil, nil)
+	}
+	return nil
+}
+
+// checkRules decides on the request with the rules of the policy of the
+// user, then with the ACL of the server.
+func (s *Session) checkRules(cmd uint8, dest *AddrSpec, ip net.IP) aclVerdict {
+	if s.policy != nil {
+		if verdict, ok := s.srv.acl.checkRules(s.policy.rules, cmd, dest, ip); ok {
+			return verdict
+		}
+	}
+	return s.srv.acl.check(cmd, dest, ip)
+}
+
+// checkACL denies the request cmd to dest with ReplyNotAllowed if the ACL
+// of the server does, ip is the resolved IP of dest or nil.
+func (s *Session) checkACL(cmd uint8, dest *AddrSpec, ip net.IP) error {
+	if s.checkRules(cmd, dest, ip) != aclDeny {
+		return nil
+	}
+	if err := s.sendReply(ReplyNotAllowed, nil); err != nil {
+		return ErrSendReplyFailed
+	}
+	return ErrACLDenied
+}
+
+// checkRemoteACL checks the CONNECT to dest which is resolved by upstream
+// proxies. If the ACL needs the IP of dest, it is resolved by the server
+// for the check and every IP must be allowed, dest is denied if it does
+// not resolve.
+func (s *Session) checkRemoteACL(ctx context.Context, dest *AddrSpec) error {
+	if s.checkRules(CmdConnect, dest, nil) != aclUnknown {
+		return s.checkACL(CmdConnect, dest, nil)
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, dest.FQDN)
+	allowed := err == nil && len(addrs) > 0
+	for _, addr := range addrs {
+		if s.checkRules(CmdConnect, dest, addr.IP) != aclAllow {
+			allowed = false
+		}
+	}
+	if !allowed {
+		if err := s.sendReply(ReplyNotAllowed, nil); err != nil {
+			return ErrSendReplyFailed
+		}
+		return ErrACLDenied
+	}
+	return nil
+}
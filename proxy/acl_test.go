@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/remones/gsocks/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestACL_check(t *testing.T) {
+	a, err := newACL(&config.ACL{
+		DenyPrivate: true,
+		Rule: []config.ACLRule{
+			{Action: "deny", Commands: []string{"bind"}},
+			{Action: "deny", Domains: []string{"*.internal"}},
+			{Action: "allow", Networks: []string{"10.1.0.0/16"}, Ports: []string{"8000-8999"}},
+			{Action: "deny", Ports: []string{"25"}},
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	tests := []struct {
+		name string
+		cmd  uint8
+		dest string
+		ip   string
+		want aclVerdict
+	}{
+		{"command", CmdBind, "1.2.3.4:80", "", aclDeny},
+		{"domain_pattern", CmdConnect, "db.internal:5432", "", aclDeny},
+		{"public_ip", CmdConnect, "1.2.3.4:80", "", aclAllow},
+		{"port", CmdConnect, "1.2.3.4:25", "", aclDeny},
+		{"private_ip", CmdConnect, "127.0.0.1:80", "", aclDeny},
+		{"metadata", CmdConnect, "169.254.169.254:80", "", aclDeny},
+		{"mapped_ipv6", CmdConnect, "[::ffff:127.0.0.1]:80", "", aclDeny},
+		{"allowed_private_network", CmdConnect, "10.1.2.3:8080", "", aclAllow},
+		{"private_network_other_port", CmdConnect, "10.1.2.3:80", "", aclDeny},
+		{"unresolved", CmdConnect, "example.com:80", "", aclUnknown},
+		{"resolved_public", CmdConnect, "example.com:80", "93.184.216.34", aclAllow},
+		{"rebound_private", CmdConnect, "example.com:80", "127.0.0.1", aclDeny},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dest, err := ParseAddrSpec(tt.dest)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, a.check(tt.cmd, dest, net.ParseIP(tt.ip)))
+		})
+	}
+
+	// the destinations of UDP ASSOCIATE are not known
+	assert.Equal(t, aclUnknown, a.check(CmdUDP, nil, nil))
+	assert.Equal(t, aclAllow, (*acl)(nil).check(CmdConnect, nil, nil))
+}
+
+func TestSession_checkACL(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	a, err := newACL(&config.ACL{DenyPrivate: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{
+		authenticators: map[AuthType]ContextAuthenticator{AuthNoRequried: &AuthNoRequired{}},
+		DialTimeout:    300 * time.Millisecond,
+		acl:            a,
+	}
+
+	// localhost is only denied once resolved
+	for _, host := range []string{"127.0.0.1", "localhost"} {
+		dest, err := ParseAddrSpec(net.JoinHostPort(host, port))
+		assert.NoError(t, err)
+
+		server, client := net.Pipe()
+		s := &Session{srv: srv, version: Socks5Version, Conn: server}
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- s.ServeRequest(context.TODO())
+			server.Close()
+		}()
+		_, err = (&Request{Version: Socks5Version, Command: CmdConnect, DestAddr: dest}).WriteTo(client)
+		assert.NoError(t, err)
+		rep, err := NewReply(client)
+		assert.NoError(t, err)
+		assert.Equal(t, ReplyNotAllowed, rep.Code, host)
+		assert.Equal(t, ErrACLDenied, <-errCh, host)
+		client.Close()
+	}
+}
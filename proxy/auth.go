@@ -1,9 +1,12 @@
 package proxy
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"net"
+	"sort"
 
 	"github.com/remones/gsocks/config"
 )
@@ -11,6 +14,7 @@ import (
 // errors
 var (
 	ErrUnsupportAuthType = errors.New("unsupported auth type")
+	ErrNoAcceptableAuth  = errors.New("socks: no acceptable authentication method")
 )
 
 // AuthType ...
@@ -24,26 +28,165 @@ const (
 	AuthNoAccetable = AuthType(0xFF)
 )
 
-func makeAuthsWithConfig(authCfg *config.Auth) map[AuthType]Authenticator {
-	auths := make(map[AuthType]Authenticator)
+func makeAuthsWithConfig(authCfg *config.Auth) (map[AuthType]ContextAuthenticator, error) {
+	auths := make(map[AuthType]ContextAuthenticator)
 
 	if authCfg.UserPasswd != nil && authCfg.UserPasswd.Enable {
-		accounts := make(map[string]string)
+		stores, err := newCredentialStores(authCfg.UserPasswd)
+		if err != nil {
+			return nil, err
+		}
+		auth := NewUserPassAuthenticator(stores...)
 		for _, account := range authCfg.UserPasswd.Account {
-			accounts[account.Username] = account.Password
+			if len(account.Groups) > 0 {
+				if auth.groups == nil {
+					auth.groups = make(map[string][]string)
+				}
+				auth.groups[account.Username] = account.Groups
+			}
 		}
-		auths[AuthUserPass] = &UserPassAuthenticator{accounts}
+		auths[AuthUserPass] = auth
 	}
 
 	if authCfg.NoRequired != nil && authCfg.NoRequired.Enable {
 		auths[AuthNoRequried] = &AuthNoRequired{}
 	}
-	return auths
-	// TODO: add gss_api
+
+	if authCfg.GssAPI != nil && authCfg.GssAPI.Enable {
+		auth, err := NewGSSAPIAuthenticate(authCfg.GssAPI)
+		if err != nil {
+			return nil, err
+		}
+		auths[AuthGSSAPI] = auth
+	}
+	return auths, nil
+}
+
+// authMethods are the methods by their name in the config.
+var authMethods = map[string]AuthType{
+	"gss_api":           AuthGSSAPI,
+	"username_password": AuthUserPass,
+	"no_required":       AuthNoRequried,
+}
+
+// authNetwork are the methods of the clients of networks.
+type authNetwork struct {
+	networks []*net.IPNet
+	methods  []AuthType
+}
+
+// newAuthMethods parses the preference order of the methods and of the
+// clients of networks.
+func newAuthMethods(authCfg *config.Auth) (methods []AuthType, networks []authNetwork, err error) {
+	if methods, err = parseAuthMethods(authCfg.Methods); err != nil {
+		return nil, nil, err
+	}
+	for _, an := range authCfg.Network {
+		nets, err := parseCIDRs(an.Networks)
+		if err != nil {
+			return nil, nil, err
+		}
+		netMethods, err := parseAuthMethods(an.Methods)
+		if err != nil {
+			return nil, nil, err
+		}
+		networks = append(networks, authNetwork{networks: nets, methods: netMethods})
+	}
+	return methods, networks, nil
+}
+
+// parseAuthMethods parses the names of the methods, an unknown name is an
+// error rather than no authentication.
+func parseAuthMethods(names []string) ([]AuthType, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	methods := make([]AuthType, 0, len(names))
+	for _, name := range names {
+		method, ok := authMethods[name]
+		if !ok {
+			return nil, fmt.Errorf("socks: unknown auth method %q", name)
+		}
+		methods = append(methods, method)
+	}
+	return methods, nil
+}
+
+// methodsFor returns the methods enabled for a client of remote, in the
+// order the server prefers them: those of the first network of the client,
+// else those configured, else the most secure first and no authentication
+// last.
+func (srv *Server) methodsFor(remote net.Addr) []AuthType {
+	order := srv.methods
+	if ip := addrIP(remote); ip != nil {
+		for _, an := range srv.authNetworks {
+			if containsIP(an.networks, ip) {
+				order = an.methods
+				break
+			}
+		}
+	}
+	if order == nil {
+		order = make([]AuthType, 0, len(srv.authenticators))
+		for method := range srv.authenticators {
+			order = append(order, method)
+		}
+		rank := func(method AuthType) int {
+			switch method {
+			case AuthGSSAPI:
+				return 0
+			case AuthUserPass:
+				return 1
+			case AuthNoRequried:
+				return 3
+			}
+			return 2
+		}
+		sort.Slice(order, func(i, j int) bool {
+			if ri, rj := rank(order[i]), rank(order[j]); ri != rj {
+				return ri < rj
+			}
+			return order[i] < order[j]
+		})
+	}
+	return srv.enabledMethods(order)
+}
+
+// enabledMethods returns the methods of order the server has an
+// authenticator of.
+func (srv *Server) enabledMethods(order []AuthType) []AuthType {
+	methods := make([]AuthType, 0, len(order))
+	for _, method := range order {
+		if _, ok := srv.authenticators[method]; ok {
+			methods = append(methods, method)
+		}
+	}
+	return methods
+}
+
+// methods returns the methods enabled for the client of the session, those
+// of its listener if it has some.
+func (s *Session) methods() []AuthType {
+	if s.endpoint != nil && s.endpoint.methods != nil {
+		return s.srv.enabledMethods(s.endpoint.methods)
+	}
+	return s.srv.methodsFor(s.RemoteAddr())
+}
+
+// allowsMethod checks whether method is enabled for the client of the
+// session.
+func (s *Session) allowsMethod(method AuthType) bool {
+	for _, m := range s.methods() {
+		if m == method {
+			return true
+		}
+	}
+	return false
 }
 
 // UserPass ...
 const (
+	UserPassVersion = uint8(0x01)
 	UserPassSuccess = uint8(0x00)
 	UserPassFailure = uint8(0x01)
 )
@@ -54,12 +197,61 @@ type Authenticator interface {
 	Authenticate(rw io.ReadWriter) (ok bool, err error)
 }
 
-// GSSAPIAuthenticate ...
-type GSSAPIAuthenticate struct{}
+// AuthRequest is the connection of a client to authenticate.
+type AuthRequest struct {
+	// Conn is the connection the sub-negotiation of the method runs on
+	Conn net.Conn
+	// RemoteAddr is the address of the client and LocalAddr the address it
+	// connected to.
+	RemoteAddr net.Addr
+	LocalAddr  net.Addr
+}
+
+// ContextAuthenticator authenticates the clients of a method, the sessions
+// are served as the identities it returns.
+type ContextAuthenticator interface {
+	Type() AuthType
+	// AuthenticateContext runs the sub-negotiation of the method, id is nil
+	// if the client failed. The session goes on with conn, which is
+	// req.Conn unless the method encapsulates the rest of the session.
+	AuthenticateContext(ctx context.Context, req *AuthRequest) (id *Identity, conn net.Conn, err error)
+}
+
+// AdaptAuthenticator adapts an Authenticator to ContextAuthenticator, the
+// clients it authenticates have an anonymous identity.
+func AdaptAuthenticator(auth Authenticator) ContextAuthenticator {
+	if ca, ok := auth.(ContextAuthenticator); ok {
+		return ca
+	}
+	return authenticatorAdapter{auth}
+}
+
+type authenticatorAdapter struct {
+	Authenticator
+}
+
+func (a authenticatorAdapter) AuthenticateContext(ctx context.Context, req *AuthRequest) (*Identity, net.Conn, error) {
+	ok, err := a.Authenticate(req.Conn)
+	if !ok {
+		return nil, req.Conn, err
+	}
+	return &Identity{Method: a.Type()}, req.Conn, err
+}
 
 // UserPassAuthenticator ...
 type UserPassAuthenticator struct {
-	accounts map[string]string
+	// stores are asked in order until one knows the user
+	stores []CredentialStore
+	// groups are the groups of the users, if any
+	groups map[string][]string
+	// lockout refuses the usernames banned or backing off
+	lockout *lockout
+}
+
+// NewUserPassAuthenticator creates a username/password authenticator
+// verifying the accounts with stores.
+func NewUserPassAuthenticator(stores ...CredentialStore) *UserPassAuthenticator {
+	return &UserPassAuthenticator{stores: stores}
 }
 
 // Type ...
@@ -69,37 +261,86 @@ func (*UserPassAuthenticator) Type() AuthType {
 
 // Authenticate ...
 func (auth *UserPassAuthenticator) Authenticate(rw io.ReadWriter) (ok bool, err error) {
+	_, ok, err = auth.authenticate(context.Background(), rw, nil)
+	return ok, err
+}
+
+// AuthenticateContext is Authenticate returning the identity of the
+// username.
+func (auth *UserPassAuthenticator) AuthenticateContext(ctx context.Context, req *AuthRequest) (*Identity, net.Conn, error) {
+	user, ok, err := auth.authenticate(ctx, req.Conn, req.RemoteAddr)
+	if !ok {
+		return nil, req.Conn, err
+	}
+	return auth.identity(user), req.Conn, err
+}
+
+func (auth *UserPassAuthenticator) authenticate(ctx context.Context, rw io.ReadWriter, remote net.Addr) (username string, ok bool, err error) {
 	header := make([]byte, 2)
 	if _, err := rw.Read(header); err != nil {
-		return false, err
+		return "", false, err
 	}
+	// RFC 1929 sub-negotiation version is 0x01, the SOCKS version sent by
+	// the clients of earlier releases is accepted too.
 	ver := uint8(header[0])
-	if ver != Socks5Version {
-		return false, fmt.Errorf("Invalid version")
+	if ver != UserPassVersion && ver != Socks5Version {
+		return "", false, fmt.Errorf("Invalid version")
 	}
 	ulen := int(header[1])
 	user := make([]byte, ulen)
 	if _, err := io.ReadAtLeast(rw, user, ulen); err != nil {
-		return false, err
+		return "", false, err
 	}
 	if _, err := rw.Read(header[:1]); err != nil {
-		return false, err
+		return "", false, err
 	}
 	plen := int(header[0])
 	passwd := make([]byte, plen)
 	if _, err := io.ReadAtLeast(rw, passwd, plen); err != nil {
-		return false, err
+		return "", false, err
+	}
+	status, err := auth.verify(ctx, remote, string(user), string(passwd))
+	rw.Write([]byte{ver, status})
+	return string(user), status == UserPassSuccess, err
+}
+
+// verify verifies the account for a client of remote, the attempts are
+// refused and recorded by the lockout.
+func (auth *UserPassAuthenticator) verify(ctx context.Context, remote net.Addr, username, passwd string) (status uint8, err error) {
+	if err := auth.lockout.allow(userKey(username)); err != nil {
+		auth.lockout.record(addrIP(remote), username, false, err)
+		return UserPassFailure, fmt.Errorf("socks: verify %s: %w", username, err)
 	}
-	status := auth.verifyAccount(string(user), string(passwd))
-	rw.Write([]byte{Socks5Version, status})
-	return status == UserPassSuccess, nil
+	status, err = auth.verifyAccount(ctx, username, passwd)
+	auth.lockout.record(addrIP(remote), username, status == UserPassSuccess, err)
+	if err != nil {
+		err = fmt.Errorf("socks: verify %s: %w", username, err)
+	}
+	return status, err
+}
+
+// verifyAccount asks the stores for the account, an error of a store fails
+// the authentication.
+func (auth *UserPassAuthenticator) verifyAccount(ctx context.Context, username, passwd string) (status uint8, err error) {
+	for _, store := range auth.stores {
+		ok, err := store.Verify(ctx, username, passwd)
+		if err == ErrUnknownUser {
+			continue
+		}
+		if err != nil || !ok {
+			return UserPassFailure, err
+		}
+		return UserPassSuccess, nil
+	}
+	return UserPassFailure, nil
 }
 
-func (auth *UserPassAuthenticator) verifyAccount(username, passwd string) (status uint8) {
-	if p, ok := auth.accounts[username]; ok && passwd == p {
-		return UserPassSuccess
+func (auth *UserPassAuthenticator) identity(username string) *Identity {
+	return &Identity{
+		Username: username,
+		Groups:   auth.groups[username],
+		Method:   AuthUserPass,
 	}
-	return UserPassFailure
 }
 
 // AuthNoRequired ...
@@ -110,6 +351,11 @@ func (auth *AuthNoRequired) Authenticate(rw io.ReadWriter) (ok bool, err error)
 	return true, nil
 }
 
+// AuthenticateContext accepts every client as anonymous.
+func (auth *AuthNoRequired) AuthenticateContext(ctx context.Context, req *AuthRequest) (*Identity, net.Conn, error) {
+	return &Identity{Method: AuthNoRequried}, req.Conn, nil
+}
+
 // Type ...
 func (auth *AuthNoRequired) Type() AuthType {
 	return AuthNoRequried
@@ -3,7 +3,11 @@ package proxy
 import (
 	"bytes"
 	"io"
+	"net"
 	"testing"
+
+	"github.com/remones/gsocks/config"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestUserPassAuthenticator_Authenticate(t *testing.T) {
@@ -36,6 +40,20 @@ func TestUserPassAuthenticator_Authenticate(t *testing.T) {
 			wantW:   string([]byte{5, 0}),
 			wantErr: false,
 		},
+		{
+			name: "userpasswd_rfc1929_version",
+			fields: fields{
+				accounts: map[string]string{
+					"si.li": "1234",
+				},
+			},
+			args: args{
+				rw: bytes.NewBuffer([]byte{1, 5, 's', 'i', '.', 'l', 'i', 4, '1', '2', '3', '4'}),
+			},
+			wantOk:  true,
+			wantW:   string([]byte{1, 0}),
+			wantErr: false,
+		},
 		{
 			name: "userpasswd_unmatch",
 			fields: fields{
@@ -53,9 +71,7 @@ func TestUserPassAuthenticator_Authenticate(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			auth := &UserPassAuthenticator{
-				accounts: tt.fields.accounts,
-			}
+			auth := NewUserPassAuthenticator(NewStaticStore(tt.fields.accounts))
 			gotOk, err := auth.Authenticate(tt.args.rw)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("UserPassAuthenticator.Authenticate() error = %v, wantErr %v", err, tt.wantErr)
@@ -71,3 +87,115 @@ func TestUserPassAuthenticator_Authenticate(t *testing.T) {
 		})
 	}
 }
+
+// newMethodsServer serves no authentication and the account si.li:1234,
+// only no authentication from 10.0.0.0/8 and only the password from
+// 192.0.2.0/24.
+func newMethodsServer(t *testing.T, methods ...string) *Server {
+	cfg := config.NewConfig()
+	cfg.Auth.NoRequired = &config.NoRequired{Enable: true}
+	cfg.Auth.UserPasswd = &config.UserPasswd{
+		Enable:  true,
+		Account: []config.Account{{Username: "si.li", Password: "1234"}},
+	}
+	cfg.Auth.Methods = methods
+	cfg.Auth.Network = []config.AuthNetwork{
+		{Networks: []string{"10.0.0.0/8"}, Methods: []string{"no_required"}},
+		{Networks: []string{"192.0.2.0/24"}, Methods: []string{"username_password"}},
+	}
+	srv, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return srv
+}
+
+func TestServer_methodsFor(t *testing.T) {
+	srv := newMethodsServer(t)
+	srv.SetAuthenticator(AdaptAuthenticator(legacyAuthenticator{}))
+	tests := []struct {
+		name    string
+		methods []string
+		remote  string
+		want    []AuthType
+	}{
+		{"default", nil, "198.51.100.1", []AuthType{AuthUserPass, AuthType(0x80), AuthNoRequried}},
+		{"configured", []string{"no_required", "username_password"}, "198.51.100.1", []AuthType{AuthNoRequried, AuthUserPass}},
+		{"no_address", []string{"username_password"}, "", []AuthType{AuthUserPass}},
+		{"network", nil, "10.1.2.3", []AuthType{AuthNoRequried}},
+		{"other_network", []string{"no_required"}, "192.0.2.7", []AuthType{AuthUserPass}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv.methods, _ = parseAuthMethods(tt.methods)
+			var remote net.Addr = &net.UnixAddr{Name: "@", Net: "unix"}
+			if tt.remote != "" {
+				remote = &net.TCPAddr{IP: net.ParseIP(tt.remote), Port: 1234}
+			}
+			assert.Equal(t, tt.want, srv.methodsFor(remote))
+		})
+	}
+}
+
+func TestNewServer_unknownMethod(t *testing.T) {
+	// the configs built in code are not validated, a typo must not serve the
+	// clients without authentication
+	for name, setup := range map[string]func(cfg *config.Config){
+		"auth": func(cfg *config.Config) {
+			cfg.Auth.Methods = []string{"username-password"}
+		},
+		"network": func(cfg *config.Config) {
+			cfg.Auth.Network = []config.AuthNetwork{{Networks: []string{"10.0.0.0/8"}, Methods: []string{"username-password"}}}
+		},
+		"listener": func(cfg *config.Config) {
+			cfg.Listener = []config.Listener{{Address: "127.0.0.1:1080", Methods: []string{"username-password"}}}
+		},
+	} {
+		cfg := config.NewConfig()
+		setup(cfg)
+		_, err := NewServer(cfg)
+		assert.Error(t, err, name)
+	}
+}
+
+func TestSession_AuthenticateMethods(t *testing.T) {
+	tests := []struct {
+		name    string
+		remote  string
+		offered []byte
+		// want is the method replied
+		want    AuthType
+		wantErr error
+	}{
+		{"password_preferred", "198.51.100.1", []byte{byte(AuthNoRequried), byte(AuthUserPass)}, AuthUserPass, nil},
+		{"no_auth", "198.51.100.1", []byte{byte(AuthNoRequried)}, AuthNoRequried, nil},
+		{"network_no_auth", "10.1.2.3", []byte{byte(AuthUserPass), byte(AuthNoRequried)}, AuthNoRequried, nil},
+		{"network_password_only", "192.0.2.7", []byte{byte(AuthNoRequried)}, AuthNoAccetable, ErrNoAcceptableAuth},
+		{"unsupported", "198.51.100.1", []byte{byte(AuthGSSAPI)}, AuthNoAccetable, ErrNoAcceptableAuth},
+	}
+	srv := newMethodsServer(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, client := net.Pipe()
+			defer client.Close()
+			s := srv.newSession(&remoteAddrConn{server, &net.TCPAddr{IP: net.ParseIP(tt.remote), Port: 1234}}, Socks5Version)
+			defer s.Close()
+			reply := make([]byte, 2)
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				client.Write(append([]byte{byte(len(tt.offered))}, tt.offered...))
+				io.ReadFull(client, reply)
+				if AuthType(reply[1]) == AuthUserPass {
+					client.Write([]byte{1, 5, 's', 'i', '.', 'l', 'i', 4, '1', '2', '3', '4'})
+					io.ReadFull(client, make([]byte, 2))
+				}
+			}()
+			ok, err := s.Authenticate()
+			<-done
+			assert.Equal(t, tt.wantErr, err)
+			assert.Equal(t, tt.wantErr == nil, ok)
+			assert.Equal(t, []byte{Socks5Version, byte(tt.want)}, reply)
+		})
+	}
+}
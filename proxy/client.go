@@ -0,0 +1,132 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/remones/gsocks/config"
+)
+
+// errors
+var (
+	ErrClientDenied       = errors.New("socks: client address denied")
+	ErrClientSessionLimit = errors.New("socks: too many sessions of the client")
+	ErrSessionLimit       = errors.New("socks: too many sessions")
+)
+
+// RejectStats counts the connections rejected before being served.
+type RejectStats struct {
+	// Denied are the connections of the clients not allowed
+	Denied uint64
+	// ClientLimit are over the max sessions of their client IP, and Limit
+	// over the max sessions of the server.
+	ClientLimit uint64
+	Limit       uint64
+}
+
+// clientLimiter admits the connections of the clients allowed, as long as
+// their sessions are under the limits.
+type clientLimiter struct {
+	// accessed atomically, keep them 64-bit aligned
+	denied      uint64
+	clientLimit uint64
+	limit       uint64
+
+	allow       []*net.IPNet
+	deny        []*net.IPNet
+	maxPerIP    int
+	maxSessions int
+
+	mu       sync.Mutex
+	sessions map[string]int
+	total    int
+}
+
+// newClientLimiter creates the limiter of cfg, nil is returned if it admits
+// every connection.
+func newClientLimiter(cfg *config.Client) (*clientLimiter, error) {
+	if len(cfg.Allow) == 0 && len(cfg.Deny) == 0 && cfg.MaxSessionsPerIP == 0 && cfg.MaxSessions == 0 {
+		return nil, nil
+	}
+	allow, err := parseCIDRs(cfg.Allow)
+	if err != nil {
+		return nil, fmt.Errorf("socks: client allow: %v", err)
+	}
+	deny, err := parseCIDRs(cfg.Deny)
+	if err != nil {
+		return nil, fmt.Errorf("socks: client deny: %v", err)
+	}
+	return &clientLimiter{
+		allow:       allow,
+		deny:        deny,
+		maxPerIP:    cfg.MaxSessionsPerIP,
+		maxSessions: cfg.MaxSessions,
+		sessions:    make(map[string]int),
+	}, nil
+}
+
+// admit checks the client of addr, release must be called when the session
+// of an admitted connection ends. The connections which do not come from
+// an IP, e.g. of Unix sockets, are only limited by the max sessions.
+func (l *clientLimiter) admit(addr net.Addr) (release func(), err error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	var ip net.IP
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		ip = tcpAddr.IP
+	}
+	if ip != nil {
+		if containsIP(l.deny, ip) || (len(l.allow) > 0 && !containsIP(l.allow, ip)) {
+			atomic.AddUint64(&l.denied, 1)
+			return nil, ErrClientDenied
+		}
+	}
+
+	var key string
+	if ip != nil {
+		key = ip.String()
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.maxSessions > 0 && l.total >= l.maxSessions {
+		atomic.AddUint64(&l.limit, 1)
+		return nil, ErrSessionLimit
+	}
+	if ip != nil && l.maxPerIP > 0 && l.sessions[key] >= l.maxPerIP {
+		atomic.AddUint64(&l.clientLimit, 1)
+		return nil, ErrClientSessionLimit
+	}
+	l.total++
+	if ip != nil {
+		l.sessions[key]++
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			l.total--
+			if ip == nil {
+				return
+			}
+			if l.sessions[key]--; l.sessions[key] <= 0 {
+				delete(l.sessions, key)
+			}
+		})
+	}, nil
+}
+
+func (l *clientLimiter) stats() RejectStats {
+	if l == nil {
+		return RejectStats{}
+	}
+	return RejectStats{
+		Denied:      atomic.LoadUint64(&l.denied),
+		ClientLimit: atomic.LoadUint64(&l.clientLimit),
+		Limit:       atomic.LoadUint64(&l.limit),
+	}
+}
@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/remones/gsocks/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientLimiter_admit(t *testing.T) {
+	l, err := newClientLimiter(&config.Client{
+		Allow:            []string{"10.0.0.0/8", "192.168.1.1"},
+		Deny:             []string{"10.0.0.0/24"},
+		MaxSessionsPerIP: 2,
+		MaxSessions:      3,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	addr := func(ip string) net.Addr {
+		return &net.TCPAddr{IP: net.ParseIP(ip), Port: 1234}
+	}
+
+	_, err = l.admit(addr("172.16.0.1"))
+	assert.Equal(t, ErrClientDenied, err)
+	_, err = l.admit(addr("10.0.0.1"))
+	assert.Equal(t, ErrClientDenied, err)
+
+	r1, err := l.admit(addr("10.1.0.1"))
+	assert.NoError(t, err)
+	r2, err := l.admit(addr("10.1.0.1"))
+	assert.NoError(t, err)
+	_, err = l.admit(addr("10.1.0.1"))
+	assert.Equal(t, ErrClientSessionLimit, err)
+	r3, err := l.admit(addr("192.168.1.1"))
+	assert.NoError(t, err)
+	_, err = l.admit(addr("10.2.0.1"))
+	assert.Equal(t, ErrSessionLimit, err)
+
+	// a release is only counted once
+	r1()
+	r1()
+	r4, err := l.admit(addr("10.1.0.1"))
+	assert.NoError(t, err)
+	for _, release := range []func(){r2, r3, r4} {
+		release()
+	}
+	assert.Empty(t, l.sessions)
+	assert.Equal(t, 0, l.total)
+	assert.Equal(t, RejectStats{Denied: 2, ClientLimit: 1, Limit: 1}, l.stats())
+}
+
+func TestServer_rejectClient(t *testing.T) {
+	cfg := config.NewConfig()
+	cfg.Client.MaxSessionsPerIP = 1
+	srv, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.ErrorLog = log.New(io.Discard, "", 0)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(ln)
+	defer srv.Close(context.Background())
+
+	first, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	// the first session is admitted once accepted
+	assert.Eventually(t, func() bool {
+		srv.clients.mu.Lock()
+		defer srv.clients.mu.Unlock()
+		return srv.clients.total == 1
+	}, time.Second, 10*time.Millisecond)
+
+	second, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	second.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = second.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, RejectStats{ClientLimit: 1}, srv.RejectedConns())
+}
@@ -0,0 +1,197 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/remones/gsocks/config"
+)
+
+// errors
+var (
+	ErrUnknownUser = errors.New("socks: unknown user")
+)
+
+const defaultCredentialTimeout = 5 * time.Second
+
+// execUnknownUserCode is the exit code of a credential command which does
+// not know the user, the next store is asked then.
+const execUnknownUserCode = 3
+
+// CredentialStore verifies the username/password accounts of
+// UserPassAuthenticator.
+type CredentialStore interface {
+	// Verify reports whether password is the password of username, or
+	// returns ErrUnknownUser if the store has no such user, then the next
+	// store is asked. It gives up once ctx is done.
+	Verify(ctx context.Context, username, password string) (ok bool, err error)
+}
+
+// NewStaticStore returns a store of the password hashes, or plaintext
+// passwords, by username.
+func NewStaticStore(accounts map[string]string) CredentialStore {
+	return staticStore(accounts)
+}
+
+type staticStore map[string]string
+
+// unknownUserHash is verified for the unknown users, so that they are not
+// told from the users of bcrypt hashes by the time they take.
+const unknownUserHash = "$2a$10$kCBCDdCRObAXNZmdLSFfxOGLLjhH773.qk8h.0ACo0XPgsezOVZzO"
+
+func (s staticStore) Verify(ctx context.Context, username, password string) (bool, error) {
+	hashed, ok := s[username]
+	if !ok {
+		VerifyPassword(unknownUserHash, password)
+		return false, ErrUnknownUser
+	}
+	return VerifyPassword(hashed, password)
+}
+
+// NewHtpasswdStore returns a store of the accounts of an htpasswd file.
+func NewHtpasswdStore(path string) (CredentialStore, error) {
+	accounts, err := loadHtpasswd(path)
+	if err != nil {
+		return nil, err
+	}
+	return staticStore(accounts), nil
+}
+
+type execStore struct {
+	command []string
+	timeout time.Duration
+}
+
+// NewExecStore returns a store running a command for every account, the
+// username and the password are written to its stdin line by line and the
+// exit code 0 accepts them, 3 reports an unknown user and any other rejects
+// them.
+func NewExecStore(cfg *config.CredentialExec) CredentialStore {
+	timeout := defaultCredentialTimeout
+	if cfg.Timeout > 0 {
+		timeout = time.Duration(cfg.Timeout) * time.Millisecond
+	}
+	return &execStore{command: cfg.Command, timeout: timeout}
+}
+
+func (s *execStore) Verify(ctx context.Context, username, password string) (bool, error) {
+	// a line break would shift the lines read by the command
+	if strings.ContainsAny(username, "\r\n") || strings.ContainsAny(password, "\r\n") {
+		return false, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, s.command[0], s.command[1:]...)
+	cmd.Stdin = strings.NewReader(username + "\n" + password + "\n")
+	err := cmd.Run()
+	if ctx.Err() != nil {
+		return false, fmt.Errorf("socks: credential command: %v", ctx.Err())
+	}
+	if ee, ok := err.(*exec.ExitError); ok {
+		if ee.ExitCode() == execUnknownUserCode {
+			return false, ErrUnknownUser
+		}
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("socks: credential command: %v", err)
+	}
+	return true, nil
+}
+
+type webhookStore struct {
+	url     string
+	headers map[string]string
+	client  *http.Client
+}
+
+// NewWebhookStore returns a store posting {"username": ..., "password": ...}
+// to a URL for every account, a 2xx status accepts it, 401, 403 and 404
+// reject it.
+func NewWebhookStore(cfg *config.CredentialWebhook) CredentialStore {
+	timeout := defaultCredentialTimeout
+	if cfg.Timeout > 0 {
+		timeout = time.Duration(cfg.Timeout) * time.Millisecond
+	}
+	return &webhookStore{
+		url:     cfg.URL,
+		headers: cfg.Headers,
+		client:  &http.Client{Timeout: timeout},
+	}
+}
+
+func (s *webhookStore) Verify(ctx context.Context, username, password string) (bool, error) {
+	body, err := json.Marshal(struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}{username, password})
+	if err != nil {
+		return false, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range s.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("socks: credential webhook: %v", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4096))
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return true, nil
+	case resp.StatusCode == http.StatusUnauthorized, resp.StatusCode == http.StatusForbidden,
+		resp.StatusCode == http.StatusNotFound:
+		return false, nil
+	}
+	return false, fmt.Errorf("socks: credential webhook: unexpected status %s", resp.Status)
+}
+
+// newCredentialStores creates the stores of cfg, in the order they are
+// asked: the accounts of the config, the htpasswd file, the directory
+// server, the command and the webhook.
+func newCredentialStores(cfg *config.UserPasswd) ([]CredentialStore, error) {
+	var stores []CredentialStore
+	if len(cfg.Account) > 0 {
+		accounts := make(map[string]string)
+		for _, account := range cfg.Account {
+			accounts[account.Username] = account.Password
+		}
+		stores = append(stores, NewStaticStore(accounts))
+	}
+	if cfg.File != "" {
+		store, err := NewHtpasswdStore(cfg.File)
+		if err != nil {
+			return nil, err
+		}
+		stores = append(stores, store)
+	}
+	if cfg.LDAP != nil {
+		store, err := NewLDAPStore(cfg.LDAP)
+		if err != nil {
+			return nil, err
+		}
+		stores = append(stores, store)
+	}
+	if cfg.Exec != nil {
+		stores = append(stores, NewExecStore(cfg.Exec))
+	}
+	if cfg.Webhook != nil {
+		stores = append(stores, NewWebhookStore(cfg.Webhook))
+	}
+	return stores, nil
+}
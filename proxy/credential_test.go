@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/remones/gsocks/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func assertVerifyAccount(t *testing.T, auth *UserPassAuthenticator, username, passwd string, want uint8) {
+	t.Helper()
+	status, err := auth.verifyAccount(context.Background(), username, passwd)
+	assert.NoError(t, err, username)
+	assert.Equal(t, want, status, username)
+}
+
+func TestExecStore(t *testing.T) {
+	store := NewExecStore(&config.CredentialExec{
+		Command: []string{"sh", "-c", `read u; read p; [ "$u" = alice ] && [ "$p" = "s3 cret" ]`},
+	})
+	tests := []struct {
+		username string
+		password string
+		want     bool
+	}{
+		{"alice", "s3 cret", true},
+		{"alice", "s3cret", false},
+		{"bob", "s3 cret", false},
+		// the password can not be smuggled into the lines of the command
+		{"alice\ns3 cret", "x", false},
+		{"alice", "s3 cret\nx", false},
+	}
+	for _, tt := range tests {
+		ok, err := store.Verify(context.Background(), tt.username, tt.password)
+		assert.NoError(t, err, tt.username)
+		assert.Equal(t, tt.want, ok, tt.username)
+	}
+
+	store = NewExecStore(&config.CredentialExec{Command: []string{"sh", "-c", "exit 3"}})
+	_, err := store.Verify(context.Background(), "carol", "c")
+	assert.Equal(t, ErrUnknownUser, err)
+
+	store = NewExecStore(&config.CredentialExec{Command: []string{"sleep", "1"}, Timeout: 50})
+	_, err = store.Verify(context.Background(), "alice", "s3 cret")
+	assert.Error(t, err)
+	// the command is killed once the session ends
+	store = NewExecStore(&config.CredentialExec{Command: []string{"sleep", "1"}})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = store.Verify(ctx, "alice", "s3 cret")
+	assert.Error(t, err)
+	assert.Less(t, int64(time.Since(start)), int64(500*time.Millisecond))
+	store = NewExecStore(&config.CredentialExec{Command: []string{"/nonexistent/gsocks-auth"}})
+	_, err = store.Verify(context.Background(), "alice", "s3 cret")
+	assert.Error(t, err)
+}
+
+func TestWebhookStore(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var account struct {
+			Username string `json:"username"`
+			Password string `json:"password"`
+		}
+		if r.Method != http.MethodPost || r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&account); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		switch {
+		case account.Username == "broken":
+			w.WriteHeader(http.StatusInternalServerError)
+		case account.Username != "alice":
+			w.WriteHeader(http.StatusNotFound)
+		case account.Password != "s3cret":
+			w.WriteHeader(http.StatusUnauthorized)
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer backend.Close()
+
+	store := NewWebhookStore(&config.CredentialWebhook{
+		URL:     backend.URL,
+		Headers: map[string]string{"Authorization": "Bearer token"},
+	})
+	ok, err := store.Verify(context.Background(), "alice", "s3cret")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = store.Verify(context.Background(), "alice", "secret")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	ok, err = store.Verify(context.Background(), "bob", "s3cret")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	_, err = store.Verify(context.Background(), "broken", "s3cret")
+	assert.Error(t, err)
+}
+
+func TestUserPassAuthenticator_stores(t *testing.T) {
+	store := NewExecStore(&config.CredentialExec{
+		Command: []string{"sh", "-c", `read u; read p; [ "$u" = carol ] && [ "$p" = c ]`},
+	})
+	auth := NewUserPassAuthenticator(NewStaticStore(map[string]string{"alice": "a"}), store)
+	assertVerifyAccount(t, auth, "alice", "a", UserPassSuccess)
+	// alice is known to the first store, the command is not run
+	assertVerifyAccount(t, auth, "alice", "c", UserPassFailure)
+	assertVerifyAccount(t, auth, "carol", "c", UserPassSuccess)
+	assertVerifyAccount(t, auth, "carol", "a", UserPassFailure)
+
+	// the users the command does not know are verified by the next store
+	store = NewExecStore(&config.CredentialExec{
+		Command: []string{"sh", "-c", `read u; [ "$u" = carol ] || exit 3`},
+	})
+	auth = NewUserPassAuthenticator(store, NewStaticStore(map[string]string{"dave": "d"}))
+	assertVerifyAccount(t, auth, "carol", "x", UserPassSuccess)
+	assertVerifyAccount(t, auth, "dave", "d", UserPassSuccess)
+	assertVerifyAccount(t, auth, "erin", "d", UserPassFailure)
+
+	// the errors of a store fail the authentication
+	auth = NewUserPassAuthenticator(NewExecStore(&config.CredentialExec{Command: []string{"/nonexistent/gsocks-auth"}}))
+	status, err := auth.verifyAccount(context.Background(), "carol", "c")
+	assert.Error(t, err)
+	assert.Equal(t, UserPassFailure, status)
+}
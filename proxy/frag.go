@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"time"
+)
+
+// Defaults of the UDP reassembly, RFC 1928 requires the reassembly timer
+// to be no less than 5 seconds.
+const (
+	defaultFragQueueSize = 0xFFFF
+	defaultFragTimeout   = 5 * time.Second
+	maxFragQueues        = 32
+	fragEnd              = uint8(0x80)
+)
+
+/*
+The FRAG field of a UDP request header tells whether the datagram is one of
+a number of fragments. The high-order bit indicates the end of the fragment
+sequence, the other bits the position of the fragment within the sequence,
+and X'00' a standalone datagram.
+
+The reassembly queue of a destination is abandoned when its timer expires,
+or a fragment arrives whose position is not next to the highest position
+processed, since the sequence can not be completed then.
+*/
+type reassembler struct {
+	maxSize int
+	timeout time.Duration
+	queues  map[string]*fragQueue
+}
+
+type fragQueue struct {
+	data     []byte
+	last     uint8
+	deadline time.Time
+}
+
+// newReassembler creates the reassembler of one client, a zero maxSize or
+// timeout falls back to the default.
+func newReassembler(maxSize int, timeout time.Duration) *reassembler {
+	if maxSize <= 0 {
+		maxSize = defaultFragQueueSize
+	}
+	if timeout <= 0 {
+		timeout = defaultFragTimeout
+	}
+	return &reassembler{
+		maxSize: maxSize,
+		timeout: timeout,
+		queues:  make(map[string]*fragQueue),
+	}
+}
+
+// add queues the fragment of dest at position frag, the reassembled
+// datagram is returned once its last fragment arrives.
+func (r *reassembler) add(dest string, frag uint8, data []byte, now time.Time) ([]byte, bool) {
+	r.expire(now)
+
+	pos := frag &^ fragEnd
+	if pos == 0 {
+		return nil, false
+	}
+	q, ok := r.queues[dest]
+	if ok && pos != q.last+1 {
+		delete(r.queues, dest)
+		ok = false
+	}
+	if !ok {
+		if pos != 1 || len(r.queues) >= maxFragQueues {
+			return nil, false
+		}
+		q = &fragQueue{deadline: now.Add(r.timeout)}
+		r.queues[dest] = q
+	}
+	if len(q.data)+len(data) > r.maxSize {
+		delete(r.queues, dest)
+		return nil, false
+	}
+	q.data = append(q.data, data...)
+	q.last = pos
+
+	if frag&fragEnd == 0 {
+		return nil, false
+	}
+	delete(r.queues, dest)
+	return q.data, true
+}
+
+func (r *reassembler) expire(now time.Time) {
+	for dest, q := range r.queues {
+		if now.After(q.deadline) {
+			delete(r.queues, dest)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReassembler_add(t *testing.T) {
+	now := time.Now()
+	type frag struct {
+		dest string
+		frag uint8
+		data string
+		at   time.Duration
+	}
+	tests := []struct {
+		name  string
+		frags []frag
+		want  []string
+	}{
+		{
+			name: "in_order",
+			frags: []frag{
+				{"a", 1, "he", 0},
+				{"a", 2, "ll", 0},
+				{"a", 0x83, "o", 0},
+			},
+			want: []string{"hello"},
+		},
+		{
+			name: "interleaved_destinations",
+			frags: []frag{
+				{"a", 1, "foo", 0},
+				{"b", 1, "bar", 0},
+				{"b", 0x82, "baz", 0},
+				{"a", 0x82, "qux", 0},
+			},
+			want: []string{"barbaz", "fooqux"},
+		},
+		{
+			name: "lower_position_abandons_queue",
+			frags: []frag{
+				{"a", 1, "x", 0},
+				{"a", 2, "y", 0},
+				{"a", 1, "he", 0},
+				{"a", 0x82, "llo", 0},
+			},
+			want: []string{"hello"},
+		},
+		{
+			name: "missing_fragment",
+			frags: []frag{
+				{"a", 1, "he", 0},
+				{"a", 0x83, "o", 0},
+			},
+		},
+		{
+			name: "expired_queue",
+			frags: []frag{
+				{"a", 1, "he", 0},
+				{"a", 0x82, "llo", 6 * time.Second},
+			},
+		},
+		{
+			name: "queue_too_large",
+			frags: []frag{
+				{"a", 1, "0123456789", 0},
+				{"a", 0x82, "0123456789", 0},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newReassembler(16, 0)
+			var got []string
+			for _, f := range tt.frags {
+				if b, ok := r.add(f.dest, f.frag, []byte(f.data), now.Add(f.at)); ok {
+					got = append(got, string(b))
+				}
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestReassembler_maxQueues(t *testing.T) {
+	r := newReassembler(0, 0)
+	now := time.Now()
+	for i := 0; i < maxFragQueues+1; i++ {
+		r.add(string(rune('a'+i)), 1, []byte("x"), now)
+	}
+	assert.Len(t, r.queues, maxFragQueues)
+
+	// expired queues make room for new ones
+	_, ok := r.add("z", 1, []byte("x"), now.Add(defaultFragTimeout+time.Second))
+	assert.False(t, ok)
+	assert.Len(t, r.queues, 1)
+}
@@ -0,0 +1,288 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/remones/gsocks/config"
+)
+
+// GSSAPI message types, see RFC 1961
+const (
+	gssapiVersion          = uint8(0x01)
+	gssapiMsgContext       = uint8(0x01)
+	gssapiMsgProtection    = uint8(0x02)
+	gssapiMsgEncapsulation = uint8(0x03)
+	gssapiMsgAbort         = uint8(0xFF)
+)
+
+// GSSAPI per-message protection levels
+const (
+	GSSProtectionIntegrity       = uint8(0x01)
+	GSSProtectionConfidentiality = uint8(0x02)
+	GSSProtectionSelective       = uint8(0x03)
+)
+
+// gssapiMaxChunk is the max payload wrapped in one encapsulation message,
+// it leaves room for the token overhead in the 2 bytes length field.
+const gssapiMaxChunk = 0xFFFF - 0xFF
+
+// errors
+var (
+	ErrGSSAPIAborted    = errors.New("gssapi: client aborted the negotiation")
+	ErrGSSAPIMessage    = errors.New("gssapi: unexpected message")
+	ErrGSSAPIProtection = errors.New("gssapi: invalid protection level")
+	ErrGSSAPIUDP        = errors.New("gssapi: UDP relay is not encapsulated, refused")
+)
+
+var gssProtections = map[string]uint8{
+	"":                0,
+	"integrity":       GSSProtectionIntegrity,
+	"confidentiality": GSSProtectionConfidentiality,
+	"selective":       GSSProtectionSelective,
+}
+
+// gssContext is the GSS-API security context of one session. Wrap and
+// Unwrap may be called concurrently with each other once the context is
+// established.
+type gssContext interface {
+	// Accept consumes a context token of the client, it returns the token
+	// to send back, if any, and whether the context is established.
+	Accept(token []byte) (out []byte, established bool, err error)
+	Wrap(b []byte, conf bool) ([]byte, error)
+	Unwrap(token []byte) (b []byte, conf bool, err error)
+	// Principal is the name of the client once the context is established
+	Principal() string
+}
+
+// GSSAPIAuthenticate implements the GSSAPI method of RFC 1961 with the
+// Kerberos V5 mechanism.
+type GSSAPIAuthenticate struct {
+	newContext func(remote net.Addr) gssContext
+	// protection is the level selected by the server, 0 follows the client
+	protection uint8
+}
+
+// NewGSSAPIAuthenticate creates a GSSAPI authenticator accepting tickets
+// for the services in the keytab of cfg.
+func NewGSSAPIAuthenticate(cfg *config.GssAPI) (*GSSAPIAuthenticate, error) {
+	protection, ok := gssProtections[cfg.Protection]
+	if !ok {
+		return nil, fmt.Errorf("gssapi: unknown protection %q", cfg.Protection)
+	}
+	acceptor, err := newKrb5Acceptor(cfg.Keytab, cfg.ServicePrincipal)
+	if err != nil {
+		return nil, err
+	}
+	return &GSSAPIAuthenticate{
+		newContext: acceptor.newContext,
+		protection: protection,
+	}, nil
+}
+
+// Type ...
+func (*GSSAPIAuthenticate) Type() AuthType {
+	return AuthGSSAPI
+}
+
+// Authenticate establishes the security context and negotiates the
+// protection level. RFC 1961 requires the rest of the session to be
+// encapsulated, which is what AuthenticateConn does.
+func (auth *GSSAPIAuthenticate) Authenticate(rw io.ReadWriter) (ok bool, err error) {
+	if _, _, err := auth.negotiate(rw, nil); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// AuthenticateConn authenticates the client like Authenticate, the
+// returned connection encapsulates the data with the negotiated protection.
+func (auth *GSSAPIAuthenticate) AuthenticateConn(conn net.Conn) (net.Conn, bool, error) {
+	id, c, err := auth.AuthenticateContext(context.Background(), &AuthRequest{
+		Conn:       conn,
+		RemoteAddr: conn.RemoteAddr(),
+		LocalAddr:  conn.LocalAddr(),
+	})
+	if id == nil {
+		return nil, false, err
+	}
+	return c, true, nil
+}
+
+// AuthenticateContext authenticates the client as its Kerberos principal,
+// the returned connection encapsulates the data with the negotiated
+// protection.
+func (auth *GSSAPIAuthenticate) AuthenticateContext(ctx context.Context, req *AuthRequest) (*Identity, net.Conn, error) {
+	gctx, level, err := auth.negotiate(req.Conn, req.RemoteAddr)
+	if err != nil {
+		return nil, req.Conn, err
+	}
+	conn := &gssConn{
+		Conn: req.Conn,
+		ctx:  gctx,
+		conf: level != GSSProtectionIntegrity,
+	}
+	return principalIdentity(gctx.Principal()), conn, nil
+}
+
+func (auth *GSSAPIAuthenticate) negotiate(rw io.ReadWriter, remote net.Addr) (gssContext, uint8, error) {
+	ctx := auth.newContext(remote)
+	for established := false; !established; {
+		mtyp, token, err := readGSSMessage(rw)
+		if err != nil {
+			return nil, 0, err
+		}
+		if mtyp != gssapiMsgContext {
+			writeGSSAbort(rw)
+			return nil, 0, ErrGSSAPIMessage
+		}
+		var out []byte
+		out, established, err = ctx.Accept(token)
+		if err != nil {
+			writeGSSAbort(rw)
+			return nil, 0, err
+		}
+		if len(out) > 0 {
+			if err := writeGSSMessage(rw, gssapiMsgContext, out); err != nil {
+				return nil, 0, err
+			}
+		}
+	}
+
+	mtyp, token, err := readGSSMessage(rw)
+	if err != nil {
+		return nil, 0, err
+	}
+	if mtyp != gssapiMsgProtection {
+		writeGSSAbort(rw)
+		return nil, 0, ErrGSSAPIMessage
+	}
+	b, _, err := ctx.Unwrap(token)
+	if err != nil {
+		writeGSSAbort(rw)
+		return nil, 0, err
+	}
+	if len(b) != 1 || b[0] < GSSProtectionIntegrity || b[0] > GSSProtectionSelective {
+		writeGSSAbort(rw)
+		return nil, 0, ErrGSSAPIProtection
+	}
+	level := b[0]
+	if auth.protection != 0 {
+		level = auth.protection
+	}
+	out, err := ctx.Wrap([]byte{level}, false)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := writeGSSMessage(rw, gssapiMsgProtection, out); err != nil {
+		return nil, 0, err
+	}
+	return ctx, level, nil
+}
+
+/*
+Every GSSAPI message but the abort one is framed like:
+
+	+------+------+------+.......................+
+	+ ver  | mtyp | len  |       token           |
+	+------+------+------+.......................+
+	+ 0x01 | 0x01 | 0x02 | up to 2^16 - 1 octets |
+	+------+------+------+.......................+
+*/
+func readGSSMessage(r io.Reader) (mtyp uint8, token []byte, err error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header[:2]); err != nil {
+		return 0, nil, err
+	}
+	if header[0] != gssapiVersion {
+		return 0, nil, fmt.Errorf("gssapi: invalid version %#x", header[0])
+	}
+	if header[1] == gssapiMsgAbort {
+		return 0, nil, ErrGSSAPIAborted
+	}
+	if _, err := io.ReadFull(r, header[2:]); err != nil {
+		return 0, nil, err
+	}
+	token = make([]byte, binary.BigEndian.Uint16(header[2:]))
+	if _, err := io.ReadFull(r, token); err != nil {
+		return 0, nil, err
+	}
+	return header[1], token, nil
+}
+
+func writeGSSMessage(w io.Writer, mtyp uint8, token []byte) error {
+	if len(token) > 0xFFFF {
+		return fmt.Errorf("gssapi: token too long: %d", len(token))
+	}
+	msg := make([]byte, 4+len(token))
+	msg[0] = gssapiVersion
+	msg[1] = mtyp
+	binary.BigEndian.PutUint16(msg[2:], uint16(len(token)))
+	copy(msg[4:], token)
+	_, err := w.Write(msg)
+	return err
+}
+
+func writeGSSAbort(w io.Writer) error {
+	_, err := w.Write([]byte{gssapiVersion, gssapiMsgAbort})
+	return err
+}
+
+// gssConn encapsulates the data of an authenticated session in GSSAPI
+// encapsulation messages.
+type gssConn struct {
+	net.Conn
+	ctx  gssContext
+	conf bool
+
+	rmu  sync.Mutex
+	rbuf []byte
+	wmu  sync.Mutex
+}
+
+func (c *gssConn) Read(b []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	for len(c.rbuf) == 0 {
+		mtyp, token, err := readGSSMessage(c.Conn)
+		if err != nil {
+			return 0, err
+		}
+		if mtyp != gssapiMsgEncapsulation {
+			return 0, ErrGSSAPIMessage
+		}
+		if c.rbuf, _, err = c.ctx.Unwrap(token); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, c.rbuf)
+	c.rbuf = c.rbuf[n:]
+	return n, nil
+}
+
+func (c *gssConn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	var n int
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > gssapiMaxChunk {
+			chunk = chunk[:gssapiMaxChunk]
+		}
+		token, err := c.ctx.Wrap(chunk, c.conf)
+		if err != nil {
+			return n, err
+		}
+		if err := writeGSSMessage(c.Conn, gssapiMsgEncapsulation, token); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+		b = b[len(chunk):]
+	}
+	return n, nil
+}
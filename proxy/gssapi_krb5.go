@@ -0,0 +1,315 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/jcmturner/gofork/encoding/asn1"
+	"github.com/jcmturner/gokrb5/v8/asn1tools"
+	"github.com/jcmturner/gokrb5/v8/crypto"
+	"github.com/jcmturner/gokrb5/v8/gssapi"
+	"github.com/jcmturner/gokrb5/v8/iana"
+	"github.com/jcmturner/gokrb5/v8/iana/asnAppTag"
+	"github.com/jcmturner/gokrb5/v8/iana/etypeID"
+	"github.com/jcmturner/gokrb5/v8/iana/flags"
+	"github.com/jcmturner/gokrb5/v8/iana/keyusage"
+	"github.com/jcmturner/gokrb5/v8/iana/msgtype"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/service"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+	"github.com/jcmturner/gokrb5/v8/types"
+)
+
+// Kerberos V5 GSS-API token IDs, see RFC 1964 and RFC 4121
+var (
+	krb5TokIDAPRep = []byte{0x02, 0x00}
+	krb5TokIDWrap  = []byte{0x05, 0x04}
+)
+
+// Wrap token flags, see RFC 4121 section 4.2.2
+const (
+	krb5FlagSentByAcceptor = byte(0x01)
+	krb5FlagSealed         = byte(0x02)
+	krb5FlagAcceptorSubkey = byte(0x04)
+	krb5WrapHeaderLen      = 16
+)
+
+// errors
+var (
+	ErrKrb5Token    = errors.New("gssapi: invalid krb5 token")
+	ErrKrb5Sequence = errors.New("gssapi: krb5 token out of sequence")
+)
+
+type krb5Acceptor struct {
+	settings *service.Settings
+}
+
+func newKrb5Acceptor(keytabFile, principal string) (*krb5Acceptor, error) {
+	kt, err := keytab.Load(keytabFile)
+	if err != nil {
+		return nil, fmt.Errorf("gssapi: load keytab: %v", err)
+	}
+	return newKrb5AcceptorWithKeytab(kt, principal), nil
+}
+
+func newKrb5AcceptorWithKeytab(kt *keytab.Keytab, principal string) *krb5Acceptor {
+	opts := []func(*service.Settings){service.DecodePAC(false)}
+	if principal != "" {
+		opts = append(opts, service.KeytabPrincipal(principal))
+	}
+	return &krb5Acceptor{settings: service.NewSettings(kt, opts...)}
+}
+
+func (a *krb5Acceptor) newContext(remote net.Addr) gssContext {
+	settings := *a.settings
+	if addr, ok := remote.(*net.TCPAddr); ok {
+		service.ClientAddress(types.HostAddressFromNetIP(addr.IP))(&settings)
+	}
+	return &krb5Context{
+		settings: &settings,
+		acceptor: true,
+	}
+}
+
+// krb5Context is a Kerberos V5 security context, its per-message tokens
+// follow RFC 4121 so only the AES encryption types are supported.
+type krb5Context struct {
+	settings *service.Settings
+	acceptor bool
+	key      types.EncryptionKey
+	// principal is the authenticated client, e.g. "alice@EXAMPLE.COM"
+	principal string
+
+	smu     sync.Mutex
+	sendSeq uint64
+	rmu     sync.Mutex
+	recvSeq uint64
+}
+
+func (c *krb5Context) Accept(token []byte) ([]byte, bool, error) {
+	var tok spnego.KRB5Token
+	if err := tok.Unmarshal(token); err != nil {
+		return nil, false, err
+	}
+	if !tok.IsAPReq() {
+		return nil, false, ErrKrb5Token
+	}
+	apReq := &tok.APReq
+	ok, creds, err := service.VerifyAPREQ(apReq, c.settings)
+	if err != nil {
+		return nil, false, err
+	}
+	if !ok {
+		return nil, false, ErrAuthenticateFailed
+	}
+
+	c.key = apReq.Ticket.DecryptedEncPart.Key
+	if apReq.Authenticator.SubKey.KeyType != 0 {
+		c.key = apReq.Authenticator.SubKey
+	}
+	if !isRFC4121EType(c.key.KeyType) {
+		return nil, false, fmt.Errorf("gssapi: unsupported encryption type %d", c.key.KeyType)
+	}
+	c.principal = creds.CName().PrincipalNameString() + "@" + creds.Realm()
+	c.recvSeq = uint64(apReq.Authenticator.SeqNumber)
+	// Without mutual authentication both sides start from the initiator's
+	// sequence number.
+	c.sendSeq = c.recvSeq
+	if !types.IsFlagSet(&apReq.APOptions, flags.APOptionMutualRequired) {
+		return nil, true, nil
+	}
+
+	seq, err := randomSeqNumber()
+	if err != nil {
+		return nil, false, err
+	}
+	out, err := marshalKrb5APRep(apReq, seq)
+	if err != nil {
+		return nil, false, err
+	}
+	c.sendSeq = uint64(seq)
+	return out, true, nil
+}
+
+func isRFC4121EType(id int32) bool {
+	switch id {
+	case etypeID.AES128_CTS_HMAC_SHA1_96, etypeID.AES256_CTS_HMAC_SHA1_96,
+		etypeID.AES128_CTS_HMAC_SHA256_128, etypeID.AES256_CTS_HMAC_SHA384_192:
+		return true
+	}
+	return false
+}
+
+func randomSeqNumber() (int64, error) {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return 0, err
+	}
+	return int64(binary.BigEndian.Uint32(b) & 0x3fffffff), nil
+}
+
+// marshalKrb5APRep builds the AP-REP context token of mutual authentication.
+func marshalKrb5APRep(apReq *messages.APReq, seq int64) ([]byte, error) {
+	encPart := messages.EncAPRepPart{
+		CTime:          apReq.Authenticator.CTime,
+		Cusec:          apReq.Authenticator.Cusec,
+		SequenceNumber: seq,
+	}
+	b, err := asn1.Marshal(encPart)
+	if err != nil {
+		return nil, err
+	}
+	b = asn1tools.AddASNAppTag(b, asnAppTag.EncAPRepPart)
+	ed, err := crypto.GetEncryptedData(b, apReq.Ticket.DecryptedEncPart.Key, keyusage.AP_REP_ENCPART, 0)
+	if err != nil {
+		return nil, err
+	}
+	apRep := messages.APRep{
+		PVNO:    iana.PVNO,
+		MsgType: msgtype.KRB_AP_REP,
+		EncPart: ed,
+	}
+	b, err = asn1.Marshal(apRep)
+	if err != nil {
+		return nil, err
+	}
+	b = asn1tools.AddASNAppTag(b, asnAppTag.APREP)
+	return marshalKrb5Token(krb5TokIDAPRep, b)
+}
+
+// marshalKrb5Token frames an inner token as a GSS-API initial context token.
+func marshalKrb5Token(tokID, inner []byte) ([]byte, error) {
+	b, err := asn1.Marshal(gssapi.OIDKRB5.OID())
+	if err != nil {
+		return nil, err
+	}
+	b = append(b, tokID...)
+	b = append(b, inner...)
+	return asn1tools.AddASNAppTag(b, 0), nil
+}
+
+// Principal returns the client principal, e.g. "alice@EXAMPLE.COM".
+func (c *krb5Context) Principal() string {
+	return c.principal
+}
+
+func (c *krb5Context) sealUsage(fromAcceptor bool) uint32 {
+	if fromAcceptor {
+		return keyusage.GSSAPI_ACCEPTOR_SEAL
+	}
+	return keyusage.GSSAPI_INITIATOR_SEAL
+}
+
+func krb5WrapHeader(flags byte, ec, rrc uint16, seq uint64) []byte {
+	h := make([]byte, krb5WrapHeaderLen)
+	copy(h, krb5TokIDWrap)
+	h[2] = flags
+	h[3] = 0xFF
+	binary.BigEndian.PutUint16(h[4:], ec)
+	binary.BigEndian.PutUint16(h[6:], rrc)
+	binary.BigEndian.PutUint64(h[8:], seq)
+	return h
+}
+
+// Wrap makes a RFC 4121 wrap token of b, encrypted if conf is true.
+func (c *krb5Context) Wrap(b []byte, conf bool) ([]byte, error) {
+	et, err := crypto.GetEtype(c.key.KeyType)
+	if err != nil {
+		return nil, err
+	}
+	c.smu.Lock()
+	seq := c.sendSeq
+	c.sendSeq++
+	c.smu.Unlock()
+
+	var flags byte
+	if c.acceptor {
+		flags |= krb5FlagSentByAcceptor
+	}
+	usage := c.sealUsage(c.acceptor)
+	if conf {
+		flags |= krb5FlagSealed
+		header := krb5WrapHeader(flags, 0, 0, seq)
+		plain := append(append([]byte(nil), b...), header...)
+		_, cipher, err := et.EncryptMessage(c.key.KeyValue, plain, usage)
+		if err != nil {
+			return nil, err
+		}
+		return append(header, cipher...), nil
+	}
+
+	cksum, err := et.GetChecksumHash(c.key.KeyValue, append(append([]byte(nil), b...), krb5WrapHeader(flags, 0, 0, seq)...), usage)
+	if err != nil {
+		return nil, err
+	}
+	token := krb5WrapHeader(flags, uint16(len(cksum)), 0, seq)
+	token = append(token, b...)
+	return append(token, cksum...), nil
+}
+
+// Unwrap verifies a RFC 4121 wrap token of the peer and returns its data.
+func (c *krb5Context) Unwrap(token []byte) ([]byte, bool, error) {
+	if len(token) < krb5WrapHeaderLen || !hmac.Equal(token[:2], krb5TokIDWrap) || token[3] != 0xFF {
+		return nil, false, ErrKrb5Token
+	}
+	flags := token[2]
+	fromAcceptor := flags&krb5FlagSentByAcceptor != 0
+	if fromAcceptor == c.acceptor || flags&krb5FlagAcceptorSubkey != 0 {
+		return nil, false, ErrKrb5Token
+	}
+	ec := int(binary.BigEndian.Uint16(token[4:]))
+	rrc := int(binary.BigEndian.Uint16(token[6:]))
+	seq := binary.BigEndian.Uint64(token[8:])
+
+	data := append([]byte(nil), token[krb5WrapHeaderLen:]...)
+	if len(data) > 0 && rrc > 0 {
+		rrc %= len(data)
+		data = append(data[rrc:], data[:rrc]...)
+	}
+	et, err := crypto.GetEtype(c.key.KeyType)
+	if err != nil {
+		return nil, false, err
+	}
+	usage := c.sealUsage(fromAcceptor)
+
+	var b []byte
+	sealed := flags&krb5FlagSealed != 0
+	if sealed {
+		plain, err := et.DecryptMessage(c.key.KeyValue, data, usage)
+		if err != nil {
+			return nil, false, err
+		}
+		if len(plain) < ec+krb5WrapHeaderLen {
+			return nil, false, ErrKrb5Token
+		}
+		header := plain[len(plain)-krb5WrapHeaderLen:]
+		if !hmac.Equal(header[:6], token[:6]) || !hmac.Equal(header[8:], token[8:krb5WrapHeaderLen]) {
+			return nil, false, ErrKrb5Token
+		}
+		b = plain[:len(plain)-krb5WrapHeaderLen-ec]
+	} else {
+		if len(data) < ec {
+			return nil, false, ErrKrb5Token
+		}
+		b = data[:len(data)-ec]
+		cksum := data[len(data)-ec:]
+		plain := append(append([]byte(nil), b...), krb5WrapHeader(flags, 0, 0, seq)...)
+		if !et.VerifyChecksum(c.key.KeyValue, plain, cksum, usage) {
+			return nil, false, ErrKrb5Token
+		}
+	}
+
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	if seq != c.recvSeq {
+		return nil, false, ErrKrb5Sequence
+	}
+	c.recvSeq++
+	return b, sealed, nil
+}
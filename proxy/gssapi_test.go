@@ -0,0 +1,232 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jcmturner/gokrb5/v8/crypto"
+	"github.com/jcmturner/gokrb5/v8/iana/etypeID"
+	"github.com/jcmturner/gokrb5/v8/iana/flags"
+	"github.com/jcmturner/gokrb5/v8/iana/keyusage"
+	"github.com/jcmturner/gokrb5/v8/iana/nametype"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+	"github.com/jcmturner/gokrb5/v8/types"
+	"github.com/remones/gsocks/config"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testRealm   = "EXAMPLE.COM"
+	testService = "rcmd/proxy.example.com"
+)
+
+// testKDC stands in for a KDC, it issues service tickets encrypted with
+// the key of the service in its keytab.
+type testKDC struct {
+	keytab *keytab.Keytab
+}
+
+func newTestKDC(t *testing.T) *testKDC {
+	kt := keytab.New()
+	if err := kt.AddEntry(testService, testRealm, "s3cret", time.Now(), 1, etypeID.AES256_CTS_HMAC_SHA1_96); err != nil {
+		t.Fatal(err)
+	}
+	return &testKDC{keytab: kt}
+}
+
+// initiator returns the initial context token of user and the client side
+// context to use once the server accepts it.
+func (kdc *testKDC) initiator(t *testing.T, user string, mutual bool) ([]byte, *krb5Context) {
+	now := time.Now().UTC()
+	cname := types.NewPrincipalName(nametype.KRB_NT_PRINCIPAL, user)
+	sname := types.NewPrincipalName(nametype.KRB_NT_SRV_INST, testService)
+	tkt, sessionKey, err := messages.NewTicket(cname, testRealm, sname, testRealm, types.NewKrbFlags(),
+		kdc.keytab, etypeID.AES256_CTS_HMAC_SHA1_96, 1, now, now, now.Add(time.Hour), now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth, err := types.NewAuthenticator(testRealm, cname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	apReq, err := messages.NewAPReq(tkt, sessionKey, auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mutual {
+		types.SetFlag(&apReq.APOptions, flags.APOptionMutualRequired)
+	}
+	b, err := apReq.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := marshalKrb5Token([]byte{0x01, 0x00}, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := &krb5Context{
+		key:     sessionKey,
+		sendSeq: uint64(auth.SeqNumber),
+		recvSeq: uint64(auth.SeqNumber),
+	}
+	return token, ctx
+}
+
+// readAPRep verifies the AP-REP of mutual authentication and sets the
+// acceptor's sequence number.
+func readAPRep(t *testing.T, token []byte, ctx *krb5Context) {
+	var tok spnego.KRB5Token
+	if err := tok.Unmarshal(token); err != nil {
+		t.Fatal(err)
+	}
+	b, err := crypto.DecryptEncPart(tok.APRep.EncPart, ctx.key, keyusage.AP_REP_ENCPART)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var part messages.EncAPRepPart
+	if err := part.Unmarshal(b); err != nil {
+		t.Fatal(err)
+	}
+	ctx.recvSeq = uint64(part.SequenceNumber)
+}
+
+func TestKrb5Context_WrapUnwrap(t *testing.T) {
+	kdc := newTestKDC(t)
+	token, client := kdc.initiator(t, "alice", false)
+
+	server := newKrb5AcceptorWithKeytab(kdc.keytab, "").newContext(nil).(*krb5Context)
+	out, established, err := server.Accept(token)
+	assert.NoError(t, err)
+	assert.True(t, established)
+	assert.Nil(t, out)
+	assert.Equal(t, "alice@"+testRealm, server.principal)
+
+	for _, conf := range []bool{false, true} {
+		wrapped, err := client.Wrap([]byte("hello"), conf)
+		assert.NoError(t, err)
+		b, gotConf, err := server.Unwrap(wrapped)
+		assert.NoError(t, err)
+		assert.Equal(t, conf, gotConf)
+		assert.Equal(t, "hello", string(b))
+
+		wrapped, err = server.Wrap([]byte("world"), conf)
+		assert.NoError(t, err)
+		b, _, err = client.Unwrap(wrapped)
+		assert.NoError(t, err)
+		assert.Equal(t, "world", string(b))
+	}
+
+	// a replayed token is out of sequence
+	wrapped, err := client.Wrap([]byte("hello"), true)
+	assert.NoError(t, err)
+	_, _, err = server.Unwrap(wrapped)
+	assert.NoError(t, err)
+	_, _, err = server.Unwrap(wrapped)
+	assert.Equal(t, ErrKrb5Sequence, err)
+
+	// a tampered token is rejected
+	wrapped, err = client.Wrap([]byte("hello"), false)
+	assert.NoError(t, err)
+	wrapped[krb5WrapHeaderLen] ^= 0xFF
+	_, _, err = server.Unwrap(wrapped)
+	assert.Equal(t, ErrKrb5Token, err)
+}
+
+func TestKrb5Context_RejectWrongKey(t *testing.T) {
+	kdc := newTestKDC(t)
+	token, _ := kdc.initiator(t, "alice", false)
+
+	other := newTestKDC(t)
+	other.keytab = keytab.New()
+	other.keytab.AddEntry(testService, testRealm, "another", time.Now(), 1, etypeID.AES256_CTS_HMAC_SHA1_96)
+	server := newKrb5AcceptorWithKeytab(other.keytab, "").newContext(nil)
+	_, _, err := server.Accept(token)
+	assert.Error(t, err)
+}
+
+func TestGSSAPIAuthenticate_AuthenticateConn(t *testing.T) {
+	kdc := newTestKDC(t)
+	dir, err := ioutil.TempDir("", "gsocks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ktFile := filepath.Join(dir, "krb5.keytab")
+	b, err := kdc.keytab.Marshal()
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(ktFile, b, 0600))
+
+	auth, err := NewGSSAPIAuthenticate(&config.GssAPI{
+		Enable:           true,
+		Keytab:           ktFile,
+		ServicePrincipal: testService,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, client := net.Pipe()
+	defer client.Close()
+	connCh := make(chan net.Conn, 1)
+	go func() {
+		defer server.Close()
+		conn, ok, err := auth.AuthenticateConn(server)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		connCh <- conn
+		io.Copy(conn, conn)
+	}()
+
+	token, ctx := kdc.initiator(t, "alice", true)
+	assert.NoError(t, writeGSSMessage(client, gssapiMsgContext, token))
+	mtyp, reply, err := readGSSMessage(client)
+	assert.NoError(t, err)
+	assert.Equal(t, gssapiMsgContext, mtyp)
+	readAPRep(t, reply, ctx)
+
+	level, err := ctx.Wrap([]byte{GSSProtectionConfidentiality}, false)
+	assert.NoError(t, err)
+	assert.NoError(t, writeGSSMessage(client, gssapiMsgProtection, level))
+	mtyp, reply, err = readGSSMessage(client)
+	assert.NoError(t, err)
+	assert.Equal(t, gssapiMsgProtection, mtyp)
+	b, _, err = ctx.Unwrap(reply)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{GSSProtectionConfidentiality}, b)
+	assert.True(t, (<-connCh).(*gssConn).conf)
+
+	// the echoed data is encapsulated in both directions
+	go func() {
+		wrapped, err := ctx.Wrap([]byte("ping"), true)
+		assert.NoError(t, err)
+		writeGSSMessage(client, gssapiMsgEncapsulation, wrapped)
+	}()
+	mtyp, reply, err = readGSSMessage(client)
+	assert.NoError(t, err)
+	assert.Equal(t, gssapiMsgEncapsulation, mtyp)
+	b, conf, err := ctx.Unwrap(reply)
+	assert.NoError(t, err)
+	assert.True(t, conf)
+	assert.Equal(t, "ping", string(b))
+}
+
+func TestGSSAPIAuthenticate_Abort(t *testing.T) {
+	kdc := newTestKDC(t)
+	auth := &GSSAPIAuthenticate{
+		newContext: newKrb5AcceptorWithKeytab(kdc.keytab, "").newContext,
+	}
+	rw := bytes.NewBuffer(nil)
+	writeGSSMessage(rw, gssapiMsgContext, []byte("garbage"))
+	ok, err := auth.Authenticate(rw)
+	assert.Error(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, []byte{gssapiVersion, gssapiMsgAbort}, rw.Bytes())
+}
@@ -0,0 +1,290 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// httpProxyVersion marks a session speaking the HTTP proxy protocol, it
+// never collides with a SOCKS version byte.
+const httpProxyVersion = uint8('H')
+
+// hopHeaders are removed before a request or a response is forwarded.
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// isHTTPMethodPrefix reports whether b may be the first byte of a request
+// line, i.e. CONNECT, DELETE, GET, HEAD, OPTIONS, PATCH, POST, PUT or TRACE.
+func isHTTPMethodPrefix(b byte) bool {
+	return strings.IndexByte("CDGHOPT", b) >= 0
+}
+
+// bufferedConn is a net.Conn whose reads go through r, so the bytes that
+// were already consumed when sniffing the protocol are not lost.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func newBufferedConn(c net.Conn, prefix []byte) *bufferedConn {
+	return &bufferedConn{
+		Conn: c,
+		r:    bufio.NewReader(io.MultiReader(bytes.NewReader(prefix), c)),
+	}
+}
+
+// ServeHTTP serves HTTP proxy requests on the session until the client or
+// the target closes the connection. CONNECT requests are tunneled, others
+// must carry an absolute URI and are forwarded.
+func (s *Session) ServeHTTP(ctx context.Context) error {
+	bc, ok := s.Conn.(*bufferedConn)
+	if !ok {
+		bc = newBufferedConn(s.Conn, nil)
+		s.Conn = bc
+	}
+
+	var target *httpTarget
+	defer func() {
+		if target != nil {
+			target.Close()
+		}
+	}()
+
+	for {
+		req, err := http.ReadRequest(bc.r)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if !s.authenticateHTTP(ctx, req) {
+			io.Copy(io.Discard, req.Body)
+			if err := s.writeHTTPStatus(http.StatusProxyAuthRequired); err != nil {
+				return err
+			}
+			if req.Close {
+				return ErrAuthenticateFailed
+			}
+			continue
+		}
+
+		if req.Method == http.MethodConnect {
+			dest, err := newAddrSpecFromHostPort(req.Host, "443")
+			if err != nil {
+				s.writeHTTPStatus(http.StatusBadRequest)
+				return err
+			}
+			connReq := &Request{
+				Version:  httpProxyVersion,
+				Command:  CmdConnect,
+				DestAddr: dest,
+			}
+			if err := s.authorize(connReq); err != nil {
+				return err
+			}
+			return s.handleCmdConnect(ctx, connReq)
+		}
+
+		if !req.URL.IsAbs() || req.URL.Scheme != "http" {
+			s.writeHTTPStatus(http.StatusBadRequest)
+			return fmt.Errorf("http: not a proxy request: %s", req.RequestURI)
+		}
+		host := req.URL.Host
+		dest, err := newAddrSpecFromHostPort(host, "80")
+		if err != nil {
+			s.writeHTTPStatus(http.StatusBadRequest)
+			return err
+		}
+		// every request is authorized, as the requests kept alive may carry
+		// the credentials of another user.
+		err = s.authorize(&Request{
+			Version:  httpProxyVersion,
+			Command:  CmdConnect,
+			DestAddr: dest,
+		})
+		if err != nil {
+			return err
+		}
+		if target != nil && (target.host != host || target.username != s.username()) {
+			target.Close()
+			target = nil
+		}
+		if target == nil {
+			conn, err := s.resolverAndDialAddr(ctx, dest)
+			if err != nil {
+				return err
+			}
+			target = &httpTarget{
+				Conn:     conn,
+				host:     host,
+				username: s.username(),
+				r:        bufio.NewReader(conn),
+			}
+		}
+
+		keepAlive, err := s.forwardHTTP(req, target)
+		if err != nil || !keepAlive {
+			return err
+		}
+	}
+}
+
+type httpTarget struct {
+	net.Conn
+	host string
+	// username is the user the connection was dialed for, it is not reused
+	// for another one.
+	username string
+	r        *bufio.Reader
+}
+
+func (s *Session) forwardHTTP(req *http.Request, target *httpTarget) (keepAlive bool, err error) {
+	removeHopHeaders(req.Header)
+	req.RequestURI = ""
+	if err := req.Write(target); err != nil {
+		s.writeHTTPStatus(http.StatusBadGateway)
+		return false, err
+	}
+
+	resp, err := http.ReadResponse(target.r, req)
+	if err != nil {
+		s.writeHTTPStatus(http.StatusBadGateway)
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	removeHopHeaders(resp.Header)
+	keepAlive = !req.Close && !resp.Close
+	if !keepAlive {
+		resp.Close = true
+	}
+	if err := resp.Write(s.Conn); err != nil {
+		return false, err
+	}
+	return keepAlive, nil
+}
+
+func removeHopHeaders(h http.Header) {
+	for _, f := range h["Connection"] {
+		for _, name := range strings.Split(f, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// authenticateHTTP authenticates the credentials of req if it has some and
+// the client may authenticate with a password, else the client is served as
+// the identity of its connection or if it requires no authentication.
+func (s *Session) authenticateHTTP(ctx context.Context, req *http.Request) bool {
+	header := req.Header.Get("Proxy-Authorization")
+	auth, ok := s.srv.authenticators[AuthUserPass].(*UserPassAuthenticator)
+	if !ok || header == "" || !s.allowsMethod(AuthUserPass) {
+		return s.authenticateConn() || s.allowsMethod(AuthNoRequried)
+	}
+	if err := s.checkLockout(); err != nil {
+		return false
+	}
+	user, passwd, ok := parseProxyBasicAuth(header)
+	if !ok {
+		return false
+	}
+	status, err := auth.verify(ctx, s.RemoteAddr(), user, passwd)
+	if err != nil {
+		s.logf("authenticate: %v", err)
+	}
+	if status != UserPassSuccess {
+		return false
+	}
+	s.setIdentity(auth.identity(user))
+	return true
+}
+
+func parseProxyBasicAuth(auth string) (username, password string, ok bool) {
+	const prefix = "Basic "
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return "", "", false
+	}
+	b, err := base64.StdEncoding.DecodeString(auth[len(prefix):])
+	if err != nil {
+		return "", "", false
+	}
+	cs := string(b)
+	i := strings.IndexByte(cs, ':')
+	if i < 0 {
+		return "", "", false
+	}
+	return cs[:i], cs[i+1:], true
+}
+
+// sendHTTPReply maps a SOCKS reply code onto an HTTP status line, so the
+// CONNECT handling can be shared with SOCKS sessions.
+func (s *Session) sendHTTPReply(code ReplyCode) error {
+	var status int
+	switch code {
+	case ReplySuccessed:
+		_, err := io.WriteString(s, "HTTP/1.1 200 Connection established\r\n\r\n")
+		return err
+	case ReplyNotAllowed:
+		status = http.StatusForbidden
+	case ReplyNetworkUnreachable, ReplyHostUnreachable, ReplyConnectionRefused:
+		status = http.StatusBadGateway
+	case ReplyTTLExpired:
+		status = http.StatusGatewayTimeout
+	case ReplyInvalidCommand, ReplyInvalidAddressType:
+		status = http.StatusBadRequest
+	default:
+		status = http.StatusInternalServerError
+	}
+	return s.writeHTTPStatus(status)
+}
+
+func (s *Session) writeHTTPStatus(status int) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "HTTP/1.1 %d %s\r\n", status, http.StatusText(status))
+	if status == http.StatusProxyAuthRequired {
+		b.WriteString("Proxy-Authenticate: Basic realm=\"gsocks\"\r\n")
+	}
+	b.WriteString("Content-Length: 0\r\n\r\n")
+	_, err := io.WriteString(s, b.String())
+	return err
+}
+
+func newAddrSpecFromHostPort(hostport, defaultPort string) (*AddrSpec, error) {
+	if _, _, err := net.SplitHostPort(hostport); err != nil {
+		hostport = net.JoinHostPort(strings.Trim(hostport, "[]"), defaultPort)
+	}
+	as, err := ParseAddrSpec(hostport)
+	if err != nil {
+		return nil, err
+	}
+	if as.Port == 0 {
+		return nil, fmt.Errorf("Invalid port: %q", "0")
+	}
+	return as, nil
+}
@@ -0,0 +1,172 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/remones/gsocks/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func serveTestSession(srv *Server) net.Conn {
+	server, client := net.Pipe()
+	srv.waitConns.Add(1)
+	go srv.serveSession(context.TODO(), server, nil)
+	return client
+}
+
+func TestSession_ServeHTTPConnect(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	srv := &Server{
+		authenticators: map[AuthType]ContextAuthenticator{AuthNoRequried: &AuthNoRequired{}},
+		DialTimeout:    300 * time.Millisecond,
+	}
+	client := serveTestSession(srv)
+	defer client.Close()
+
+	fmt.Fprintf(client, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", ln.Addr(), ln.Addr())
+	br := bufio.NewReader(client)
+	resp, err := http.ReadResponse(br, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	_, err = client.Write([]byte("ping"))
+	assert.NoError(t, err)
+	b := make([]byte, 4)
+	_, err = io.ReadFull(br, b)
+	assert.NoError(t, err)
+	assert.Equal(t, "ping", string(b))
+}
+
+func TestSession_ServeHTTPForward(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Empty(t, r.Header.Get("Proxy-Authorization"))
+		fmt.Fprintf(w, "hello, %s", r.URL.Path)
+	}))
+	defer backend.Close()
+
+	srv := &Server{
+		authenticators: map[AuthType]ContextAuthenticator{
+			AuthUserPass: NewUserPassAuthenticator(NewStaticStore(map[string]string{"si.li": "1234"})),
+		},
+		DialTimeout: 300 * time.Millisecond,
+	}
+	client := serveTestSession(srv)
+	defer client.Close()
+	br := bufio.NewReader(client)
+
+	// without credentials
+	go fmt.Fprintf(client, "GET %s/a HTTP/1.1\r\nHost: x\r\n\r\n", backend.URL)
+	resp, err := http.ReadResponse(br, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusProxyAuthRequired, resp.StatusCode)
+	assert.NotEmpty(t, resp.Header.Get("Proxy-Authenticate"))
+
+	// the connection is kept alive for the retry
+	cred := base64.StdEncoding.EncodeToString([]byte("si.li:1234"))
+	for _, path := range []string{"/a", "/b"} {
+		go fmt.Fprintf(client, "GET %s%s HTTP/1.1\r\nHost: x\r\nProxy-Authorization: Basic %s\r\n\r\n", backend.URL, path, cred)
+		resp, err = http.ReadResponse(br, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		body, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, "hello, "+path, string(body))
+	}
+}
+
+func TestSession_ServeHTTPForwardAuthorizesEveryRequest(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "hello")
+	}))
+	defer backend.Close()
+
+	cfg := config.NewConfig()
+	cfg.Auth.NoRequired = nil
+	cfg.Auth.UserPasswd = &config.UserPasswd{
+		Enable: true,
+		Account: []config.Account{
+			{Username: "si.li", Password: "1234"},
+			{Username: "wu.wang", Password: "5678", Policy: "bind-only"},
+		},
+	}
+	cfg.Policy = []config.Policy{{Name: "bind-only", Commands: []string{"bind"}}}
+	srv, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := serveTestSession(srv)
+	defer client.Close()
+	br := bufio.NewReader(client)
+
+	get := func(cred string) *http.Response {
+		go fmt.Fprintf(client, "GET %s/ HTTP/1.1\r\nHost: x\r\nProxy-Authorization: Basic %s\r\n\r\n",
+			backend.URL, base64.StdEncoding.EncodeToString([]byte(cred)))
+		resp, err := http.ReadResponse(br, nil)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		io.Copy(io.Discard, resp.Body)
+		return resp
+	}
+	if resp := get("si.li:1234"); resp != nil {
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+	// the next user on the same connection is denied by its own policy
+	if resp := get("wu.wang:5678"); resp != nil {
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	}
+}
+
+func TestSession_ServeHTTPBadGateway(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	srv := &Server{
+		authenticators: map[AuthType]ContextAuthenticator{AuthNoRequried: &AuthNoRequired{}},
+		DialTimeout:    300 * time.Millisecond,
+	}
+	client := serveTestSession(srv)
+	defer client.Close()
+
+	go fmt.Fprintf(client, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", addr, addr)
+	resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+}
+
+func Test_parseProxyBasicAuth(t *testing.T) {
+	user, passwd, ok := parseProxyBasicAuth("basic " + base64.StdEncoding.EncodeToString([]byte("a:b:c")))
+	assert.True(t, ok)
+	assert.Equal(t, "a", user)
+	assert.Equal(t, "b:c", passwd)
+
+	_, _, ok = parseProxyBasicAuth("Bearer abc")
+	assert.False(t, ok)
+}
@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+)
+
+// Identity is who a client authenticated as, it picks the policy and the
+// routes of the requests of its session.
+type Identity struct {
+	// Username is empty for the anonymous clients
+	Username string
+	Groups   []string
+	// Attributes are the other facts the method knows of the client, e.g.
+	// the realm of a Kerberos principal.
+	Attributes map[string]string
+	// Method is the method the client authenticated with
+	Method AuthType
+}
+
+func (id *Identity) String() string {
+	if id == nil || id.Username == "" {
+		return "-"
+	}
+	return id.Username
+}
+
+// username is the authenticated user of the session, empty without
+// authentication.
+func (s *Session) username() string {
+	if s.identity == nil {
+		return ""
+	}
+	return s.identity.Username
+}
+
+// setIdentity sets the identity of the session, which picks its policy: the
+// policy of the user, or else of its first group having one, or else of its
+// listener. The session of the previous user ends if it changes, as the HTTP
+// requests may carry different credentials.
+func (s *Session) setIdentity(id *Identity) {
+	if s.identity != nil && id != nil && s.identity.Username == id.Username {
+		s.identity = id
+		return
+	}
+	s.releaseUser()
+	s.srv.trackUser(s.username(), -1)
+	s.identity = id
+	s.policy = s.srv.policyOf(id)
+	if s.policy == nil && id != nil && s.endpoint != nil {
+		s.policy = s.endpoint.policy
+	}
+	s.srv.trackUser(s.username(), 1)
+}
+
+// logf logs a message about the session, prefixed by its client and user.
+func (s *Session) logf(format string, args ...interface{}) {
+	s.srv.logf("socks: %s %s: "+format, append([]interface{}{s.RemoteAddr(), s.identity}, args...)...)
+}
+
+// trackUser counts the sessions of the authenticated users.
+func (srv *Server) trackUser(user string, delta int) {
+	if user == "" {
+		return
+	}
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.users == nil {
+		srv.users = make(map[string]int)
+	}
+	if srv.users[user] += delta; srv.users[user] <= 0 {
+		delete(srv.users, user)
+	}
+}
+
+// ActiveUsers returns the number of sessions of the authenticated users by
+// username.
+func (srv *Server) ActiveUsers() map[string]int {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	users := make(map[string]int, len(srv.users))
+	for user, n := range srv.users {
+		users[user] = n
+	}
+	return users
+}
+
+// watchContext interrupts the I/O of conn once ctx is done, until stop is
+// called.
+func watchContext(ctx context.Context, conn net.Conn) (stop func()) {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+		<-exited
+	}
+}
+
+// principalIdentity is the identity of a Kerberos principal, e.g.
+// "alice@EXAMPLE.COM", whose realm is an attribute.
+func principalIdentity(principal string) *Identity {
+	id := &Identity{Username: principal, Method: AuthGSSAPI}
+	if i := strings.LastIndexByte(principal, '@'); i >= 0 {
+		id.Attributes = map[string]string{"realm": principal[i+1:]}
+	}
+	return id
+}
@@ -0,0 +1,130 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/remones/gsocks/config"
+	"github.com/stretchr/testify/assert"
+)
+
+// legacyAuthenticator only implements Authenticator, accepting a client
+// sending 0x01.
+type legacyAuthenticator struct{}
+
+func (legacyAuthenticator) Type() AuthType { return AuthType(0x80) }
+
+func (legacyAuthenticator) Authenticate(rw io.ReadWriter) (bool, error) {
+	b := make([]byte, 1)
+	if _, err := io.ReadFull(rw, b); err != nil {
+		return false, err
+	}
+	return b[0] == 0x01, nil
+}
+
+func TestAdaptAuthenticator(t *testing.T) {
+	up := NewUserPassAuthenticator()
+	assert.Same(t, up, AdaptAuthenticator(up))
+
+	auth := AdaptAuthenticator(legacyAuthenticator{})
+	assert.Equal(t, AuthType(0x80), auth.Type())
+	for _, b := range []byte{0x01, 0x02} {
+		server, client := net.Pipe()
+		go client.Write([]byte{b})
+		id, conn, err := auth.AuthenticateContext(context.Background(), &AuthRequest{Conn: server})
+		assert.NoError(t, err)
+		assert.Equal(t, server, conn)
+		if b == 0x01 {
+			assert.Equal(t, &Identity{Method: AuthType(0x80)}, id)
+		} else {
+			assert.Nil(t, id)
+		}
+		server.Close()
+		client.Close()
+	}
+}
+
+func TestPrincipalIdentity(t *testing.T) {
+	id := principalIdentity("alice@EXAMPLE.COM")
+	assert.Equal(t, "alice@EXAMPLE.COM", id.Username)
+	assert.Equal(t, "EXAMPLE.COM", id.Attributes["realm"])
+	assert.Equal(t, AuthGSSAPI, id.Method)
+	assert.Equal(t, "alice@EXAMPLE.COM", id.String())
+	assert.Equal(t, "-", (*Identity)(nil).String())
+}
+
+func TestSession_AuthenticateContext(t *testing.T) {
+	cfg := config.NewConfig()
+	cfg.Auth.NoRequired = nil
+	cfg.Auth.UserPasswd = &config.UserPasswd{
+		Enable:  true,
+		Account: []config.Account{{Username: "si.li", Password: "1234", Groups: []string{"staff", "ops"}}},
+	}
+	cfg.Policy = []config.Policy{{Name: "ops", Groups: []string{"ops"}, Commands: []string{"connect"}}}
+	srv, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.SetAuthenticator(AdaptAuthenticator(legacyAuthenticator{}))
+
+	server, client := net.Pipe()
+	defer client.Close()
+	s := srv.newSession(server, Socks5Version)
+	go func() {
+		client.Write([]byte{1, byte(AuthUserPass)})
+		io.ReadFull(client, make([]byte, 2))
+		client.Write([]byte{1, 5, 's', 'i', '.', 'l', 'i', 4, '1', '2', '3', '4'})
+		io.ReadFull(client, make([]byte, 2))
+	}()
+	ok, err := s.AuthenticateContext(context.Background())
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, &Identity{Username: "si.li", Groups: []string{"staff", "ops"}, Method: AuthUserPass}, s.identity)
+	if assert.NotNil(t, s.policy) {
+		assert.Equal(t, "ops", s.policy.name)
+	}
+	assert.Equal(t, map[string]int{"si.li": 1}, srv.ActiveUsers())
+	s.Close()
+	assert.Empty(t, srv.ActiveUsers())
+
+	// the legacy authenticator is anonymous
+	server, client = net.Pipe()
+	defer client.Close()
+	s = srv.newSession(server, Socks5Version)
+	defer s.Close()
+	go func() {
+		client.Write([]byte{1, 0x80})
+		io.ReadFull(client, make([]byte, 2))
+		client.Write([]byte{0x01})
+	}()
+	ok, err = s.AuthenticateContext(context.Background())
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "", s.username())
+	assert.Nil(t, s.policy)
+}
+
+func TestSession_AuthenticateContextCanceled(t *testing.T) {
+	srv := &Server{
+		authenticators: map[AuthType]ContextAuthenticator{
+			AuthUserPass: NewUserPassAuthenticator(NewStaticStore(map[string]string{"si.li": "1234"})),
+		},
+	}
+	server, client := net.Pipe()
+	defer client.Close()
+	s := srv.newSession(server, Socks5Version)
+	defer s.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		client.Write([]byte{1, byte(AuthUserPass)})
+		io.ReadFull(client, make([]byte, 2))
+		// the client never sends its credentials
+		cancel()
+	}()
+	ok, err := s.AuthenticateContext(ctx)
+	assert.Error(t, err)
+	assert.False(t, ok)
+}
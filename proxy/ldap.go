@@ -0,0 +1,238 @@
+package proxy
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/remones/gsocks/config"
+)
+
+const defaultLDAPUserFilter = "(uid={username})"
+
+type ldapStore struct {
+	url       string
+	startTLS  bool
+	tlsConfig *tls.Config
+	timeout   time.Duration
+
+	bindDN       string
+	bindPassword string
+	baseDN       string
+	userFilter   string
+	groupBaseDN  string
+	groupFilter  string
+
+	cacheTTL time.Duration
+	// cacheKey keys the HMAC of the passwords cached, so the plaintext
+	// passwords are not kept in memory.
+	cacheKey []byte
+	mu       sync.Mutex
+	cache    map[string]ldapCacheEntry
+}
+
+type ldapCacheEntry struct {
+	mac     []byte
+	expires time.Time
+}
+
+// NewLDAPStore returns a store verifying the accounts of a directory server
+// by a search of the entry of the user, then a bind to it with the
+// password.
+func NewLDAPStore(cfg *config.LDAP) (CredentialStore, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		ServerName:         u.Hostname(),
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+	if cfg.CACert != "" {
+		pem, err := ioutil.ReadFile(cfg.CACert)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("socks: no certificate in %s", cfg.CACert)
+		}
+	}
+	s := &ldapStore{
+		url:          cfg.URL,
+		startTLS:     cfg.StartTLS,
+		tlsConfig:    tlsConfig,
+		timeout:      defaultCredentialTimeout,
+		bindDN:       cfg.BindDN,
+		bindPassword: cfg.BindPassword,
+		baseDN:       cfg.BaseDN,
+		userFilter:   cfg.UserFilter,
+		groupBaseDN:  cfg.GroupBaseDN,
+		groupFilter:  cfg.GroupFilter,
+		cacheTTL:     time.Duration(cfg.CacheTTL) * time.Millisecond,
+	}
+	if cfg.Timeout > 0 {
+		s.timeout = time.Duration(cfg.Timeout) * time.Millisecond
+	}
+	if s.userFilter == "" {
+		s.userFilter = defaultLDAPUserFilter
+	}
+	if s.groupBaseDN == "" {
+		s.groupBaseDN = s.baseDN
+	}
+	if s.cacheTTL > 0 {
+		s.cacheKey = make([]byte, 32)
+		if _, err := rand.Read(s.cacheKey); err != nil {
+			return nil, err
+		}
+		s.cache = make(map[string]ldapCacheEntry)
+	}
+	return s, nil
+}
+
+func (s *ldapStore) Verify(ctx context.Context, username, password string) (bool, error) {
+	// a bind with an empty password is an anonymous bind, which succeeds
+	if username == "" || password == "" {
+		return false, nil
+	}
+	if s.cached(username, password) {
+		return true, nil
+	}
+
+	conn, err := s.dial()
+	if err != nil {
+		return false, fmt.Errorf("socks: ldap: %v", err)
+	}
+	defer conn.Close()
+	// the connection is closed to interrupt the operations once ctx is done
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	if s.bindDN != "" {
+		if err := conn.Bind(s.bindDN, s.bindPassword); err != nil {
+			return false, fmt.Errorf("socks: ldap: bind %s: %v", s.bindDN, err)
+		}
+	}
+	filter := strings.Replace(s.userFilter, "{username}", ldap.EscapeFilter(username), -1)
+	entries, err := s.search(conn, s.baseDN, filter)
+	if err != nil {
+		return false, err
+	}
+	switch len(entries) {
+	case 0:
+		return false, ErrUnknownUser
+	case 1:
+	default:
+		return false, fmt.Errorf("socks: ldap: %s matches %d entries", filter, len(entries))
+	}
+	dn := entries[0].DN
+
+	if s.groupFilter != "" {
+		filter := strings.Replace(s.groupFilter, "{username}", ldap.EscapeFilter(username), -1)
+		filter = strings.Replace(filter, "{dn}", ldap.EscapeFilter(dn), -1)
+		groups, err := s.search(conn, s.groupBaseDN, filter)
+		if err != nil {
+			return false, err
+		}
+		if len(groups) == 0 {
+			return false, nil
+		}
+	}
+
+	if err := conn.Bind(dn, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return false, nil
+		}
+		return false, fmt.Errorf("socks: ldap: bind %s: %v", dn, err)
+	}
+	s.store(username, password)
+	return true, nil
+}
+
+func (s *ldapStore) dial() (*ldap.Conn, error) {
+	conn, err := ldap.DialURL(s.url,
+		ldap.DialWithDialer(&net.Dialer{Timeout: s.timeout}),
+		ldap.DialWithTLSConfig(s.tlsConfig))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(s.timeout)
+	if s.startTLS {
+		if err := conn.StartTLS(s.tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func (s *ldapStore) search(conn *ldap.Conn, baseDN, filter string) ([]*ldap.Entry, error) {
+	// two entries are enough to know the filter is ambiguous
+	req := ldap.NewSearchRequest(baseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		2, int(s.timeout/time.Second), false, filter, []string{"dn"}, nil)
+	res, err := conn.Search(req)
+	if err != nil {
+		var lerr *ldap.Error
+		if errors.As(err, &lerr) && lerr.ResultCode == ldap.LDAPResultSizeLimitExceeded && res != nil {
+			return res.Entries, nil
+		}
+		return nil, fmt.Errorf("socks: ldap: search %s: %v", filter, err)
+	}
+	return res.Entries, nil
+}
+
+func (s *ldapStore) mac(password string) []byte {
+	h := hmac.New(sha256.New, s.cacheKey)
+	h.Write([]byte(password))
+	return h.Sum(nil)
+}
+
+// cached reports whether the account has been verified in the last TTL.
+func (s *ldapStore) cached(username, password string) bool {
+	if s.cache == nil {
+		return false
+	}
+	s.mu.Lock()
+	entry, ok := s.cache[username]
+	if ok && time.Now().After(entry.expires) {
+		delete(s.cache, username)
+		ok = false
+	}
+	s.mu.Unlock()
+	return ok && hmac.Equal(entry.mac, s.mac(password))
+}
+
+func (s *ldapStore) store(username, password string) {
+	if s.cache == nil {
+		return
+	}
+	mac := s.mac(password)
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for user, entry := range s.cache {
+		if now.After(entry.expires) {
+			delete(s.cache, user)
+		}
+	}
+	s.cache[username] = ldapCacheEntry{mac: mac, expires: now.Add(s.cacheTTL)}
+}
@@ -0,0 +1,307 @@
+package proxy
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/remones/gsocks/config"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestCertificate creates a self-signed certificate of 127.0.0.1 and
+// localhost, certPEM is the PEM of the certificate.
+func newTestCertificate(t *testing.T) (cert tls.Certificate, certPEM []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "gsocks test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		DNSNames:              []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key},
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+// ldapTestServer is a directory server of the few operations the ldap store
+// needs: simple binds, searches by exact filter and StartTLS.
+type ldapTestServer struct {
+	ln        net.Listener
+	ldaps     bool
+	tlsConfig *tls.Config
+	// passwords by DN
+	passwords map[string]string
+	// entries are the DNs by filter
+	entries map[string][]string
+	binds   int32
+}
+
+func newLDAPTestServer(t *testing.T, ldaps bool, tlsConfig *tls.Config) *ldapTestServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ldaps {
+		ln = tls.NewListener(ln, tlsConfig)
+	}
+	srv := &ldapTestServer{
+		ln:        ln,
+		ldaps:     ldaps,
+		tlsConfig: tlsConfig,
+		passwords: map[string]string{
+			"cn=proxy,dc=example,dc=org":            "proxy",
+			"uid=alice,ou=people,dc=example,dc=org": "alice",
+			"uid=bob,ou=people,dc=example,dc=org":   "bob",
+		},
+		entries: map[string][]string{
+			"(uid=alice)": {"uid=alice,ou=people,dc=example,dc=org"},
+			"(uid=bob)":   {"uid=bob,ou=people,dc=example,dc=org"},
+			"(uid=dup)":   {"uid=dup,ou=people,dc=example,dc=org", "uid=dup,ou=staff,dc=example,dc=org"},
+			"(&(cn=proxy-users)(member=uid=alice,ou=people,dc=example,dc=org))": {"cn=proxy-users,ou=groups,dc=example,dc=org"},
+		},
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go srv.serve(conn)
+		}
+	}()
+	return srv
+}
+
+func (srv *ldapTestServer) URL() string {
+	if srv.ldaps {
+		return "ldaps://" + srv.ln.Addr().String()
+	}
+	return "ldap://" + srv.ln.Addr().String()
+}
+
+func (srv *ldapTestServer) Close() {
+	srv.ln.Close()
+}
+
+func (srv *ldapTestServer) serve(conn net.Conn) {
+	defer func() { conn.Close() }()
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		id := packet.Children[0].Value.(int64)
+		op := packet.Children[1]
+		reply := func(tag ber.Tag, children ...*ber.Packet) {
+			envelope := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+			envelope.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, ""))
+			res := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "")
+			for _, child := range children {
+				res.AppendChild(child)
+			}
+			envelope.AppendChild(res)
+			conn.Write(envelope.Bytes())
+		}
+		result := func(code uint16) []*ber.Packet {
+			return []*ber.Packet{
+				ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), ""),
+				ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""),
+				ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""),
+			}
+		}
+
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			atomic.AddInt32(&srv.binds, 1)
+			dn := op.Children[1].Value.(string)
+			password := op.Children[2].Data.String()
+			code := uint16(ldap.LDAPResultSuccess)
+			if want, ok := srv.passwords[dn]; !ok || want != password {
+				code = ldap.LDAPResultInvalidCredentials
+			}
+			reply(ldap.ApplicationBindResponse, result(code)...)
+		case ldap.ApplicationSearchRequest:
+			base := op.Children[0].Value.(string)
+			filter, err := ldap.DecompileFilter(op.Children[6])
+			if err != nil {
+				return
+			}
+			for _, dn := range srv.entries[filter] {
+				if !strings.HasSuffix(dn, base) {
+					continue
+				}
+				reply(ldap.ApplicationSearchResultEntry,
+					ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, dn, ""),
+					ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, ""))
+			}
+			reply(ldap.ApplicationSearchResultDone, result(ldap.LDAPResultSuccess)...)
+		case ldap.ApplicationExtendedRequest:
+			reply(ldap.ApplicationExtendedResponse, result(ldap.LDAPResultSuccess)...)
+			tlsConn := tls.Server(conn, srv.tlsConfig)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn = tlsConn
+		default:
+			return
+		}
+	}
+}
+
+func TestLDAPStore(t *testing.T) {
+	srv := newLDAPTestServer(t, false, nil)
+	defer srv.Close()
+
+	cfg := &config.LDAP{
+		URL:          srv.URL(),
+		BindDN:       "cn=proxy,dc=example,dc=org",
+		BindPassword: "proxy",
+		BaseDN:       "dc=example,dc=org",
+	}
+	store, err := NewLDAPStore(cfg)
+	if !assert.NoError(t, err) {
+		return
+	}
+	tests := []struct {
+		username string
+		password string
+		want     bool
+		wantErr  error
+	}{
+		{"alice", "alice", true, nil},
+		{"alice", "bob", false, nil},
+		{"bob", "bob", true, nil},
+		// an empty password is an anonymous bind
+		{"alice", "", false, nil},
+		{"carol", "carol", false, ErrUnknownUser},
+		// the username is escaped in the filter
+		{"*", "alice", false, ErrUnknownUser},
+	}
+	for _, tt := range tests {
+		ok, err := store.Verify(context.Background(), tt.username, tt.password)
+		assert.Equal(t, tt.wantErr, err, tt.username)
+		assert.Equal(t, tt.want, ok, tt.username)
+	}
+	_, err = store.Verify(context.Background(), "dup", "dup")
+	assert.Error(t, err)
+
+	// bob is not a member of the group
+	cfg.GroupFilter = "(&(cn=proxy-users)(member={dn}))"
+	store, err = NewLDAPStore(cfg)
+	if !assert.NoError(t, err) {
+		return
+	}
+	ok, err := store.Verify(context.Background(), "alice", "alice")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = store.Verify(context.Background(), "bob", "bob")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	cfg.BindPassword = "wrong"
+	store, err = NewLDAPStore(cfg)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = store.Verify(context.Background(), "alice", "alice")
+	assert.Error(t, err)
+}
+
+func TestLDAPStore_cache(t *testing.T) {
+	srv := newLDAPTestServer(t, false, nil)
+	defer srv.Close()
+
+	store, err := NewLDAPStore(&config.LDAP{
+		URL:      srv.URL(),
+		BaseDN:   "dc=example,dc=org",
+		CacheTTL: 100,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	verify := func(username, password string) bool {
+		ok, err := store.Verify(context.Background(), username, password)
+		assert.NoError(t, err)
+		return ok
+	}
+	assert.True(t, verify("alice", "alice"))
+	binds := atomic.LoadInt32(&srv.binds)
+	assert.True(t, verify("alice", "alice"))
+	assert.Equal(t, binds, atomic.LoadInt32(&srv.binds))
+	// a different password is verified by the server
+	assert.False(t, verify("alice", "bob"))
+	assert.Equal(t, binds+1, atomic.LoadInt32(&srv.binds))
+
+	time.Sleep(150 * time.Millisecond)
+	binds = atomic.LoadInt32(&srv.binds)
+	assert.True(t, verify("alice", "alice"))
+	assert.Equal(t, binds+1, atomic.LoadInt32(&srv.binds))
+}
+
+func TestLDAPStore_TLS(t *testing.T) {
+	cert, certPEM := newTestCertificate(t)
+	dir, err := ioutil.TempDir("", "gsocks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := ioutil.WriteFile(caFile, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	for _, ldaps := range []bool{false, true} {
+		srv := newLDAPTestServer(t, ldaps, tlsConfig)
+		cfg := &config.LDAP{
+			URL:      srv.URL(),
+			StartTLS: !ldaps,
+			CACert:   caFile,
+			BaseDN:   "dc=example,dc=org",
+		}
+		store, err := NewLDAPStore(cfg)
+		if assert.NoError(t, err) {
+			ok, err := store.Verify(context.Background(), "alice", "alice")
+			assert.NoError(t, err, cfg.URL)
+			assert.True(t, ok, cfg.URL)
+		}
+
+		// the certificate is not trusted by the system
+		cfg.CACert = ""
+		store, err = NewLDAPStore(cfg)
+		if assert.NoError(t, err) {
+			_, err := store.Verify(context.Background(), "alice", "alice")
+			assert.Error(t, err, cfg.URL)
+		}
+		srv.Close()
+	}
+}
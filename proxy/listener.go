@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/remones/gsocks/config"
+)
+
+// endpoint is a listener of [[listener]], its clients have its TLS, PROXY
+// protocol, methods and policy.
+type endpoint struct {
+	name    string
+	address string
+
+	tlsReloader         *tlsReloader
+	tlsConfig           *tls.Config
+	tlsHandshakeTimeout time.Duration
+	tlsClientIdentity   string
+	proxyProtocol       *proxyProtocol
+	unixSocket          *unixSocket
+	// methods replace those of the server and its networks if not nil
+	methods []AuthType
+	// policy is the policy of the sessions whose user has none
+	policy *policy
+}
+
+// newEndpoints creates the listeners of cfg, policies are the policies by
+// name.
+func newEndpoints(cfg *config.Config, policies map[string]*policy) ([]*endpoint, error) {
+	endpoints := make([]*endpoint, 0, len(cfg.Listener))
+	for _, lc := range cfg.Listener {
+		ep := &endpoint{
+			name:    lc.Name,
+			address: lc.Address,
+		}
+		if ep.name == "" {
+			ep.name = lc.Address
+		}
+		var err error
+		if ep.methods, err = parseAuthMethods(lc.Methods); err != nil {
+			return nil, fmt.Errorf("socks: listener %s: %w", ep.name, err)
+		}
+		if ep.tlsReloader, err = newTLSReloader(lc.TLS); err != nil {
+			return nil, fmt.Errorf("socks: listener %s: %w", ep.name, err)
+		}
+		if ep.tlsReloader != nil {
+			ep.tlsConfig = ep.tlsReloader.tlsConfig()
+			ep.tlsHandshakeTimeout = time.Millisecond * time.Duration(lc.TLS.HandshakeTimeout)
+			ep.tlsClientIdentity = lc.TLS.ClientIdentity
+		}
+		if ep.proxyProtocol, err = newProxyProtocol(lc.ProxyProtocol); err != nil {
+			return nil, fmt.Errorf("socks: listener %s: %w", ep.name, err)
+		}
+		if ep.unixSocket, err = newUnixSocket(lc.Unix); err != nil {
+			return nil, fmt.Errorf("socks: listener %s: %w", ep.name, err)
+		}
+		if lc.Policy != "" {
+			p, ok := policies[lc.Policy]
+			if !ok {
+				return nil, fmt.Errorf("socks: unknown policy %q of listener %s", lc.Policy, ep.name)
+			}
+			ep.policy = p
+		}
+		endpoints = append(endpoints, ep)
+	}
+	return endpoints, nil
+}
+
+// listen listens on the address of the endpoint, the PROXY protocol headers
+// are read before TLS.
+func (ep *endpoint) listen(logf func(format string, args ...interface{})) (net.Listener, error) {
+	ln, err := listen(ep.address, ep.unixSocket)
+	if err != nil {
+		return nil, err
+	}
+	ln = ep.proxyProtocol.listener(ln, logf)
+	if ep.tlsConfig != nil {
+		ln = tls.NewListener(ln, ep.tlsConfig)
+	}
+	return ln, nil
+}
+
+// serveEndpoints serves all the listeners of [[listener]] until one of them
+// fails or the server is closed, the others are closed then.
+func (srv *Server) serveEndpoints() error {
+	lns := make([]net.Listener, 0, len(srv.endpoints))
+	for _, ep := range srv.endpoints {
+		ln, err := ep.listen(srv.logf)
+		if err != nil {
+			for _, ln := range lns {
+				ln.Close()
+			}
+			return fmt.Errorf("socks: listener %s: %w", ep.name, err)
+		}
+		lns = append(lns, ln)
+	}
+	errc := make(chan error, len(lns))
+	for i, ln := range lns {
+		ep := srv.endpoints[i]
+		if ep.tlsReloader != nil {
+			go ep.tlsReloader.watch(srv.getDoneChan())
+		}
+		go func(ln net.Listener) {
+			err := srv.serveListener(ln, ep)
+			if err != ErrServerClosed {
+				err = fmt.Errorf("socks: listener %s: %w", ep.name, err)
+			}
+			errc <- err
+		}(ln)
+	}
+	err := <-errc
+	for _, ln := range lns {
+		ln.Close()
+	}
+	for range lns[1:] {
+		<-errc
+	}
+	return err
+}
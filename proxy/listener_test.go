@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/remones/gsocks/config"
+	"github.com/stretchr/testify/assert"
+)
+
+// freeAddr returns a local address no one listens on.
+func freeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+func TestServer_serveEndpoints(t *testing.T) {
+	cfg := config.NewConfig()
+	cfg.Auth.UserPasswd = &config.UserPasswd{
+		Enable:  true,
+		Account: []config.Account{{Username: "si.li", Password: "1234"}},
+	}
+	cfg.Policy = []config.Policy{{Name: "guests", Commands: []string{"connect"}}}
+	cfg.Listener = []config.Listener{
+		{Name: "public", Address: freeAddr(t), Methods: []string{"username_password"}},
+		{Name: "local", Address: freeAddr(t), Methods: []string{"no_required"}, Policy: "guests"},
+	}
+	srv, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.ListenAndServe()
+	}()
+
+	greet := func(addr string) []byte {
+		var conn net.Conn
+		assert.Eventually(t, func() bool {
+			conn, err = net.Dial("tcp", addr)
+			return err == nil
+		}, time.Second, 10*time.Millisecond)
+		if conn == nil {
+			return nil
+		}
+		defer conn.Close()
+		conn.Write([]byte{Socks5Version, 2, byte(AuthNoRequried), byte(AuthUserPass)})
+		b := make([]byte, 2)
+		io.ReadFull(conn, b)
+		return b
+	}
+	assert.Equal(t, []byte{Socks5Version, byte(AuthUserPass)}, greet(cfg.Listener[0].Address))
+	assert.Equal(t, []byte{Socks5Version, byte(AuthNoRequried)}, greet(cfg.Listener[1].Address))
+
+	// the anonymous sessions of the local listener have its policy
+	server, client := net.Pipe()
+	defer client.Close()
+	s := srv.newSession(server, Socks5Version)
+	s.endpoint = srv.endpoints[1]
+	s.setIdentity(&Identity{Method: AuthNoRequried})
+	if assert.NotNil(t, s.policy) {
+		assert.Equal(t, "guests", s.policy.name)
+	}
+	s.Close()
+
+	assert.NoError(t, srv.Close(context.Background()))
+	select {
+	case err := <-served:
+		assert.Equal(t, ErrServerClosed, err)
+	case <-time.After(time.Second):
+		t.Fatal("ListenAndServe did not return")
+	}
+}
+
+func TestServer_serveEndpointsListenError(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	free := freeAddr(t)
+
+	cfg := config.NewConfig()
+	cfg.Listener = []config.Listener{{Address: free}, {Address: ln.Addr().String()}}
+	srv, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Error(t, srv.ListenAndServe())
+	// the listener opened is closed again
+	ln2, err := net.Listen("tcp", free)
+	if assert.NoError(t, err) {
+		ln2.Close()
+	}
+}
@@ -0,0 +1,364 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/remones/gsocks/config"
+)
+
+// errors
+var (
+	ErrAuthBanned  = errors.New("socks: banned for too many authentication failures")
+	ErrAuthBackoff = errors.New("socks: authentication retried too soon")
+)
+
+const (
+	defaultLockoutMaxFailures = 5
+	defaultLockoutWindow      = 15 * time.Minute
+	defaultLockoutBackoff     = time.Second
+	defaultLockoutMaxBackoff  = time.Minute
+	defaultLockoutBanTime     = time.Hour
+)
+
+// BanEvent is emitted when the authentication failures of a source IP or of
+// a username ban it.
+type BanEvent struct {
+	// IP is the source banned, nil if it is Username
+	IP       net.IP
+	Username string
+	Failures int
+	Until    time.Time
+}
+
+// lockout tracks the failed authentications by source IP and by username,
+// the next attempt of a key is refused for a backoff growing exponentially
+// with its failures, until enough of them ban it.
+type lockout struct {
+	maxFailures int
+	window      time.Duration
+	backoff     time.Duration
+	maxBackoff  time.Duration
+	banTime     time.Duration
+	file        string
+	now         func() time.Time
+	// onBan is called outside the lock for every new ban
+	onBan func(BanEvent)
+	logf  func(format string, args ...interface{})
+
+	mu        sync.Mutex
+	failures  map[string]*lockoutEntry
+	lastSweep time.Time
+	// bans are the ends of the bans by key, zero for the permanent bans
+	bans map[string]time.Time
+}
+
+type lockoutEntry struct {
+	failures int
+	first    time.Time
+	next     time.Time
+}
+
+// newLockout creates the lockout of cfg and loads its ban file, nil is
+// returned if it is not enabled.
+func newLockout(cfg *config.Lockout) (*lockout, error) {
+	if cfg == nil || !cfg.Enable {
+		return nil, nil
+	}
+	ms := func(v int, def time.Duration) time.Duration {
+		if v == 0 {
+			return def
+		}
+		return time.Duration(v) * time.Millisecond
+	}
+	l := &lockout{
+		maxFailures: cfg.MaxFailures,
+		window:      ms(cfg.Window, defaultLockoutWindow),
+		backoff:     ms(cfg.Backoff, defaultLockoutBackoff),
+		maxBackoff:  ms(cfg.MaxBackoff, defaultLockoutMaxBackoff),
+		banTime:     ms(cfg.BanTime, defaultLockoutBanTime),
+		file:        cfg.BanFile,
+		now:         time.Now,
+		failures:    make(map[string]*lockoutEntry),
+		bans:        make(map[string]time.Time),
+	}
+	if l.maxFailures == 0 {
+		l.maxFailures = defaultLockoutMaxFailures
+	}
+	if l.file != "" {
+		if err := l.load(); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+func ipKey(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	return "ip:" + ip.String()
+}
+
+func userKey(user string) string {
+	return "user:" + user
+}
+
+// allow checks whether an authentication may be attempted by the keys.
+func (l *lockout) allow(keys ...string) error {
+	if l == nil {
+		return nil
+	}
+	now := l.now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, key := range keys {
+		if key == "" {
+			continue
+		}
+		if until, ok := l.bans[key]; ok {
+			if until.IsZero() || now.Before(until) {
+				return ErrAuthBanned
+			}
+			delete(l.bans, key)
+		}
+		if e, ok := l.failures[key]; ok && now.Before(e.next) {
+			return ErrAuthBackoff
+		}
+	}
+	return nil
+}
+
+// fail counts a failed authentication of the keys, the keys already banned
+// or backing off are not counted again.
+func (l *lockout) fail(keys ...string) {
+	if l == nil {
+		return
+	}
+	now := l.now()
+	var events []BanEvent
+	l.mu.Lock()
+	l.sweep(now)
+	for _, key := range keys {
+		if key == "" {
+			continue
+		}
+		if until, ok := l.bans[key]; ok && (until.IsZero() || now.Before(until)) {
+			continue
+		}
+		e, ok := l.failures[key]
+		if ok && now.Before(e.next) {
+			continue
+		}
+		if !ok || now.Sub(e.first) > l.window {
+			e = &lockoutEntry{first: now}
+			l.failures[key] = e
+		}
+		e.failures++
+		if e.failures >= l.maxFailures {
+			delete(l.failures, key)
+			until := now.Add(l.banTime)
+			l.bans[key] = until
+			events = append(events, newBanEvent(key, e.failures, until))
+			continue
+		}
+		backoff := l.backoff
+		for i := 1; i < e.failures && backoff < l.maxBackoff; i++ {
+			backoff *= 2
+		}
+		if backoff > l.maxBackoff {
+			backoff = l.maxBackoff
+		}
+		e.next = now.Add(backoff)
+	}
+	var err error
+	if len(events) > 0 && l.file != "" {
+		err = l.save(now)
+	}
+	l.mu.Unlock()
+
+	if err != nil && l.logf != nil {
+		l.logf("socks: save bans: %v", err)
+	}
+	for _, ev := range events {
+		if l.onBan != nil {
+			l.onBan(ev)
+		}
+	}
+}
+
+// succeed forgets the failures of the key.
+func (l *lockout) succeed(key string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	delete(l.failures, key)
+	l.mu.Unlock()
+}
+
+// sweep removes the failures out of the window, at most once per window.
+func (l *lockout) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < l.window {
+		return
+	}
+	l.lastSweep = now
+	for key, e := range l.failures {
+		if now.Sub(e.first) > l.window && !now.Before(e.next) {
+			delete(l.failures, key)
+		}
+	}
+}
+
+func newBanEvent(key string, failures int, until time.Time) BanEvent {
+	ev := BanEvent{Failures: failures, Until: until}
+	if strings.HasPrefix(key, "ip:") {
+		ev.IP = net.ParseIP(key[len("ip:"):])
+	} else {
+		ev.Username = strings.TrimPrefix(key, "user:")
+	}
+	return ev
+}
+
+// The ban file has a ban per line: "ip|user <RFC 3339 end|forever> <value>",
+// the value is quoted if it is not a plain word.
+const banForever = "forever"
+
+func (l *lockout) load() error {
+	f, err := os.Open(l.file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	now := l.now()
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 3)
+		if len(fields) != 3 || (fields[0] != "ip" && fields[0] != "user") {
+			return fmt.Errorf("socks: %s:%d: not a ban line", l.file, n)
+		}
+		var until time.Time
+		if fields[1] != banForever {
+			if until, err = time.Parse(time.RFC3339, fields[1]); err != nil {
+				return fmt.Errorf("socks: %s:%d: %v", l.file, n, err)
+			}
+			if !now.Before(until) {
+				continue
+			}
+		}
+		value := strings.TrimSpace(fields[2])
+		if strings.HasPrefix(value, `"`) {
+			if value, err = strconv.Unquote(value); err != nil {
+				return fmt.Errorf("socks: %s:%d: %v", l.file, n, err)
+			}
+		}
+		key := userKey(value)
+		if fields[0] == "ip" {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return fmt.Errorf("socks: %s:%d: %q is not an IP address", l.file, n, value)
+			}
+			key = ipKey(ip)
+		}
+		l.bans[key] = until
+	}
+	return scanner.Err()
+}
+
+// save writes the bans in effect to the ban file, the file is replaced at
+// once so it is never seen half written.
+func (l *lockout) save(now time.Time) error {
+	var b strings.Builder
+	b.WriteString("# gsocks bans, one per line: ip|user <RFC 3339 end|forever> <value>\n")
+	for key, until := range l.bans {
+		end := banForever
+		if !until.IsZero() {
+			if !now.Before(until) {
+				continue
+			}
+			end = until.UTC().Format(time.RFC3339)
+		}
+		kind, value := "user", strings.TrimPrefix(key, "user:")
+		if strings.HasPrefix(key, "ip:") {
+			kind, value = "ip", key[len("ip:"):]
+		}
+		if value == "" || strings.IndexFunc(value, func(r rune) bool {
+			return r <= ' ' || r == '"' || r == 0x7f || r >= 0x80
+		}) >= 0 {
+			value = strconv.Quote(value)
+		}
+		fmt.Fprintf(&b, "%s %s %s\n", kind, end, value)
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(l.file), filepath.Base(l.file)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.WriteString(b.String()); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), l.file)
+}
+
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	return nil
+}
+
+// checkLockout checks whether the client may attempt to authenticate.
+func (s *Session) checkLockout() error {
+	return s.srv.lockout.allow(ipKey(addrIP(s.RemoteAddr())))
+}
+
+// record records the result of the authentication of user by a client of
+// ip. The failures of the backends are not held against the client.
+func (l *lockout) record(ip net.IP, user string, ok bool, err error) {
+	if l == nil {
+		return
+	}
+	if ok {
+		l.succeed(userKey(user))
+		return
+	}
+	if err != nil && err != ErrAuthBanned && err != ErrAuthBackoff {
+		return
+	}
+	l.fail(ipKey(ip), userKey(user))
+}
+
+// banned logs a ban and emits its event.
+func (srv *Server) banned(ev BanEvent) {
+	who := "user " + ev.Username
+	if ev.IP != nil {
+		who = ev.IP.String()
+	}
+	srv.logf("socks: ban %s until %s after %d authentication failures", who, ev.Until.Format(time.RFC3339), ev.Failures)
+	if srv.OnBan != nil {
+		srv.OnBan(ev)
+	}
+}
@@ -0,0 +1,204 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/remones/gsocks/config"
+	"github.com/stretchr/testify/assert"
+)
+
+type lockoutClock struct {
+	t time.Time
+}
+
+func (c *lockoutClock) now() time.Time { return c.t }
+
+func (c *lockoutClock) add(d time.Duration) { c.t = c.t.Add(d) }
+
+func TestLockout(t *testing.T) {
+	l, err := newLockout(&config.Lockout{
+		Enable:      true,
+		MaxFailures: 4,
+		Backoff:     1000,
+		MaxBackoff:  3000,
+		BanTime:     60000,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	clock := &lockoutClock{t: time.Now()}
+	l.now = clock.now
+	var events []BanEvent
+	l.onBan = func(ev BanEvent) { events = append(events, ev) }
+
+	ip := ipKey(net.ParseIP("192.0.2.1"))
+	alice := userKey("alice")
+	assert.NoError(t, l.allow(ip, alice))
+
+	// the backoff doubles up to the max
+	for _, backoff := range []time.Duration{time.Second, 2 * time.Second, 3 * time.Second} {
+		l.fail(ip, alice)
+		assert.Equal(t, ErrAuthBackoff, l.allow(ip))
+		assert.Equal(t, ErrAuthBackoff, l.allow(alice))
+		// the attempts backing off are not counted
+		l.fail(ip, alice)
+		clock.add(backoff - time.Millisecond)
+		assert.Equal(t, ErrAuthBackoff, l.allow(ip, alice))
+		clock.add(time.Millisecond)
+		assert.NoError(t, l.allow(ip, alice))
+	}
+	// a success forgets the failures of the username, not of the IP
+	l.succeed(alice)
+	l.fail(ip, alice)
+	assert.Equal(t, ErrAuthBanned, l.allow(ip))
+	clock.add(time.Second)
+	assert.NoError(t, l.allow(alice))
+	if assert.Len(t, events, 1) {
+		assert.Equal(t, "192.0.2.1", events[0].IP.String())
+		assert.Equal(t, 4, events[0].Failures)
+		assert.Equal(t, clock.t.Add(59*time.Second), events[0].Until)
+	}
+
+	clock.add(59 * time.Second)
+	assert.NoError(t, l.allow(ip))
+
+	// the failures out of the window are forgotten
+	bob := userKey("bob")
+	for i := 0; i < 3; i++ {
+		l.fail(bob)
+		clock.add(6 * time.Minute)
+	}
+	l.fail(bob)
+	assert.Equal(t, ErrAuthBackoff, l.allow(bob))
+	assert.Len(t, events, 1)
+}
+
+func TestLockout_banFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gsocks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "bans")
+	content := "# added by hand\n" +
+		"ip forever 198.51.100.7\n" +
+		"user 2000-01-01T00:00:00Z expired\n"
+	if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.Lockout{Enable: true, MaxFailures: 1, BanFile: file}
+	l, err := newLockout(cfg)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, ErrAuthBanned, l.allow(ipKey(net.ParseIP("198.51.100.7"))))
+	assert.NoError(t, l.allow(userKey("expired")))
+
+	// the usernames can not break the lines of the file
+	l.fail(userKey("mallory\nip forever 192.0.2.1"), ipKey(net.ParseIP("2001:db8::1")))
+	b, err := ioutil.ReadFile(file)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, strings.Count(string(b), "\n"))
+
+	l, err = newLockout(cfg)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, ErrAuthBanned, l.allow(ipKey(net.ParseIP("198.51.100.7"))))
+	assert.Equal(t, ErrAuthBanned, l.allow(userKey("mallory\nip forever 192.0.2.1")))
+	assert.Equal(t, ErrAuthBanned, l.allow(ipKey(net.ParseIP("2001:db8::1"))))
+	assert.NoError(t, l.allow(ipKey(net.ParseIP("192.0.2.1"))))
+
+	if err := ioutil.WriteFile(file, []byte("ip forever host\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, err = newLockout(cfg)
+	assert.Error(t, err)
+}
+
+// remoteAddrConn is a net.Conn with a fixed remote address.
+type remoteAddrConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *remoteAddrConn) RemoteAddr() net.Addr { return c.remote }
+
+func TestSession_AuthenticateLockout(t *testing.T) {
+	cfg := config.NewConfig()
+	cfg.Auth.NoRequired = nil
+	cfg.Auth.UserPasswd = &config.UserPasswd{
+		Enable:  true,
+		Account: []config.Account{{Username: "si.li", Password: "1234"}},
+	}
+	cfg.Auth.Lockout = &config.Lockout{Enable: true, MaxFailures: 2}
+	srv, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.ErrorLog = log.New(ioutil.Discard, "", 0)
+	clock := &lockoutClock{t: time.Now()}
+	srv.lockout.now = clock.now
+	bans := make(chan BanEvent, 2)
+	srv.OnBan = func(ev BanEvent) { bans <- ev }
+
+	// authenticate replies the status of the password, or the method if
+	// the client is refused before
+	authenticate := func(password string) (reply []byte, ok bool, err error) {
+		server, client := net.Pipe()
+		defer client.Close()
+		s := srv.newSession(&remoteAddrConn{server, &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}}, Socks5Version)
+		defer s.Close()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			client.Write([]byte{1, byte(AuthUserPass)})
+			method := make([]byte, 2)
+			client.Read(method)
+			if method[1] != byte(AuthUserPass) {
+				reply = method
+				return
+			}
+			client.Write(append([]byte{1, 5, 's', 'i', '.', 'l', 'i', byte(len(password))}, password...))
+			status := make([]byte, 2)
+			client.Read(status)
+			reply = status
+		}()
+		ok, err = s.Authenticate()
+		<-done
+		return reply, ok, err
+	}
+
+	reply, ok, err := authenticate("4321")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, []byte{1, UserPassFailure}, reply)
+	reply, _, err = authenticate("1234")
+	assert.Equal(t, ErrAuthBackoff, err)
+	assert.Equal(t, []byte{5, byte(AuthNoAccetable)}, reply)
+
+	clock.add(time.Second)
+	_, ok, err = authenticate("4321")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	// both the IP and the username are banned
+	if assert.Len(t, bans, 2) {
+		for i := 0; i < 2; i++ {
+			ev := <-bans
+			assert.True(t, ev.Username == "si.li" || ev.IP.String() == "192.0.2.1")
+		}
+	}
+
+	clock.add(time.Hour)
+	_, ok, err = authenticate("1234")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+}
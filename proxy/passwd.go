@@ -0,0 +1,200 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// errors
+var (
+	ErrUnknownHash = errors.New("socks: unknown password hash")
+)
+
+// The password hash algorithms of HashPassword.
+const (
+	HashBcrypt   = "bcrypt"
+	HashArgon2id = "argon2id"
+	HashSHA256   = "sha256-crypt"
+	HashSHA512   = "sha512-crypt"
+)
+
+// argon2id parameters of HashPassword, as recommended by RFC 9106 for
+// memory-constrained environments.
+const (
+	argon2Time    = 3
+	argon2Memory  = 64 * 1024
+	argon2Threads = 4
+	argon2KeyLen  = 32
+	// argon2MaxMemory in KiB bounds the memory a stored hash may require
+	argon2MaxMemory = 1024 * 1024
+)
+
+// HashPassword hashes password with the algorithm, one of the Hash*
+// constants, in the format of crypt(3).
+func HashPassword(algorithm, password string) (string, error) {
+	switch algorithm {
+	case HashBcrypt:
+		b, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		return string(b), err
+	case HashArgon2id:
+		salt := make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return "", err
+		}
+		key := argon2.IDKey([]byte(password), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version,
+			argon2Memory, argon2Time, argon2Threads,
+			base64.RawStdEncoding.EncodeToString(salt),
+			base64.RawStdEncoding.EncodeToString(key)), nil
+	case HashSHA256, HashSHA512:
+		salt := make([]byte, shaCryptSaltLen)
+		if _, err := rand.Read(salt); err != nil {
+			return "", err
+		}
+		for i := range salt {
+			salt[i] = cryptAlphabet[int(salt[i])%len(cryptAlphabet)]
+		}
+		sc := sha256Crypt
+		if algorithm == HashSHA512 {
+			sc = sha512Crypt
+		}
+		return sc.crypt([]byte(password), sc.prefix+string(salt))
+	}
+	return "", fmt.Errorf("socks: unknown hash algorithm %q", algorithm)
+}
+
+// hashPrefixes are the prefixes of the hashes supported, and
+// unsupportedHashPrefixes of MD5-crypt, Apache MD5 and SHA-1 of htpasswd.
+// The other passwords are plaintext.
+var (
+	hashPrefixes            = []string{"$2a$", "$2b$", "$2y$", "$argon2id$", "$argon2i$", "$5$", "$6$"}
+	unsupportedHashPrefixes = []string{"$1$", "$apr1$", "{SHA}"}
+)
+
+func isPasswordHash(s string) bool {
+	return hasAnyPrefix(s, hashPrefixes) || isUnsupportedHash(s)
+}
+
+func isUnsupportedHash(s string) bool {
+	return hasAnyPrefix(s, unsupportedHashPrefixes)
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// VerifyPassword reports whether password matches hashed, a bcrypt,
+// argon2 or SHA-crypt hash, or a plaintext password. The comparison takes
+// a constant time.
+func VerifyPassword(hashed, password string) (bool, error) {
+	switch {
+	case strings.HasPrefix(hashed, "$2a$"), strings.HasPrefix(hashed, "$2b$"), strings.HasPrefix(hashed, "$2y$"):
+		err := bcrypt.CompareHashAndPassword([]byte(hashed), []byte(password))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return false, nil
+		}
+		return err == nil, err
+	case strings.HasPrefix(hashed, "$argon2i"):
+		return verifyArgon2(hashed, password)
+	case strings.HasPrefix(hashed, sha256Crypt.prefix), strings.HasPrefix(hashed, sha512Crypt.prefix):
+		sc := sha256Crypt
+		if strings.HasPrefix(hashed, sha512Crypt.prefix) {
+			sc = sha512Crypt
+		}
+		computed, err := sc.crypt([]byte(password), hashed)
+		if err != nil {
+			return false, err
+		}
+		return subtle.ConstantTimeCompare([]byte(computed), []byte(hashed)) == 1, nil
+	case isPasswordHash(hashed):
+		return false, ErrUnknownHash
+	}
+	return subtle.ConstantTimeCompare([]byte(hashed), []byte(password)) == 1, nil
+}
+
+// verifyArgon2 verifies the PHC string of an argon2i or argon2id hash,
+// e.g. "$argon2id$v=19$m=65536,t=3,p=4$<salt>$<key>".
+func verifyArgon2(hashed, password string) (bool, error) {
+	parts := strings.Split(hashed, "$")
+	if len(parts) != 6 {
+		return false, ErrUnknownHash
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, ErrUnknownHash
+	}
+	var memory, time uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return false, ErrUnknownHash
+	}
+	// argon2 panics on the parameters out of its range
+	if time < 1 || threads < 1 || memory > argon2MaxMemory {
+		return false, ErrUnknownHash
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, ErrUnknownHash
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return false, ErrUnknownHash
+	}
+
+	var computed []byte
+	switch parts[1] {
+	case "argon2id":
+		computed = argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(key)))
+	case "argon2i":
+		computed = argon2.Key([]byte(password), salt, time, memory, threads, uint32(len(key)))
+	default:
+		return false, ErrUnknownHash
+	}
+	return subtle.ConstantTimeCompare(computed, key) == 1, nil
+}
+
+// loadHtpasswd reads the accounts of an htpasswd file, i.e. lines of
+// "username:hash", the blank lines and the lines starting with '#' are
+// skipped.
+func loadHtpasswd(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	accounts := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		i := strings.IndexByte(line, ':')
+		if i <= 0 {
+			return nil, fmt.Errorf("socks: %s:%d: not a username:hash line", path, n)
+		}
+		if isUnsupportedHash(line[i+1:]) {
+			return nil, fmt.Errorf("socks: %s:%d: unsupported hash", path, n)
+		}
+		accounts[line[:i]] = line[i+1:]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return accounts, nil
+}
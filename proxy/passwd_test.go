@@ -0,0 +1,134 @@
+package proxy
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/remones/gsocks/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSHACrypt(t *testing.T) {
+	tests := []struct {
+		scheme   *shaCryptScheme
+		password string
+		want     string
+	}{
+		{sha256Crypt, "Hello world!", "$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5"},
+		{sha512Crypt, "Hello world!", "$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1"},
+		{sha256Crypt, "Hello world!", "$5$rounds=10000$saltstringsaltst$3xv.VbSHBb41AL9AvLeujZkZRBAwqFMz2.opqey6IcA"},
+		{sha256Crypt, "a very much longer text to encrypt.  This one even stretches over morethan one line.",
+			"$5$rounds=1400$anotherlongsalts$Rx.j8H.h8HjEDGomFU8bDkXm3XIUnzyxf12oP84Bnq1"},
+		{sha512Crypt, "we have a short salt string but not a short password",
+			"$6$rounds=77777$short$WuQyW2YR.hBNpjjRhpYD/ifIw05xdfeEyQoMxIXbkvr0gge1a1x3yRULJ5CCaUeOxFmtlcGZelFl5CxtgfiAc0"},
+	}
+	for _, tt := range tests {
+		got, err := tt.scheme.crypt([]byte(tt.password), tt.want)
+		assert.NoError(t, err)
+		assert.Equal(t, tt.want, got)
+	}
+
+	// the salt is truncated to 16 characters
+	got, err := sha512Crypt.crypt([]byte("Hello world!"), "$6$rounds=10000$saltstringsaltstring")
+	assert.NoError(t, err)
+	assert.Equal(t, "$6$rounds=10000$saltstringsaltst$OW1/O6BYHV6BcXZu8QVeXbDWra3Oeqh0sbHbbMCVNSnCM/UrjmM0Dp8vOuZeHBy/YTBmSK6H9qs/y3RnOaw5v.", got)
+}
+
+func TestVerifyPassword(t *testing.T) {
+	for _, algorithm := range []string{HashBcrypt, HashArgon2id, HashSHA256, HashSHA512} {
+		hashed, err := HashPassword(algorithm, "s3cret")
+		if !assert.NoError(t, err, algorithm) {
+			continue
+		}
+		assert.True(t, isPasswordHash(hashed), algorithm)
+		ok, err := VerifyPassword(hashed, "s3cret")
+		assert.NoError(t, err, algorithm)
+		assert.True(t, ok, algorithm)
+		ok, err = VerifyPassword(hashed, "S3cret")
+		assert.NoError(t, err, algorithm)
+		assert.False(t, ok, algorithm)
+	}
+
+	tests := []struct {
+		hashed   string
+		password string
+		want     bool
+		wantErr  error
+	}{
+		{"s3cret", "s3cret", true, nil},
+		{"s3cret", "s3cre", false, nil},
+		// a hash which is not supported never matches, not even itself
+		{"$apr1$salt$hash", "$apr1$salt$hash", false, ErrUnknownHash},
+		{"$argon2id$v=19$m=65536$salt$key", "s3cret", false, ErrUnknownHash},
+		{"$argon2id$v=19$m=65536,t=0,p=4$c2FsdHNhbHQ$a2V5", "s3cret", false, ErrUnknownHash},
+		{"$argon2id$v=19$m=65536,t=3,p=0$c2FsdHNhbHQ$a2V5", "s3cret", false, ErrUnknownHash},
+		{"$argon2i$v=19$m=4294967295,t=3,p=4$c2FsdHNhbHQ$a2V5", "s3cret", false, ErrUnknownHash},
+	}
+	for _, tt := range tests {
+		ok, err := VerifyPassword(tt.hashed, tt.password)
+		assert.Equal(t, tt.wantErr, err, tt.hashed)
+		assert.Equal(t, tt.want, ok, tt.hashed)
+	}
+}
+
+func TestUserPassAuthenticator_htpasswd(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gsocks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "htpasswd")
+	content := "# gsocks accounts\n\n" +
+		"alice:$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5\n" +
+		"bob:bob\n"
+	if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	auths, err := makeAuthsWithConfig(&config.Auth{
+		UserPasswd: &config.UserPasswd{
+			Enable: true,
+			File:   file,
+			// the accounts of the config take precedence
+			Account: []config.Account{{Username: "bob", Password: "b0b"}},
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	auth := auths[AuthUserPass].(*UserPassAuthenticator)
+	assertVerifyAccount(t, auth, "alice", "Hello world!", UserPassSuccess)
+	assertVerifyAccount(t, auth, "alice", "hello world!", UserPassFailure)
+	assertVerifyAccount(t, auth, "bob", "b0b", UserPassSuccess)
+	assertVerifyAccount(t, auth, "bob", "bob", UserPassFailure)
+	assertVerifyAccount(t, auth, "carol", "", UserPassFailure)
+
+	if err := ioutil.WriteFile(file, []byte("alice\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, err = loadHtpasswd(file)
+	assert.EqualError(t, err, "socks: "+file+":1: not a username:hash line")
+
+	if err := ioutil.WriteFile(file, []byte("alice:$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5\nbob:$apr1$salt$hash\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, err = loadHtpasswd(file)
+	assert.EqualError(t, err, "socks: "+file+":2: unsupported hash")
+}
+
+func TestStaticStore_unknownUser(t *testing.T) {
+	hashed, err := HashPassword(HashBcrypt, "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := NewStaticStore(map[string]string{"alice": hashed})
+	start := time.Now()
+	_, err = store.Verify(context.Background(), "bob", "s3cret")
+	assert.Equal(t, ErrUnknownUser, err)
+	// a hash is verified for the unknown users too, it takes a few ms
+	assert.Greater(t, int64(time.Since(start)), int64(time.Millisecond))
+}
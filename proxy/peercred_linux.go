@@ -0,0 +1,26 @@
+package proxy
+
+import (
+	"net"
+	"syscall"
+)
+
+// readPeerCred reads the credentials of the peer of conn by SO_PEERCRED.
+func readPeerCred(conn *net.UnixConn) (*peerCred, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var ucred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		ucred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if credErr != nil {
+		return nil, credErr
+	}
+	return &peerCred{uid: ucred.Uid, gid: ucred.Gid, pid: ucred.Pid}, nil
+}
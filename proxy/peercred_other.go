@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package proxy
+
+import (
+	"errors"
+	"net"
+)
+
+// readPeerCred is only supported on Linux.
+func readPeerCred(conn *net.UnixConn) (*peerCred, error) {
+	return nil, errors.New("socks: peer credentials are not supported on this platform")
+}
@@ -0,0 +1,168 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/remones/gsocks/config"
+)
+
+// errors
+var (
+	ErrCommandNotAllowed = errors.New("socks: command not allowed by the policy")
+	ErrUserSessionLimit  = errors.New("socks: too many sessions of the user")
+)
+
+// policy restricts the sessions of its users, the sessions of the users
+// without policy are only restricted by the server.
+type policy struct {
+	name string
+	// commands are the commands allowed, all of them if nil
+	commands map[uint8]bool
+	// rules are checked before the ACL of the server
+	rules []*aclRule
+	// outbound replaces the default outbound if not nil
+	outbound    *outbound
+	maxSessions int
+
+	mu       sync.Mutex
+	sessions map[string]int
+}
+
+// newPolicies creates the policies of cfg by name, by user and by group.
+func newPolicies(cfg *config.Config, outbounds map[string]*outbound) (byName, users, groups map[string]*policy, err error) {
+	if len(cfg.Policy) == 0 {
+		return nil, nil, nil, nil
+	}
+	byName = make(map[string]*policy)
+	users = make(map[string]*policy)
+	groups = make(map[string]*policy)
+	for _, pc := range cfg.Policy {
+		p := &policy{
+			name:        pc.Name,
+			maxSessions: pc.MaxSessions,
+			sessions:    make(map[string]int),
+		}
+		if len(pc.Commands) > 0 {
+			p.commands = make(map[uint8]bool)
+			for _, name := range pc.Commands {
+				cmd, ok := aclCommands[name]
+				if !ok {
+					return nil, nil, nil, fmt.Errorf("socks: unknown command %q of policy %s", name, pc.Name)
+				}
+				p.commands[cmd] = true
+			}
+		}
+		rules, err := newACLRules(pc.Rule)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("socks: policy %s: %v", pc.Name, err)
+		}
+		p.rules = rules
+		if pc.Outbound != "" {
+			ob, ok := outbounds[pc.Outbound]
+			if !ok {
+				return nil, nil, nil, fmt.Errorf("socks: unknown outbound %q of policy %s", pc.Outbound, pc.Name)
+			}
+			p.outbound = ob
+		}
+		byName[pc.Name] = p
+		for _, user := range pc.Users {
+			users[user] = p
+		}
+		for _, group := range pc.Groups {
+			groups[group] = p
+		}
+	}
+	if cfg.Auth.UserPasswd != nil {
+		for _, account := range cfg.Auth.UserPasswd.Account {
+			if account.Policy == "" {
+				continue
+			}
+			p, ok := byName[account.Policy]
+			if !ok {
+				return nil, nil, nil, fmt.Errorf("socks: unknown policy %q of account %s", account.Policy, account.Username)
+			}
+			users[account.Username] = p
+		}
+	}
+	return byName, users, groups, nil
+}
+
+func (p *policy) allowCommand(cmd uint8) bool {
+	return p.commands == nil || p.commands[cmd]
+}
+
+// acquire counts a session of user, ok is false if the user has too many.
+// release must be called when the session ends.
+func (p *policy) acquire(user string) (release func(), ok bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.maxSessions > 0 && p.sessions[user] >= p.maxSessions {
+		return nil, false
+	}
+	p.sessions[user]++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			if p.sessions[user]--; p.sessions[user] <= 0 {
+				delete(p.sessions, user)
+			}
+		})
+	}, true
+}
+
+// policyOf returns the policy of the user of id, or else of its first group
+// having one.
+func (srv *Server) policyOf(id *Identity) *policy {
+	if id == nil {
+		return nil
+	}
+	if p, ok := srv.policies[id.Username]; ok && id.Username != "" {
+		return p
+	}
+	for _, group := range id.Groups {
+		if p, ok := srv.groupPolicies[group]; ok {
+			return p
+		}
+	}
+	return nil
+}
+
+func (s *Session) releaseUser() {
+	if s.release != nil {
+		s.release()
+		s.release = nil
+	}
+}
+
+// authorize checks the request against the policy of the user and the ACL
+// of the server, a request denied is replied ReplyNotAllowed.
+func (s *Session) authorize(req *Request) error {
+	switch req.Command {
+	case CmdConnect, CmdBind, CmdUDP:
+	default:
+		return nil
+	}
+	if p := s.policy; p != nil {
+		if !p.allowCommand(req.Command) {
+			if err := s.sendReply(ReplyNotAllowed, nil); err != nil {
+				return ErrSendReplyFailed
+			}
+			return ErrCommandNotAllowed
+		}
+		if s.release == nil {
+			release, ok := p.acquire(s.username())
+			if !ok {
+				if err := s.sendReply(ReplyNotAllowed, nil); err != nil {
+					return ErrSendReplyFailed
+				}
+				return ErrUserSessionLimit
+			}
+			s.release = release
+		}
+	}
+	return s.checkRequestACL(req)
+}
@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/remones/gsocks/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func newPolicyTestServer(t *testing.T) *Server {
+	cfg := config.NewConfig()
+	cfg.Auth.UserPasswd = &config.UserPasswd{
+		Enable: true,
+		Account: []config.Account{
+			{Username: "alice", Password: "a", Policy: "staff"},
+			{Username: "bob", Password: "b"},
+		},
+	}
+	cfg.ACL = config.ACL{DenyPrivate: true}
+	cfg.Outbound = []config.Outbound{{Name: "lan", Type: "direct", Source: "127.0.0.1"}}
+	cfg.Policy = []config.Policy{
+		{
+			Name:        "staff",
+			Users:       []string{"carol@EXAMPLE.COM"},
+			Commands:    []string{"connect"},
+			Rule:        []config.ACLRule{{Action: "allow", Networks: []string{"10.0.0.0/8"}}},
+			Outbound:    "lan",
+			MaxSessions: 1,
+		},
+	}
+	srv, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return srv
+}
+
+func TestNewPolicies(t *testing.T) {
+	srv := newPolicyTestServer(t)
+	assert.Len(t, srv.policies, 2)
+	assert.Equal(t, "staff", srv.policies["alice"].name)
+	assert.Same(t, srv.policies["alice"], srv.policies["carol@EXAMPLE.COM"])
+	assert.Nil(t, srv.policies["bob"])
+}
+
+func TestSession_authorize(t *testing.T) {
+	srv := newPolicyTestServer(t)
+	newSession := func(user string) (*Session, net.Conn) {
+		server, client := net.Pipe()
+		s := srv.newSession(server, Socks5Version)
+		s.setIdentity(&Identity{Username: user, Method: AuthUserPass})
+		return s, client
+	}
+	request := func(cmd uint8, addr string) *Request {
+		dest, err := ParseAddrSpec(addr)
+		assert.NoError(t, err)
+		return &Request{Version: Socks5Version, Command: cmd, DestAddr: dest}
+	}
+	// authorize replies to the denied requests
+	denied := func(s *Session, client net.Conn, req *Request) error {
+		errCh := make(chan error, 1)
+		go func() { errCh <- s.authorize(req) }()
+		rep, err := NewReply(client)
+		assert.NoError(t, err)
+		assert.Equal(t, ReplyNotAllowed, rep.Code)
+		return <-errCh
+	}
+
+	alice, aliceClient := newSession("alice")
+	defer aliceClient.Close()
+	defer alice.Close()
+	assert.Equal(t, ErrCommandNotAllowed, denied(alice, aliceClient, request(CmdBind, "1.2.3.4:80")))
+	// the private network is allowed by the rules of the policy
+	assert.NoError(t, alice.authorize(request(CmdConnect, "10.1.2.3:80")))
+	assert.Equal(t, aclAllow, alice.checkRules(CmdConnect, nil, net.ParseIP("10.1.2.3")))
+	assert.Equal(t, aclDeny, alice.checkRules(CmdConnect, nil, net.ParseIP("192.168.1.1")))
+	assert.Equal(t, "lan", alice.outbound(context.Background(), request(CmdConnect, "1.2.3.4:80").DestAddr).name)
+
+	// alice is over the max sessions until the first session is closed
+	again, againClient := newSession("alice")
+	assert.Equal(t, ErrUserSessionLimit, denied(again, againClient, request(CmdConnect, "1.2.3.4:80")))
+	again.Close()
+	againClient.Close()
+	alice.Close()
+	again, againClient = newSession("alice")
+	defer againClient.Close()
+	defer again.Close()
+	assert.NoError(t, again.authorize(request(CmdConnect, "1.2.3.4:80")))
+
+	// bob has no policy
+	bob, bobClient := newSession("bob")
+	defer bobClient.Close()
+	defer bob.Close()
+	assert.NoError(t, bob.authorize(request(CmdBind, "1.2.3.4:80")))
+	assert.Equal(t, aclDeny, bob.checkRules(CmdConnect, nil, net.ParseIP("10.1.2.3")))
+	assert.Equal(t, "default", bob.outbound(context.Background(), request(CmdConnect, "1.2.3.4:80").DestAddr).name)
+}
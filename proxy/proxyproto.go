@@ -0,0 +1,386 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/remones/gsocks/config"
+)
+
+// ErrProxyHeader is returned for a malformed PROXY protocol header
+var ErrProxyHeader = errors.New("socks: invalid PROXY protocol header")
+
+const (
+	// proxyV1MaxLen is the max length of a v1 header, CRLF included
+	proxyV1MaxLen = 107
+
+	proxyV2CmdLocal = 0x0
+	proxyV2CmdProxy = 0x1
+
+	proxyV2FamInet  = 0x1
+	proxyV2FamInet6 = 0x2
+	proxyV2Stream   = 0x1
+
+	defaultProxyHeaderTimeout = 5 * time.Second
+)
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// readProxyHeader reads a PROXY protocol v1 or v2 header, and nothing past
+// it. src and dst are nil if the header does not carry the addresses of a
+// TCP client, e.g. for the health checks of the balancer.
+func readProxyHeader(r io.Reader) (src, dst net.Addr, err error) {
+	b := make([]byte, 16)
+	if _, err := io.ReadFull(r, b[:6]); err != nil {
+		return nil, nil, err
+	}
+	if string(b[:6]) == "PROXY " {
+		return readProxyV1(r)
+	}
+	if !bytes.Equal(b[:6], proxyV2Signature[:6]) {
+		return nil, nil, ErrProxyHeader
+	}
+	if _, err := io.ReadFull(r, b[6:]); err != nil {
+		return nil, nil, err
+	}
+	if !bytes.Equal(b[:12], proxyV2Signature) {
+		return nil, nil, ErrProxyHeader
+	}
+	return readProxyV2(r, b[12:])
+}
+
+// readProxyV1 reads the rest of a v1 header, e.g.
+// "TCP4 192.0.2.1 198.51.100.1 56324 1080\r\n".
+func readProxyV1(r io.Reader) (src, dst net.Addr, err error) {
+	line := make([]byte, 0, proxyV1MaxLen)
+	b := make([]byte, 1)
+	for len(line) < proxyV1MaxLen-len("PROXY ") {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b[0])
+		if b[0] == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, ErrProxyHeader
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	switch fields[0] {
+	case "UNKNOWN":
+		return nil, nil, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, nil, ErrProxyHeader
+	}
+	if len(fields) != 5 {
+		return nil, nil, ErrProxyHeader
+	}
+	srcAddr, err := parseProxyV1Addr(fields[1], fields[3])
+	if err != nil {
+		return nil, nil, err
+	}
+	dstAddr, err := parseProxyV1Addr(fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	return srcAddr, dstAddr, nil
+}
+
+func parseProxyV1Addr(host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	p, err := strconv.ParseUint(port, 10, 16)
+	if ip == nil || err != nil {
+		return nil, ErrProxyHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+// readProxyV2 reads the rest of a v2 header of the 4 bytes following the
+// signature, the TLVs are skipped.
+func readProxyV2(r io.Reader, b []byte) (src, dst net.Addr, err error) {
+	if b[0]>>4 != 2 {
+		return nil, nil, ErrProxyHeader
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(b[2:4]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, nil, err
+	}
+	switch b[0] & 0xf {
+	case proxyV2CmdLocal:
+		return nil, nil, nil
+	case proxyV2CmdProxy:
+	default:
+		return nil, nil, ErrProxyHeader
+	}
+	if b[1]&0xf != proxyV2Stream {
+		return nil, nil, nil
+	}
+	var ipLen int
+	switch b[1] >> 4 {
+	case proxyV2FamInet:
+		ipLen = net.IPv4len
+	case proxyV2FamInet6:
+		ipLen = net.IPv6len
+	default:
+		return nil, nil, nil
+	}
+	if len(payload) < 2*ipLen+4 {
+		return nil, nil, ErrProxyHeader
+	}
+	ports := payload[2*ipLen:]
+	src = &net.TCPAddr{
+		IP:   net.IP(payload[:ipLen]),
+		Port: int(binary.BigEndian.Uint16(ports[0:2])),
+	}
+	dst = &net.TCPAddr{
+		IP:   net.IP(payload[ipLen : 2*ipLen]),
+		Port: int(binary.BigEndian.Uint16(ports[2:4])),
+	}
+	return src, dst, nil
+}
+
+// proxyTLV is a type-length-value of a v2 header
+type proxyTLV struct {
+	typ   byte
+	value []byte
+}
+
+// proxyHeader builds a PROXY protocol header of version 1 or 2 of a client
+// at src connected to dst. The addresses are unknown unless both are TCP
+// addresses, the TLVs are only sent by v2.
+func proxyHeader(version int, src, dst net.Addr, tlvs []proxyTLV) []byte {
+	var srcIP, dstIP net.IP
+	var srcPort, dstPort int
+	if s, ok := src.(*net.TCPAddr); ok {
+		if d, ok := dst.(*net.TCPAddr); ok {
+			srcIP, srcPort, dstIP, dstPort = s.IP, s.Port, d.IP, d.Port
+		}
+	}
+	// both addresses are of the same family, IPv4 is mapped to IPv6 if
+	// they differ.
+	inet4 := srcIP.To4() != nil && dstIP.To4() != nil
+	if inet4 {
+		srcIP, dstIP = srcIP.To4(), dstIP.To4()
+	} else if srcIP != nil && dstIP != nil {
+		srcIP, dstIP = srcIP.To16(), dstIP.To16()
+	}
+
+	if version == 1 {
+		if srcIP == nil || dstIP == nil {
+			return []byte("PROXY UNKNOWN\r\n")
+		}
+		if inet4 {
+			return []byte(fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n", srcIP, dstIP, srcPort, dstPort))
+		}
+		return []byte(fmt.Sprintf("PROXY TCP6 %s %s %d %d\r\n", proxyV1IPv6(srcIP), proxyV1IPv6(dstIP), srcPort, dstPort))
+	}
+
+	var payload []byte
+	fam := byte(0x00)
+	if srcIP != nil && dstIP != nil {
+		fam = proxyV2FamInet6<<4 | proxyV2Stream
+		if inet4 {
+			fam = proxyV2FamInet<<4 | proxyV2Stream
+		}
+		payload = append(payload, srcIP...)
+		payload = append(payload, dstIP...)
+		payload = append(payload, byte(srcPort>>8), byte(srcPort), byte(dstPort>>8), byte(dstPort))
+	}
+	for _, tlv := range tlvs {
+		payload = append(payload, tlv.typ, byte(len(tlv.value)>>8), byte(len(tlv.value)))
+		payload = append(payload, tlv.value...)
+	}
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, 0x20|proxyV2CmdProxy, fam, byte(len(payload)>>8), byte(len(payload)))
+	return append(header, payload...)
+}
+
+// proxyV1IPv6 formats ip as an IPv6 address, which the IPv4-mapped
+// addresses are not by net.IP.
+func proxyV1IPv6(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return "::ffff:" + ip4.String()
+	}
+	return ip.String()
+}
+
+// proxyProtocol reads the address of the clients of the trusted load
+// balancers from their PROXY protocol header.
+type proxyProtocol struct {
+	trusted []*net.IPNet
+	timeout time.Duration
+}
+
+// newProxyProtocol creates the PROXY protocol of cfg, nil if it is not
+// enabled.
+func newProxyProtocol(cfg *config.ProxyProtocol) (*proxyProtocol, error) {
+	if cfg == nil || !cfg.Enable {
+		return nil, nil
+	}
+	trusted, err := parseCIDRs(cfg.Trusted)
+	if err != nil {
+		return nil, fmt.Errorf("socks: proxy protocol trusted: %v", err)
+	}
+	pp := &proxyProtocol{trusted: trusted, timeout: defaultProxyHeaderTimeout}
+	if cfg.Timeout > 0 {
+		pp.timeout = time.Duration(cfg.Timeout) * time.Millisecond
+	}
+	return pp, nil
+}
+
+// listener wraps ln, its connections of the trusted balancers have the
+// address of their header as their remote address.
+func (pp *proxyProtocol) listener(ln net.Listener, logf func(format string, args ...interface{})) net.Listener {
+	if pp == nil {
+		return ln
+	}
+	l := &proxyProtoListener{
+		Listener: ln,
+		pp:       pp,
+		logf:     logf,
+		conns:    make(chan net.Conn),
+		errc:     make(chan error),
+		done:     make(chan struct{}),
+	}
+	go l.serve()
+	return l
+}
+
+// proxyProtoListener reads the headers aside of Accept, so a balancer slow to
+// send one does not hold the other clients.
+type proxyProtoListener struct {
+	net.Listener
+	pp    *proxyProtocol
+	logf  func(format string, args ...interface{})
+	conns chan net.Conn
+	errc  chan error
+	done  chan struct{}
+	once  sync.Once
+	// reading are the connections whose header is being read
+	mu      sync.Mutex
+	reading map[net.Conn]struct{}
+}
+
+func (l *proxyProtoListener) serve() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				select {
+				case l.errc <- err:
+					continue
+				case <-l.done:
+					return
+				}
+			}
+			// every next Accept fails with err
+			for {
+				select {
+				case l.errc <- err:
+				case <-l.done:
+					return
+				}
+			}
+		}
+		if !containsIP(l.pp.trusted, addrIP(conn.RemoteAddr())) {
+			l.deliver(conn)
+			continue
+		}
+		go l.readHeader(conn)
+	}
+}
+
+func (l *proxyProtoListener) readHeader(conn net.Conn) {
+	if !l.trackReading(conn, true) {
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Now().Add(l.pp.timeout))
+	src, _, err := readProxyHeader(conn)
+	conn.SetReadDeadline(time.Time{})
+	l.trackReading(conn, false)
+	if err != nil {
+		l.logf("socks: proxy protocol %s: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	if src != nil {
+		conn = &proxyProtoConn{Conn: conn, remote: src}
+	}
+	l.deliver(conn)
+}
+
+func (l *proxyProtoListener) deliver(conn net.Conn) {
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+// Accept returns the next connection whose header has been read.
+func (l *proxyProtoListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case err := <-l.errc:
+		return nil, err
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// trackReading adds or removes a connection whose header is being read, it
+// is not added once the listener is closed.
+func (l *proxyProtoListener) trackReading(conn net.Conn, add bool) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !add {
+		delete(l.reading, conn)
+		return true
+	}
+	select {
+	case <-l.done:
+		return false
+	default:
+	}
+	if l.reading == nil {
+		l.reading = make(map[net.Conn]struct{})
+	}
+	l.reading[conn] = struct{}{}
+	return true
+}
+
+// Close closes the listener, the connections whose header is being read are
+// closed.
+func (l *proxyProtoListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	l.mu.Lock()
+	for conn := range l.reading {
+		conn.Close()
+	}
+	l.mu.Unlock()
+	return l.Listener.Close()
+}
+
+// proxyProtoConn is a connection of a balancer, of the client of its header.
+// The local address stays the one of the server, the BIND and UDP ASSOCIATE
+// replies are addresses of the server.
+type proxyProtoConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	return c.remote
+}
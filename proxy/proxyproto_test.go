@@ -0,0 +1,259 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/remones/gsocks/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadProxyHeader(t *testing.T) {
+	v2 := func(cmd, fam byte, payload ...byte) []byte {
+		b := append([]byte{}, proxyV2Signature...)
+		b = append(b, 0x20|cmd, fam, 0, byte(len(payload)))
+		return append(b, payload...)
+	}
+	tests := []struct {
+		name     string
+		header   []byte
+		src, dst string
+		wantErr  bool
+	}{
+		{"v1 tcp4", []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 1080\r\n"), "192.0.2.1:56324", "198.51.100.1:1080", false},
+		{"v1 tcp6", []byte("PROXY TCP6 2001:db8::1 2001:db8::2 4000 1080\r\n"), "[2001:db8::1]:4000", "[2001:db8::2]:1080", false},
+		{"v1 unknown", []byte("PROXY UNKNOWN\r\n"), "", "", false},
+		{"v1 bad port", []byte("PROXY TCP4 192.0.2.1 198.51.100.1 70000 1080\r\n"), "", "", true},
+		{"v1 no crlf", []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 1080\n"), "", "", true},
+		{"v2 tcp4", v2(proxyV2CmdProxy, 0x11, 192, 0, 2, 1, 198, 51, 100, 1, 0xdc, 0x04, 0x04, 0x38), "192.0.2.1:56324", "198.51.100.1:1080", false},
+		{"v2 tlvs", v2(proxyV2CmdProxy, 0x11, 192, 0, 2, 1, 198, 51, 100, 1, 0xdc, 0x04, 0x04, 0x38, 0x04, 0, 1, 0), "192.0.2.1:56324", "198.51.100.1:1080", false},
+		{"v2 local", v2(proxyV2CmdLocal, 0x00), "", "", false},
+		{"v2 short", v2(proxyV2CmdProxy, 0x11, 192, 0, 2, 1), "", "", true},
+		{"not proxy", []byte{Socks5Version, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bytes.NewReader(append(tt.header, Socks5Version))
+			src, dst, err := readProxyHeader(r)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			if !assert.NoError(t, err) {
+				return
+			}
+			if tt.src == "" {
+				assert.Nil(t, src)
+				assert.Nil(t, dst)
+			} else {
+				assert.Equal(t, tt.src, src.String())
+				assert.Equal(t, tt.dst, dst.String())
+			}
+			// nothing past the header is read
+			assert.Equal(t, 1, r.Len())
+		})
+	}
+}
+
+func TestProxyProtoListener(t *testing.T) {
+	pp, err := newProxyProtocol(&config.ProxyProtocol{Enable: true, Trusted: []string{"127.0.0.1"}, Timeout: 200})
+	if err != nil {
+		t.Fatal(err)
+	}
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := log.New(ioutil.Discard, "", 0)
+	ln := pp.listener(inner, logger.Printf)
+	defer ln.Close()
+
+	// a balancer never sending its header does not hold the next ones
+	stalled, err := net.Dial("tcp", inner.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stalled.Close()
+	client, err := net.Dial("tcp", inner.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.Write([]byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 1080\r\n\x05"))
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	assert.Equal(t, "192.0.2.1:56324", conn.RemoteAddr().String())
+	assert.Equal(t, inner.Addr().String(), conn.LocalAddr().String())
+	b := make([]byte, 1)
+	if _, err := conn.Read(b); assert.NoError(t, err) {
+		assert.Equal(t, Socks5Version, b[0])
+	}
+
+	// the stalled balancer is dropped once its header times out
+	stalled.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = stalled.Read(b)
+	assert.Error(t, err)
+	if ne, ok := err.(net.Error); ok {
+		assert.False(t, ne.Timeout())
+	}
+
+	ln.Close()
+	_, err = ln.Accept()
+	assert.Error(t, err)
+}
+
+func TestProxyProtoListener_Close(t *testing.T) {
+	pp, err := newProxyProtocol(&config.ProxyProtocol{Enable: true, Trusted: []string{"127.0.0.1"}, Timeout: 10000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := pp.listener(inner, log.New(ioutil.Discard, "", 0).Printf).(*proxyProtoListener)
+
+	stalled, err := net.Dial("tcp", inner.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stalled.Close()
+	assert.Eventually(t, func() bool {
+		ln.mu.Lock()
+		defer ln.mu.Unlock()
+		return len(ln.reading) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// the balancer whose header is being read is dropped with the listener
+	ln.Close()
+	stalled.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = stalled.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestProxyHeader(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56324}
+	dst := &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 80}
+	dst6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 80}
+
+	assert.Equal(t, "PROXY TCP4 192.0.2.1 198.51.100.1 56324 80\r\n", string(proxyHeader(1, src, dst, nil)))
+	assert.Equal(t, "PROXY TCP6 ::ffff:192.0.2.1 2001:db8::2 56324 80\r\n", string(proxyHeader(1, src, dst6, nil)))
+	assert.Equal(t, "PROXY UNKNOWN\r\n", string(proxyHeader(1, src, nil, nil)))
+
+	for _, d := range []*net.TCPAddr{dst, dst6} {
+		header := proxyHeader(2, src, d, []proxyTLV{{typ: 0xE0, value: []byte("alice")}})
+		gotSrc, gotDst, err := readProxyHeader(bytes.NewReader(header))
+		if assert.NoError(t, err) {
+			assert.True(t, src.IP.Equal(gotSrc.(*net.TCPAddr).IP))
+			assert.Equal(t, src.Port, gotSrc.(*net.TCPAddr).Port)
+			assert.Equal(t, d.String(), gotDst.String())
+		}
+		assert.True(t, bytes.HasSuffix(header, []byte{0xE0, 0, 5, 'a', 'l', 'i', 'c', 'e'}))
+	}
+	gotSrc, _, err := readProxyHeader(bytes.NewReader(proxyHeader(2, src, nil, nil)))
+	assert.NoError(t, err)
+	assert.Nil(t, gotSrc)
+}
+
+func TestSession_sendProxyHeader(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	cfg := config.NewConfig()
+	cfg.Outbound = []config.Outbound{
+		{Name: "backend", Type: "direct", ProxyProtocol: "v2", ProxyProtocolUserTLV: 0xE0},
+	}
+	cfg.Route = []config.Route{{Outbound: "backend"}}
+	srv, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, client := net.Pipe()
+	defer client.Close()
+	remote := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56324}
+	s := srv.newSession(&proxyProtoConn{Conn: server, remote: remote}, Socks5Version)
+	defer s.Close()
+	s.setIdentity(&Identity{Username: "alice", Method: AuthUserPass})
+
+	dest, _ := ParseAddrSpec(ln.Addr().String())
+	target, err := s.resolverAndDialAddr(context.Background(), dest)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer target.Close()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	src, dst, err := readProxyHeader(conn)
+	if assert.NoError(t, err) {
+		assert.Equal(t, remote.String(), src.String())
+		assert.Equal(t, ln.Addr().String(), dst.String())
+	}
+}
+
+// fixedDialer dials addr whatever the address asked, as an upstream proxy
+// which resolves the domain names.
+type fixedDialer struct {
+	addr string
+}
+
+func (d fixedDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, network, d.addr)
+}
+
+func TestSession_sendProxyHeaderDomainName(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	cfg := config.NewConfig()
+	cfg.Outbound = []config.Outbound{{Name: "backend", Type: "direct", ProxyProtocol: "v1"}}
+	cfg.Route = []config.Route{{Outbound: "backend"}}
+	srv, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ob := srv.routes[0].outbound
+	ob.dialer, ob.resolve = fixedDialer{addr: ln.Addr().String()}, false
+
+	server, client := net.Pipe()
+	defer client.Close()
+	remote := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56324}
+	s := srv.newSession(&proxyProtoConn{Conn: server, remote: remote}, Socks5Version)
+	defer s.Close()
+
+	dest, _ := ParseAddrSpec("example.com:443")
+	target, err := s.resolverAndDialAddr(context.Background(), dest)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer target.Close()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	src, dst, err := readProxyHeader(conn)
+	if assert.NoError(t, err) {
+		assert.Equal(t, remote.String(), src.String())
+		assert.Equal(t, "0.0.0.0:443", dst.String())
+	}
+}
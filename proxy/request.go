@@ -42,6 +42,7 @@ func readAddrSpec(r io.Reader) (*AddrSpec, error) {
 	if _, err := r.Read(h[:1]); err != nil {
 		return nil, err
 	}
+	addr.Type = h[0]
 	switch h[0] {
 	case TypeIPV4:
 		buf := make([]byte, 4)
@@ -56,7 +57,7 @@ func readAddrSpec(r io.Reader) (*AddrSpec, error) {
 		}
 		addr.IP = buf
 	case TypeFQDN:
-		if _, err := r.Read(h); err != nil {
+		if _, err := io.ReadFull(r, h[:1]); err != nil {
 			return nil, err
 		}
 		n := int(h[0])
@@ -72,11 +73,88 @@ func readAddrSpec(r io.Reader) (*AddrSpec, error) {
 	if _, err := io.ReadAtLeast(r, h, 2); err != nil {
 		return nil, err
 	}
-	addr.Type = h[0]
 	addr.Port = (int(h[0])<<8 | int(h[1]))
 	return addr, nil
 }
 
+func newAddrSpecFromAddr(addr net.Addr) *AddrSpec {
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	as := &AddrSpec{IP: net.ParseIP(host)}
+	as.Port, _ = strconv.Atoi(port)
+	as.Type = TypeIPV6
+	if as.IP.To4() != nil {
+		as.Type = TypeIPV4
+	}
+	return as
+}
+
+// ParseAddrSpec parses a "host:port" address, the host is either an IP or
+// a domain name.
+func ParseAddrSpec(address string) (*AddrSpec, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	nPort, err := strconv.Atoi(port)
+	if err != nil || nPort < 0 || nPort > 0xFFFF {
+		return nil, fmt.Errorf("Invalid port: %q", port)
+	}
+	if host == "" {
+		return nil, fmt.Errorf("Invalid host: %q", address)
+	}
+	as := &AddrSpec{Port: nPort}
+	if ip := net.ParseIP(host); ip != nil {
+		as.IP = ip
+		as.Type = TypeIPV6
+		if ip.To4() != nil {
+			as.Type = TypeIPV4
+		}
+	} else {
+		as.FQDN = host
+		as.Type = TypeFQDN
+	}
+	return as, nil
+}
+
+// String returns the "host:port" form of the address.
+func (as *AddrSpec) String() string {
+	host := as.FQDN
+	if host == "" {
+		host = as.IP.String()
+	}
+	return net.JoinHostPort(host, strconv.Itoa(as.Port))
+}
+
+/*
+MarshalBinary encodes the address like it is carried in requests, replies
+and UDP request headers:
++------+----------+----------+
+| ATYP | DST.ADDR | DST.PORT |
++------+----------+----------+
+|  1   | Variable |    2     |
++------+----------+----------+
+*/
+func (as *AddrSpec) MarshalBinary() ([]byte, error) {
+	var b []byte
+	switch {
+	case as.FQDN != "":
+		if len(as.FQDN) > 0xFF {
+			return nil, fmt.Errorf("Invalid FQDN: %q", as.FQDN)
+		}
+		b = append([]byte{TypeFQDN, byte(len(as.FQDN))}, as.FQDN...)
+	case as.IP.To4() != nil:
+		b = append([]byte{TypeIPV4}, as.IP.To4()...)
+	case as.IP.To16() != nil:
+		b = append([]byte{TypeIPV6}, as.IP.To16()...)
+	default:
+		return nil, fmt.Errorf("Invalid address: %v", as)
+	}
+	return append(b, uint8(as.Port>>8), uint8(as.Port)), nil
+}
+
 // Resolve ...
 func (as *AddrSpec) Resolve(ctx context.Context) (string, error) {
 	ip, err := as.resolveIPAddr()
@@ -105,6 +183,8 @@ type Request struct {
 	Command    uint8
 	RemoteAddr *AddrSpec
 	DestAddr   *AddrSpec
+	// UserID is only carried by SOCKS4 requests
+	UserID string
 }
 
 // NewReuqest ...
@@ -114,7 +194,7 @@ func NewReuqest(r io.Reader) (*Request, error) {
 
 func readRequest(r io.Reader) (*Request, error) {
 	header := make([]byte, 3)
-	_, err := r.Read(header)
+	_, err := io.ReadFull(r, header)
 	if err != nil {
 		return nil, err
 	}
@@ -132,4 +212,50 @@ func readRequest(r io.Reader) (*Request, error) {
 	return req, nil
 }
 
-// NewReply ...
+// WriteTo writes the request to w, it is what a client sends.
+func (req *Request) WriteTo(w io.Writer) (int64, error) {
+	addr, err := req.DestAddr.MarshalBinary()
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(append([]byte{req.Version, req.Command, 0x00}, addr...))
+	return int64(n), err
+}
+
+// Reply ...
+type Reply struct {
+	Version  uint8
+	Code     ReplyCode
+	BindAddr *AddrSpec
+}
+
+// NewReply reads a reply, it is what a client receives.
+func NewReply(r io.Reader) (*Reply, error) {
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	bind, err := NewAddrSpec(r)
+	if err != nil {
+		return nil, err
+	}
+	return &Reply{
+		Version:  header[0],
+		Code:     ReplyCode(header[1]),
+		BindAddr: bind,
+	}, nil
+}
+
+// WriteTo writes the reply to w, a nil BindAddr is sent as 0.0.0.0:0.
+func (rep *Reply) WriteTo(w io.Writer) (int64, error) {
+	bind := rep.BindAddr
+	if bind == nil {
+		bind = &AddrSpec{IP: net.IPv4zero, Type: TypeIPV4}
+	}
+	addr, err := bind.MarshalBinary()
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(append([]byte{rep.Version, byte(rep.Code), 0x00}, addr...))
+	return int64(n), err
+}
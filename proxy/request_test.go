@@ -48,3 +48,55 @@ func Test_readRequest(t *testing.T) {
 		})
 	}
 }
+
+func TestRequest_WriteTo(t *testing.T) {
+	tests := []struct {
+		name string
+		addr string
+		want []byte
+	}{
+		{
+			name: "ipv4",
+			addr: "127.0.0.1:1080",
+			want: []byte{5, 1, 0, 1, 127, 0, 0, 1, 4, 56},
+		},
+		{
+			name: "ipv6",
+			addr: "[::1]:1080",
+			want: []byte{5, 1, 0, 4, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 4, 56},
+		},
+		{
+			name: "fqdn",
+			addr: "example.com:1080",
+			want: append(append([]byte{5, 1, 0, 3, 11}, "example.com"...), 4, 56),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dest, err := ParseAddrSpec(tt.addr)
+			assert.NoError(t, err)
+			req := &Request{Version: Socks5Version, Command: CmdConnect, DestAddr: dest}
+			buf := new(bytes.Buffer)
+			_, err = req.WriteTo(buf)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, buf.Bytes())
+
+			got, err := readRequest(buf)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.addr, got.DestAddr.String())
+			assert.Equal(t, tt.want[3], got.DestAddr.Type)
+		})
+	}
+}
+
+func TestReply_WriteTo(t *testing.T) {
+	buf := new(bytes.Buffer)
+	_, err := (&Reply{Version: Socks5Version, Code: ReplyHostUnreachable}).WriteTo(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{5, 4, 0, 1, 0, 0, 0, 0, 0, 0}, buf.Bytes())
+
+	rep, err := NewReply(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, ReplyHostUnreachable, rep.Code)
+	assert.Equal(t, "0.0.0.0:0", rep.BindAddr.String())
+}
@@ -0,0 +1,356 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/remones/gsocks/config"
+)
+
+// errors
+var (
+	ErrRouteRejected = errors.New("socks: request rejected by the routes")
+)
+
+// outbound is a named way to reach the targets, the targets of an outbound
+// without dialer are dialed directly.
+type outbound struct {
+	name   string
+	reject bool
+	dialer Dialer
+	// resolve is set if the server resolves the targets, i.e. they are not
+	// reached through upstream proxies.
+	resolve bool
+	// proxyProtocol is the version of the PROXY protocol header sent to the
+	// targets, none if 0, and userTLV the type of the TLV of the username.
+	proxyProtocol int
+	userTLV       byte
+}
+
+// route picks its outbound for the requests matching all its conditions,
+// an empty condition matches any request.
+type route struct {
+	outbound    *outbound
+	domains     []string
+	domainRegex []*regexp.Regexp
+	networks    []*net.IPNet
+	ports       []portRange
+	users       map[string]bool
+	groups      map[string]bool
+	sources     []*net.IPNet
+}
+
+type portRange struct {
+	lo, hi int
+}
+
+// routeRequest is what the routes match, the IPs of a domain name are
+// looked up once if a route needs them.
+type routeRequest struct {
+	dest   *AddrSpec
+	user   string
+	groups []string
+	source net.IP
+
+	resolved bool
+	ips      []net.IP
+}
+
+// newOutbounds creates the outbounds of cfg by name, they are shared by the
+// routes and the policies picking them.
+func newOutbounds(cfg *config.Config) (map[string]*outbound, error) {
+	outbounds := map[string]*outbound{
+		"direct": {name: "direct", resolve: true},
+		"reject": {name: "reject", reject: true},
+	}
+	for _, ob := range cfg.Outbound {
+		o := &outbound{name: ob.Name}
+		switch ob.Type {
+		case "reject":
+			o.reject = true
+		case "direct":
+			o.resolve = true
+			if ob.Source != "" {
+				ip := net.ParseIP(ob.Source)
+				if ip == nil {
+					return nil, fmt.Errorf("socks: invalid source %q of outbound %s", ob.Source, ob.Name)
+				}
+				o.dialer = &directDialer{source: ip}
+			}
+		case "upstream":
+			d, err := newUpstreamChain(ob.Upstream)
+			if err != nil {
+				return nil, err
+			}
+			o.dialer = d
+		default:
+			return nil, fmt.Errorf("socks: unknown type %q of outbound %s", ob.Type, ob.Name)
+		}
+		switch ob.ProxyProtocol {
+		case "":
+		case "v1":
+			o.proxyProtocol = 1
+		case "v2":
+			o.proxyProtocol = 2
+		default:
+			return nil, fmt.Errorf("socks: unknown proxy_protocol %q of outbound %s", ob.ProxyProtocol, ob.Name)
+		}
+		o.userTLV = byte(ob.ProxyProtocolUserTLV)
+		outbounds[ob.Name] = o
+	}
+	return outbounds, nil
+}
+
+// newRoutes compiles the routing table of cfg.
+func newRoutes(cfg *config.Config, outbounds map[string]*outbound) ([]*route, error) {
+	if len(cfg.Route) == 0 {
+		return nil, nil
+	}
+	routes := make([]*route, 0, len(cfg.Route))
+	for i, rc := range cfg.Route {
+		ob, ok := outbounds[rc.Outbound]
+		if !ok {
+			return nil, fmt.Errorf("socks: unknown outbound %q of route %d", rc.Outbound, i)
+		}
+		r := &route{outbound: ob, domains: normalizeDomains(rc.Domains)}
+		for _, expr := range rc.DomainRegex {
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return nil, fmt.Errorf("socks: domain_regex of route %d: %v", i, err)
+			}
+			r.domainRegex = append(r.domainRegex, re)
+		}
+		var err error
+		if r.networks, err = parseCIDRs(rc.Networks); err != nil {
+			return nil, fmt.Errorf("socks: networks of route %d: %v", i, err)
+		}
+		if r.sources, err = parseCIDRs(rc.Sources); err != nil {
+			return nil, fmt.Errorf("socks: sources of route %d: %v", i, err)
+		}
+		for _, p := range rc.Ports {
+			pr, err := parsePortRange(p)
+			if err != nil {
+				return nil, fmt.Errorf("socks: ports of route %d: %v", i, err)
+			}
+			r.ports = append(r.ports, pr)
+		}
+		if len(rc.Users) > 0 || len(rc.Groups) > 0 {
+			r.users = make(map[string]bool)
+			for _, user := range rc.Users {
+				r.users[user] = true
+			}
+			r.groups = make(map[string]bool)
+			for _, group := range rc.Groups {
+				r.groups[group] = true
+			}
+		}
+		routes = append(routes, r)
+	}
+	return routes, nil
+}
+
+// containsAny reports whether any of values is in set.
+func containsAny(set map[string]bool, values []string) bool {
+	for _, v := range values {
+		if set[v] {
+			return true
+		}
+	}
+	return false
+}
+
+// parseCIDRs parses CIDRs, a bare IP is a network of its own.
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP %q", cidr)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// parsePortRange parses a port, e.g. "443", or a range, e.g. "8000-8999".
+func parsePortRange(s string) (portRange, error) {
+	lo, hi := s, s
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		lo, hi = s[:i], s[i+1:]
+	}
+	l, err := strconv.ParseUint(strings.TrimSpace(lo), 10, 16)
+	if err != nil {
+		return portRange{}, fmt.Errorf("invalid port range %q", s)
+	}
+	h, err := strconv.ParseUint(strings.TrimSpace(hi), 10, 16)
+	if err != nil || h < l {
+		return portRange{}, fmt.Errorf("invalid port range %q", s)
+	}
+	return portRange{lo: int(l), hi: int(h)}, nil
+}
+
+func (r *route) match(ctx context.Context, req *routeRequest) bool {
+	if r.users != nil && !r.users[req.user] && !containsAny(r.groups, req.groups) {
+		return false
+	}
+	if len(r.sources) > 0 && !containsIP(r.sources, req.source) {
+		return false
+	}
+	if len(r.ports) > 0 && !portsContain(r.ports, req.dest.Port) {
+		return false
+	}
+	if (len(r.domains) > 0 || len(r.domainRegex) > 0) && !r.matchDomain(req.dest.FQDN) {
+		return false
+	}
+	if len(r.networks) > 0 {
+		for _, ip := range req.lookup(ctx) {
+			if containsIP(r.networks, ip) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func portsContain(ports []portRange, port int) bool {
+	for _, pr := range ports {
+		if port >= pr.lo && port <= pr.hi {
+			return true
+		}
+	}
+	return false
+}
+
+// matchDomain reports whether fqdn matches the domains or one of the
+// regular expressions. The domain rules never match IP addresses.
+func (r *route) matchDomain(fqdn string) bool {
+	if fqdn == "" {
+		return false
+	}
+	if matchDomain(r.domains, fqdn) {
+		return true
+	}
+	fqdn = strings.ToLower(strings.TrimSuffix(fqdn, "."))
+	for _, re := range r.domainRegex {
+		if re.MatchString(fqdn) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeDomains lowercases domains and trims their dots.
+func normalizeDomains(domains []string) []string {
+	var normalized []string
+	for _, domain := range domains {
+		normalized = append(normalized, strings.ToLower(strings.Trim(domain, ".")))
+	}
+	return normalized
+}
+
+// matchDomain reports whether fqdn is one of the normalized domains or a
+// subdomain of them. A domain with wildcards, e.g. "api-*.example.com", is
+// a pattern matching fqdn as a whole.
+func matchDomain(domains []string, fqdn string) bool {
+	if fqdn == "" {
+		return false
+	}
+	fqdn = strings.ToLower(strings.TrimSuffix(fqdn, "."))
+	for _, domain := range domains {
+		if strings.ContainsAny(domain, "*?[") {
+			if ok, _ := path.Match(domain, fqdn); ok {
+				return true
+			}
+			continue
+		}
+		if fqdn == domain || strings.HasSuffix(fqdn, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// lookup returns the IPs of the destination, a domain name which does not
+// resolve has none.
+func (req *routeRequest) lookup(ctx context.Context) []net.IP {
+	if req.dest.FQDN == "" {
+		return []net.IP{req.dest.IP}
+	}
+	if !req.resolved {
+		req.resolved = true
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, req.dest.FQDN)
+		if err == nil {
+			for _, addr := range addrs {
+				req.ips = append(req.ips, addr.IP)
+			}
+		}
+	}
+	return req.ips
+}
+
+// outbound returns the outbound of the request of the session to dest, the
+// requests matching no route go through the outbound of the policy of the
+// user, or the Dialer of the server.
+func (s *Session) outbound(ctx context.Context, dest *AddrSpec) *outbound {
+	req := &routeRequest{dest: dest, user: s.username()}
+	if s.identity != nil {
+		req.groups = s.identity.Groups
+	}
+	if addr, ok := s.RemoteAddr().(*net.TCPAddr); ok {
+		req.source = addr.IP
+	}
+	for _, r := range s.srv.routes {
+		if r.match(ctx, req) {
+			return r.outbound
+		}
+	}
+	if s.policy != nil && s.policy.outbound != nil {
+		return s.policy.outbound
+	}
+	return &outbound{name: "default", dialer: s.srv.Dialer, resolve: s.srv.Dialer == nil}
+}
+
+// directDialer reaches the targets directly from a local source address.
+type directDialer struct {
+	source net.IP
+}
+
+func (d *directDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	dialer := net.Dialer{LocalAddr: &net.TCPAddr{IP: d.source}}
+	return dialer.DialContext(ctx, network, address)
+}
+
+func (d *directDialer) ListenPacket(ctx context.Context, network, address string) (net.PacketConn, error) {
+	return net.ListenUDP(network, &net.UDPAddr{IP: d.source})
+}
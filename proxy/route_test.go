@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/remones/gsocks/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewRoutes(t *testing.T) {
+	cfg := config.NewConfig()
+	cfg.Outbound = []config.Outbound{
+		{Name: "lan", Type: "direct", Source: "127.0.0.1"},
+	}
+	cfg.Route = []config.Route{
+		{Outbound: "reject", Networks: []string{"10.0.0.0/8", "::1"}},
+		{Outbound: "lan", Domains: []string{"Example.com."}, Ports: []string{"443", "8000-8999"}},
+		{Outbound: "direct", DomainRegex: []string{`^api\d+\.test$`}},
+		{Outbound: "lan", Users: []string{"alice"}, Sources: []string{"192.168.0.0/16"}},
+		{Outbound: "reject", Groups: []string{"contractors"}, Ports: []string{"22"}},
+	}
+	outbounds, err := newOutbounds(cfg)
+	if !assert.NoError(t, err) {
+		return
+	}
+	routes, err := newRoutes(cfg, outbounds)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	tests := []struct {
+		name   string
+		dest   string
+		user   string
+		source string
+		want   string
+	}{
+		{"network", "10.1.2.3:80", "", "", "reject"},
+		{"bare_ip", "[::1]:80", "", "", "reject"},
+		{"domain", "example.com:443", "", "", "lan"},
+		{"subdomain", "www.EXAMPLE.com:8080", "", "", "lan"},
+		{"not_subdomain", "badexample.com:443", "", "", ""},
+		{"port", "example.com:80", "", "", ""},
+		{"regex", "api42.test:53", "", "", "direct"},
+		{"user_source", "1.2.3.4:80", "alice", "192.168.1.1", "lan"},
+		{"user_other_source", "1.2.3.4:80", "alice", "172.16.0.1", ""},
+		{"other_user", "1.2.3.4:80", "bob", "192.168.1.1", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dest, err := ParseAddrSpec(tt.dest)
+			assert.NoError(t, err)
+			req := &routeRequest{dest: dest, user: tt.user, source: net.ParseIP(tt.source)}
+			var got string
+			for _, r := range routes {
+				if r.match(context.Background(), req) {
+					got = r.outbound.name
+					break
+				}
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+	assert.Equal(t, &directDialer{source: net.ParseIP("127.0.0.1")}, routes[1].outbound.dialer)
+
+	// the routes of the groups match their members
+	dest, _ := ParseAddrSpec("1.2.3.4:22")
+	assert.True(t, routes[4].match(context.Background(), &routeRequest{dest: dest, user: "carol", groups: []string{"staff", "contractors"}}))
+	assert.False(t, routes[4].match(context.Background(), &routeRequest{dest: dest, user: "contractors", groups: []string{"staff"}}))
+}
+
+func TestParsePortRange(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    portRange
+		wantErr bool
+	}{
+		{"443", portRange{443, 443}, false},
+		{"8000-8999", portRange{8000, 8999}, false},
+		{"9000-8000", portRange{}, true},
+		{"65536", portRange{}, true},
+		{"http", portRange{}, true},
+	}
+	for _, tt := range tests {
+		got, err := parsePortRange(tt.s)
+		assert.Equal(t, tt.wantErr, err != nil, tt.s)
+		assert.Equal(t, tt.want, got, tt.s)
+	}
+}
+
+func TestNewServer_unregisteredUpstream(t *testing.T) {
+	// the tests of package proxy do not import package client
+	cfg := config.NewConfig()
+	cfg.Outbound = []config.Outbound{
+		{Name: "corp", Type: "upstream", Upstream: []config.Upstream{{Type: "socks5", Address: "127.0.0.1:1080"}}},
+	}
+	_, err := NewServer(cfg)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "github.com/remones/gsocks/client")
+	}
+}
@@ -2,8 +2,10 @@ package proxy
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"log"
 	"net"
 	"sync"
 	"sync/atomic"
@@ -18,7 +20,7 @@ const Socks5Version = uint8(0x5)
 // Errors ...
 var (
 	ErrServerClosed       = errors.New("socks: server closed")
-	ErrProtoNotSupport    = errors.New("socks: only support SOCKS5 for now")
+	ErrProtoNotSupport    = errors.New("socks: only support SOCKS4, SOCKS5 and HTTP proxy for now")
 	ErrAuthenticateFailed = errors.New("socks: authenticate failed")
 )
 
@@ -39,48 +41,291 @@ func (ln *onceCloseListener) close() {
 
 // Server ...
 type Server struct {
-	addr           string
-	listener       net.Listener
-	mu             sync.Mutex
-	waitConns      sync.WaitGroup
-	inShutdown     int32
-	doneChan       chan struct{}
-	authenticators map[AuthType]Authenticator
-	DialTimeout    time.Duration
+	addr string
+	// endpoints are served instead of addr if any
+	endpoints []*endpoint
+	// listeners are the listeners being served
+	listeners  map[net.Listener]struct{}
+	mu         sync.Mutex
+	waitConns  sync.WaitGroup
+	inShutdown int32
+	doneChan   chan struct{}
+	// sessionsCtx is the context of the sessions, which Close cancels
+	sessionsCtx    context.Context
+	cancelSessions context.CancelFunc
+	authenticators map[AuthType]ContextAuthenticator
+	// methods are the methods in the order of preference, and authNetworks
+	// those of the clients of networks.
+	methods      []AuthType
+	authNetworks []authNetwork
+	DialTimeout  time.Duration
+	// BindAddress is the host BIND listens on
+	BindAddress string
+	BindTimeout time.Duration
+	// UDPAddress is the host UDP ASSOCIATE relays datagrams on, and
+	// UDPAdvertise the address replied to clients, if it differs.
+	UDPAddress   string
+	UDPAdvertise net.IP
+	// UDPFragQueueSize and UDPFragTimeout limit the reassembly of
+	// fragmented UDP datagrams.
+	UDPFragQueueSize int
+	UDPFragTimeout   time.Duration
+	// UDPFilter is the filtering behaviour of the UDP NAT mappings, one of
+	// the UDPFilter* constants, and UDPMappingTimeout the idle time after
+	// which a mapping expires.
+	UDPFilter         string
+	UDPMappingTimeout time.Duration
+	udpRelays         map[*udpServer]struct{}
+	// Dialer connects to the targets matching no route, they are dialed
+	// directly if nil. UDP is relayed through it only if it is a
+	// PacketDialer.
+	Dialer Dialer
+	routes []*route
+	acl    *acl
+	// policies are the policies of the users by name, and groupPolicies
+	// of the groups.
+	policies      map[string]*policy
+	groupPolicies map[string]*policy
+	// users counts the sessions by authenticated user
+	users map[string]int
+	// ErrorLog logs the rejected connections, the standard logger of the
+	// log package is used if nil.
+	ErrorLog *log.Logger
+	clients  *clientLimiter
+	lockout  *lockout
+	// OnBan, if not nil, is called when the authentication failures of a
+	// source IP or a username ban it. It is called by the session of the
+	// last failure, so it must not block.
+	OnBan func(BanEvent)
+	// TLSConfig, if not nil, serves the clients of ListenAndServe over TLS,
+	// and TLSHandshakeTimeout limits their handshake.
+	TLSConfig           *tls.Config
+	TLSHandshakeTimeout time.Duration
+	// TLSClientIdentity, one of the TLSIdentity* constants, authenticates
+	// the clients with a verified certificate as its identity when they
+	// offer no authentication.
+	TLSClientIdentity string
+	tlsReloader       *tlsReloader
+	proxyProtocol     *proxyProtocol
+	unixSocket        *unixSocket
 }
 
-// NewServer ...
-func NewServer(cfg *config.Config) *Server {
-	return &Server{
-		addr:           fmt.Sprintf("%s:%d", cfg.Host, cfg.Port),
-		authenticators: makeAuthsWithConfig(&cfg.Auth),
-		DialTimeout:    time.Millisecond * time.Duration(cfg.DialTimeout),
-		doneChan:       make(chan struct{}),
+// NewServer creates a server of cfg. The upstream proxy types of
+// [[upstream]] and [[outbound]] must be registered, the built-in ones are by
+// importing package github.com/remones/gsocks/client, e.g.
+//
+//	import _ "github.com/remones/gsocks/client"
+func NewServer(cfg *config.Config) (*Server, error) {
+	auths, err := makeAuthsWithConfig(&cfg.Auth)
+	if err != nil {
+		return nil, err
+	}
+	addr := fmt.Sprintf("%s:%d", cfg.Host, cfg.Port)
+	host := cfg.Host
+	if config.IsUnixAddress(cfg.Host) {
+		// the clients of a unix socket are local
+		addr, host = cfg.Host, "127.0.0.1"
+	}
+	bindAddr := cfg.Bind.Address
+	if bindAddr == "" {
+		bindAddr = host
+	}
+	udpAddr := cfg.UDP.Address
+	if udpAddr == "" {
+		udpAddr = host
+	}
+	dialer, err := newUpstreamChain(cfg.Upstream)
+	if err != nil {
+		return nil, err
+	}
+	outbounds, err := newOutbounds(cfg)
+	if err != nil {
+		return nil, err
+	}
+	routes, err := newRoutes(cfg, outbounds)
+	if err != nil {
+		return nil, err
+	}
+	policiesByName, policies, groupPolicies, err := newPolicies(cfg, outbounds)
+	if err != nil {
+		return nil, err
+	}
+	endpoints, err := newEndpoints(cfg, policiesByName)
+	if err != nil {
+		return nil, err
+	}
+	acl, err := newACL(&cfg.ACL)
+	if err != nil {
+		return nil, err
+	}
+	clients, err := newClientLimiter(&cfg.Client)
+	if err != nil {
+		return nil, err
+	}
+	methods, authNetworks, err := newAuthMethods(&cfg.Auth)
+	if err != nil {
+		return nil, err
+	}
+	lockout, err := newLockout(cfg.Auth.Lockout)
+	if err != nil {
+		return nil, err
+	}
+	if up, ok := auths[AuthUserPass].(*UserPassAuthenticator); ok {
+		up.lockout = lockout
+	}
+	tlsReloader, err := newTLSReloader(cfg.TLS)
+	if err != nil {
+		return nil, err
+	}
+	proxyProtocol, err := newProxyProtocol(cfg.ProxyProtocol)
+	if err != nil {
+		return nil, err
+	}
+	unixSocket, err := newUnixSocket(cfg.Unix)
+	if err != nil {
+		return nil, err
+	}
+	srv := &Server{
+		addr:              addr,
+		endpoints:         endpoints,
+		authenticators:    auths,
+		methods:           methods,
+		authNetworks:      authNetworks,
+		DialTimeout:       time.Millisecond * time.Duration(cfg.DialTimeout),
+		BindAddress:       bindAddr,
+		BindTimeout:       time.Millisecond * time.Duration(cfg.Bind.AcceptTimeout),
+		UDPAddress:        udpAddr,
+		UDPAdvertise:      net.ParseIP(cfg.UDP.Advertise),
+		UDPFragQueueSize:  cfg.UDP.FragQueueSize,
+		UDPFragTimeout:    time.Millisecond * time.Duration(cfg.UDP.FragTimeout),
+		UDPFilter:         cfg.UDP.Filter,
+		UDPMappingTimeout: time.Millisecond * time.Duration(cfg.UDP.MappingTimeout),
+		Dialer:            dialer,
+		routes:            routes,
+		acl:               acl,
+		policies:          policies,
+		groupPolicies:     groupPolicies,
+		clients:           clients,
+		lockout:           lockout,
+		doneChan:          make(chan struct{}),
+		tlsReloader:       tlsReloader,
+		proxyProtocol:     proxyProtocol,
+		unixSocket:        unixSocket,
+	}
+	if tlsReloader != nil {
+		tlsReloader.logf = srv.logf
+		srv.TLSConfig = tlsReloader.tlsConfig()
+		srv.TLSHandshakeTimeout = time.Millisecond * time.Duration(cfg.TLS.HandshakeTimeout)
+		srv.TLSClientIdentity = cfg.TLS.ClientIdentity
+	}
+	for _, ep := range endpoints {
+		if ep.tlsReloader != nil {
+			ep.tlsReloader.logf = srv.logf
+		}
 	}
+	if lockout != nil {
+		lockout.onBan = srv.banned
+		lockout.logf = srv.logf
+	}
+	return srv, nil
 }
 
-// ListenAndServe serve the socks server
+// ListenAndServe serve the socks server, over TLS if TLSConfig is set. The
+// certificate files of the config are reloaded once they change, and the
+// PROXY protocol headers of the trusted balancers are read before TLS. The
+// listeners of the config are served instead of its host and port if it
+// has some, it returns once one of them fails.
 func (srv *Server) ListenAndServe() error {
-	ln, err := net.Listen("tcp", srv.addr)
+	if len(srv.endpoints) > 0 {
+		return srv.serveEndpoints()
+	}
+	ln, err := listen(srv.addr, srv.unixSocket)
 	if err != nil {
 		return err
 	}
+	ln = srv.proxyProtocol.listener(ln, srv.logf)
+	if srv.TLSConfig != nil {
+		ln = tls.NewListener(ln, srv.TLSConfig)
+		if srv.tlsReloader != nil {
+			go srv.tlsReloader.watch(srv.getDoneChan())
+		}
+	}
+	return srv.Serve(ln)
+}
+
+// ReloadTLS reloads the certificates and the client CAs of the config from
+// their files, they apply to the next handshakes while the sessions go on.
+// The previous ones are kept if they fail to load, the first error is
+// returned.
+func (srv *Server) ReloadTLS() error {
+	var err error
+	if srv.tlsReloader != nil {
+		err = srv.tlsReloader.reload()
+	}
+	for _, ep := range srv.endpoints {
+		if ep.tlsReloader == nil {
+			continue
+		}
+		if rErr := ep.tlsReloader.reload(); rErr != nil && err == nil {
+			err = fmt.Errorf("socks: listener %s: %w", ep.name, rErr)
+		}
+	}
+	return err
+}
+
+// Serve serves the sessions of the connections accepted on ln, ln is closed
+// when it returns.
+func (srv *Server) Serve(ln net.Listener) error {
+	return srv.serveListener(ln, nil)
+}
+
+// serveListener serves the clients of ep accepted on ln, along with the
+// other listeners.
+func (srv *Server) serveListener(ln net.Listener, ep *endpoint) error {
 	ln = &onceCloseListener{Listener: ln}
 	defer ln.Close()
-	srv.listener = ln
+	srv.trackListener(ln, true)
+	defer srv.trackListener(ln, false)
+
+	return srv.serve(ln, ep)
+}
+
+func (srv *Server) trackListener(ln net.Listener, add bool) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.listeners == nil {
+		srv.listeners = make(map[net.Listener]struct{})
+	}
+	if add {
+		srv.listeners[ln] = struct{}{}
+	} else {
+		delete(srv.listeners, ln)
+	}
+}
 
-	return srv.serve()
+// closeListeners closes the listeners being served, the first error is
+// returned.
+func (srv *Server) closeListeners() error {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	var err error
+	for ln := range srv.listeners {
+		if cErr := ln.Close(); cErr != nil && err == nil {
+			err = cErr
+		}
+	}
+	return err
 }
 
-func (srv *Server) serve() (err error) {
+func (srv *Server) serve(ln net.Listener, ep *endpoint) (err error) {
 	if srv.shuttingDown() {
 		return ErrServerClosed
 	}
 
 	var tempDelay time.Duration
-	ctx := context.Background()
+	ctx := srv.getSessionsCtx()
 	for {
-		conn, err := srv.listener.Accept()
+		conn, err := ln.Accept()
 		if err != nil {
 			select {
 			case <-srv.getDoneChan():
@@ -101,19 +346,47 @@ func (srv *Server) serve() (err error) {
 			}
 			return err
 		}
+		release, err := srv.clients.admit(conn.RemoteAddr())
+		if err != nil {
+			srv.logf("socks: reject %s: %v", conn.RemoteAddr(), err)
+			conn.Close()
+			continue
+		}
 		srv.waitConns.Add(1)
-		go srv.serveSession(ctx, conn)
+		go func() {
+			defer release()
+			srv.serveSession(ctx, conn, ep)
+		}()
 	}
 }
 
-func (srv *Server) serveSession(ctx context.Context, conn net.Conn) error {
+func (srv *Server) serveSession(ctx context.Context, conn net.Conn, ep *endpoint) error {
 	defer srv.waitConns.Done()
 
 	select {
 	case <-ctx.Done():
+		conn.Close()
 		return ctx.Err()
 	default:
 	}
+	// the connection is closed once the session is canceled, whatever it
+	// is waiting for.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	if tc, ok := conn.(*tls.Conn); ok {
+		if err := srv.handshakeTLS(ctx, tc, ep); err != nil {
+			srv.logf("socks: tls handshake %s: %v", conn.RemoteAddr(), err)
+			conn.Close()
+			return err
+		}
+	}
 
 	b := make([]byte, 1)
 	_, err := conn.Read(b)
@@ -121,24 +394,42 @@ func (srv *Server) serveSession(ctx context.Context, conn net.Conn) error {
 		return err
 	}
 	ver := uint8(b[0])
-	if ver != Socks5Version {
+	if isHTTPMethodPrefix(b[0]) {
+		sess := srv.newSession(newBufferedConn(conn, b), httpProxyVersion)
+		sess.endpoint = ep
+		defer sess.Close()
+		return sess.ServeHTTP(ctx)
+	}
+	if ver != Socks5Version && ver != Socks4Version {
 		return ErrProtoNotSupport
 	}
 
-	sess := srv.newSession(conn)
+	sess := srv.newSession(conn, ver)
+	sess.endpoint = ep
 	defer sess.Close()
 
-	authentic, err := sess.Authenticate()
-	if err != nil {
-		return err
-	}
-	if !authentic {
-		return ErrAuthenticateFailed
+	switch ver {
+	case Socks4Version:
+		// SOCKS4 has no method negotiation, only serve it when the client
+		// does not require authentication or its connection authenticates it.
+		if !sess.authenticateConn() && !sess.allowsMethod(AuthNoRequried) {
+			sess.sendReply(ReplyNotAllowed, nil)
+			return ErrAuthenticateFailed
+		}
+	default:
+		authentic, err := sess.AuthenticateContext(ctx)
+		if err != nil {
+			return err
+		}
+		if !authentic {
+			return ErrAuthenticateFailed
+		}
 	}
 	return sess.ServeRequest(ctx)
 }
 
-// Close the server.
+// Close closes the listeners and the sessions of the server, and waits for
+// the sessions to end until ctx is done.
 func (srv *Server) Close(ctx context.Context) error {
 	atomic.StoreInt32(&srv.inShutdown, 1)
 
@@ -149,10 +440,21 @@ func (srv *Server) Close(ctx context.Context) error {
 	default:
 		close(ch)
 	}
-	lnerr := srv.listener.Close()
+	lnerr := srv.closeListeners()
+	srv.getSessionsCtx()
+	srv.cancelSessions()
 
-	srv.waitConns.Wait()
-	return lnerr
+	ended := make(chan struct{})
+	go func() {
+		srv.waitConns.Wait()
+		close(ended)
+	}()
+	select {
+	case <-ended:
+		return lnerr
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 func (srv *Server) shuttingDown() bool {
@@ -167,3 +469,64 @@ func (srv *Server) getDoneChan() chan struct{} {
 	}
 	return srv.doneChan
 }
+
+func (srv *Server) getSessionsCtx() context.Context {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.sessionsCtx == nil {
+		srv.sessionsCtx, srv.cancelSessions = context.WithCancel(context.Background())
+	}
+	return srv.sessionsCtx
+}
+
+// SetAuthenticator adds auth to the methods of the server, replacing the
+// authenticator of its method. Authenticators may be adapted with
+// AdaptAuthenticator. It must be called before the server is started.
+func (srv *Server) SetAuthenticator(auth ContextAuthenticator) {
+	if srv.authenticators == nil {
+		srv.authenticators = make(map[AuthType]ContextAuthenticator)
+	}
+	if up, ok := auth.(*UserPassAuthenticator); ok && up.lockout == nil {
+		up.lockout = srv.lockout
+	}
+	srv.authenticators[auth.Type()] = auth
+}
+
+// RejectedConns returns the counts of the connections rejected by the
+// client lists and limits.
+func (srv *Server) RejectedConns() RejectStats {
+	return srv.clients.stats()
+}
+
+func (srv *Server) logf(format string, args ...interface{}) {
+	if srv.ErrorLog != nil {
+		srv.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+func (srv *Server) trackUDPRelay(us *udpServer, add bool) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.udpRelays == nil {
+		srv.udpRelays = make(map[*udpServer]struct{})
+	}
+	if add {
+		srv.udpRelays[us] = struct{}{}
+	} else {
+		delete(srv.udpRelays, us)
+	}
+}
+
+// UDPMappings returns the statistics of the NAT mappings of all the UDP
+// relays alive.
+func (srv *Server) UDPMappings() []UDPMappingStats {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	var stats []UDPMappingStats
+	for us := range srv.udpRelays {
+		stats = append(stats, us.stats()...)
+	}
+	return stats
+}
@@ -1,21 +1,25 @@
 package proxy
 
 import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
 	"net"
-	"sync"
+	"net/http"
 	"testing"
 	"time"
+
+	"github.com/remones/gsocks/config"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestServer_ListenAndServe(t *testing.T) {
 	type fields struct {
 		addr           string
-		listener       net.Listener
-		mu             sync.Mutex
-		waitConns      sync.WaitGroup
 		inShutdown     int32
 		doneChan       chan struct{}
-		authenticators map[AuthType]Authenticator
+		authenticators map[AuthType]ContextAuthenticator
 		DialTimeout    time.Duration
 	}
 	tests := []struct {
@@ -29,9 +33,6 @@ func TestServer_ListenAndServe(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			srv := &Server{
 				addr:           tt.fields.addr,
-				listener:       tt.fields.listener,
-				mu:             tt.fields.mu,
-				waitConns:      tt.fields.waitConns,
 				inShutdown:     tt.fields.inShutdown,
 				doneChan:       tt.fields.doneChan,
 				authenticators: tt.fields.authenticators,
@@ -43,3 +44,60 @@ func TestServer_ListenAndServe(t *testing.T) {
 		})
 	}
 }
+
+func TestServer_Close(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	go func() {
+		conn, err := backend.Accept()
+		if err == nil {
+			defer conn.Close()
+			io.Copy(io.Discard, conn)
+		}
+	}()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, err := NewServer(config.NewConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.Serve(ln)
+	}()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	fmt.Fprintf(client, "CONNECT %s HTTP/1.1\r\nHost: x\r\n\r\n", backend.Addr())
+	resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	// the idle relay is closed
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.NoError(t, srv.Close(ctx))
+	assert.Equal(t, ErrServerClosed, <-served)
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = client.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestServer_CloseDeadline(t *testing.T) {
+	srv := &Server{}
+	srv.waitConns.Add(1)
+	defer srv.waitConns.Done()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, srv.Close(ctx))
+}
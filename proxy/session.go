@@ -9,7 +9,7 @@ import (
 	"net"
 	"strconv"
 	"strings"
-	"sync"
+	"time"
 )
 
 // ReplyCode ...
@@ -29,6 +29,27 @@ const (
 	ReplyUnassigned         = ReplyCode(0x09)
 )
 
+var replyMessages = map[ReplyCode]string{
+	ReplySuccessed:          "succeeded",
+	ReplyFailure:            "general SOCKS server failure",
+	ReplyNotAllowed:         "connection not allowed by ruleset",
+	ReplyNetworkUnreachable: "network unreachable",
+	ReplyHostUnreachable:    "host unreachable",
+	ReplyConnectionRefused:  "connection refused",
+	ReplyTTLExpired:         "TTL expired",
+	ReplyInvalidCommand:     "command not supported",
+	ReplyInvalidAddressType: "address type not supported",
+}
+
+func (code ReplyCode) String() string {
+	if msg, ok := replyMessages[code]; ok {
+		return msg
+	}
+	return fmt.Sprintf("unassigned reply %#x", uint8(code))
+}
+
+const defaultBindTimeout = 2 * time.Minute
+
 // errors ...
 var (
 	ErrSendReplyFailed  = errors.New("sends a reply failed")
@@ -38,34 +59,95 @@ var (
 
 // Session is the session of negotiation
 type Session struct {
-	srv *Server
+	srv     *Server
+	version uint8
+	// identity is the authenticated client, nil without authentication
+	identity *Identity
+	policy   *policy
+	// release ends the session of the user in its policy
+	release func()
+	// endpoint is the listener of [[listener]] the client connected to, nil
+	// for the one of Host and Port or Serve.
+	endpoint *endpoint
 	net.Conn
 }
 
-func (srv *Server) newSession(c net.Conn) *Session {
+func (srv *Server) newSession(c net.Conn, ver uint8) *Session {
 	return &Session{
-		srv:  srv,
-		Conn: c,
+		srv:     srv,
+		version: ver,
+		Conn:    c,
 	}
 }
 
 // Authenticate ...
 func (s *Session) Authenticate() (bool, error) {
-	methods, err := s.readMethods()
+	return s.AuthenticateContext(context.Background())
+}
+
+// AuthenticateContext negotiates the method with the client and
+// authenticates it, the I/O is interrupted once ctx is done. The method is
+// the one the server prefers among those offered, the client is replied
+// AuthNoAccetable if none is enabled for it. A client whose connection
+// authenticates it, by its certificate or its process, and offering no
+// authentication is served as it without sub-negotiation.
+func (s *Session) AuthenticateContext(ctx context.Context) (bool, error) {
+	offered, err := s.readMethods()
 	if err != nil {
 		return false, err
 	}
-	for _, method := range methods {
-		if auth, found := s.srv.authenticators[AuthType(method)]; found {
-			err := s.ackMethod(method)
-			if err != nil {
+	if bytes.IndexByte(offered, byte(AuthNoRequried)) >= 0 {
+		if id := s.connIdentity(); id != nil {
+			if err := s.ackMethod(byte(AuthNoRequried)); err != nil {
 				return false, err
 			}
-			status, err := auth.Authenticate(s.Conn)
-			return status, err
+			s.setIdentity(id)
+			return true, nil
 		}
 	}
-	return false, nil
+	for _, method := range s.methods() {
+		if bytes.IndexByte(offered, byte(method)) < 0 {
+			continue
+		}
+		auth := s.srv.authenticators[method]
+		if method == AuthUserPass {
+			if err := s.checkLockout(); err != nil {
+				s.ackMethod(byte(AuthNoAccetable))
+				return false, err
+			}
+		}
+		if err := s.ackMethod(byte(method)); err != nil {
+			return false, err
+		}
+		stop := watchContext(ctx, s.Conn)
+		id, conn, err := auth.AuthenticateContext(ctx, &AuthRequest{
+			Conn:       s.Conn,
+			RemoteAddr: s.RemoteAddr(),
+			LocalAddr:  s.LocalAddr(),
+		})
+		stop()
+		if err != nil && err != io.EOF {
+			s.logf("authenticate: %v", err)
+		}
+		if id == nil {
+			return false, err
+		}
+		if conn != nil {
+			s.Conn = conn
+		}
+		s.setIdentity(id)
+		return true, err
+	}
+	if err := s.ackMethod(byte(AuthNoAccetable)); err != nil {
+		return false, err
+	}
+	return false, ErrNoAcceptableAuth
+}
+
+// Close closes the connection and ends the session of the user.
+func (s *Session) Close() error {
+	s.setIdentity(nil)
+	return s.Conn.Close()
 }
 
 func (s *Session) ackMethod(method byte) error {
@@ -75,29 +157,39 @@ func (s *Session) ackMethod(method byte) error {
 
 func (s *Session) readMethods() ([]byte, error) {
 	b := make([]byte, 1)
-	n, err := s.Read(b)
-	if err != nil {
+	if _, err := io.ReadFull(s, b); err != nil {
 		return nil, err
 	}
-	nMethods := int(n)
+	nMethods := int(b[0])
 	buf := make([]byte, nMethods)
-	_, err = io.ReadAtLeast(s.Conn, buf, nMethods)
+	_, err := io.ReadAtLeast(s.Conn, buf, nMethods)
 	return buf, err
 }
 
 // ServeRequest ...
 func (s *Session) ServeRequest(ctx context.Context) error {
-	req, err := NewReuqest(s)
+	var (
+		req *Request
+		err error
+	)
+	if s.version == Socks4Version {
+		req, err = readSocks4Request(s)
+	} else {
+		req, err = NewReuqest(s)
+	}
 	if err != nil {
 		return err
 	}
+	if err := s.authorize(req); err != nil {
+		return err
+	}
 
-	switch req.Command {
-	case CmdConnect:
+	switch {
+	case req.Command == CmdConnect:
 		err = s.handleCmdConnect(ctx, req)
-	case CmdBind:
+	case req.Command == CmdBind:
 		err = s.handleCmdBind(ctx, req)
-	case CmdUDP:
+	case req.Command == CmdUDP && s.version != Socks4Version:
 		err = s.handleCmdUDP(ctx, req)
 	default:
 		s.sendReply(ReplyInvalidCommand, nil)
@@ -140,6 +232,10 @@ func (s *Session) handleCmdConnect(ctx context.Context, req *Request) error {
 	}
 	defer target.Close()
 
+	if err := s.sendReply(ReplySuccessed, newAddrSpecFromAddr(target.LocalAddr())); err != nil {
+		return ErrSendReplyFailed
+	}
+
 	errCh := make(chan error)
 	startProxy(target, s.Conn, errCh)
 
@@ -153,40 +249,65 @@ func (s *Session) handleCmdConnect(ctx context.Context, req *Request) error {
 	return err
 }
 
+/*
+BIND is used by protocols which require the client to accept connections
+from the server, e.g. active mode FTP. The server sends two replies: the
+first one carries the address it listens on, the second one is sent once
+the host of DST.ADDR connects, and carries the address of that host.
+*/
 func (s *Session) handleCmdBind(ctx context.Context, req *Request) error {
-	target, err := s.resolverAndDialAddr(ctx, req.DestAddr)
+	expected, err := req.DestAddr.resolveIPAddr()
 	if err != nil {
-		return err
+		if rErr := s.sendReply(ReplyHostUnreachable, nil); rErr != nil {
+			return ErrSendReplyFailed
+		}
+		return ErrResolverFailed
+	}
+	// any host may connect if expected is unspecified, it is checked once
+	// connected.
+	if expected != nil && !expected.IsUnspecified() {
+		if err := s.checkACL(CmdBind, req.DestAddr, expected); err != nil {
+			return err
+		}
 	}
-	defer target.Close()
 
-	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	ln, err := net.Listen("tcp", net.JoinHostPort(s.srv.BindAddress, "0"))
 	if err != nil {
-		if rErr := s.sendReply(ReplyUnassigned, nil); rErr != nil {
+		if rErr := s.sendReply(ReplyFailure, nil); rErr != nil {
 			return ErrSendReplyFailed
 		}
-		return err
+		return ErrBindSocketFailed
 	}
+	defer ln.Close()
 
-	lnhost, lnport, _ := net.SplitHostPort(ln.Addr().String())
-	port, _ := strconv.Atoi(lnport)
-	as := &AddrSpec{
-		IP:   net.ParseIP(lnhost),
-		Port: port,
-		Type: TypeIPV4,
+	if err := s.sendReply(ReplySuccessed, s.replyAddr(ln.Addr())); err != nil {
+		return ErrSendReplyFailed
 	}
-	s.sendReply(ReplySuccessed, as)
 
-	conn, err := ln.Accept()
+	// the listener is closed as soon as the client disconnects, rather than
+	// at the end of the timeout.
+	acceptCtx, cancel := context.WithCancel(ctx)
+	stop := s.watchDisconnect(cancel)
+	conn, err := s.acceptBindPeer(acceptCtx, ln.(*net.TCPListener), expected)
+	stop()
+	cancel()
 	if err != nil {
 		if rErr := s.sendReply(ReplyFailure, nil); rErr != nil {
 			return ErrSendReplyFailed
 		}
 		return err
 	}
+	defer conn.Close()
+	peer := newAddrSpecFromAddr(conn.RemoteAddr())
+	if err := s.checkACL(CmdBind, peer, peer.IP); err != nil {
+		return err
+	}
+	if err := s.sendReply(ReplySuccessed, peer); err != nil {
+		return ErrSendReplyFailed
+	}
 
 	errCh := make(chan error)
-	startProxy(conn, target, errCh)
+	startProxy(conn, s.Conn, errCh)
 	select {
 	case <-ctx.Done():
 		s.Close()
@@ -197,181 +318,112 @@ func (s *Session) handleCmdBind(ctx context.Context, req *Request) error {
 	return err
 }
 
-/*
-Support for UDP, UDP connection lifetime must be as same as the TCP.
-The UDP request header like it:
-+----+------+------+----------+----------+----------+
-|RSV | FRAG | ATYP | DST.ADDR | DST.PORT |   DATA   |
-+----+------+------+----------+----------+----------+
-| 2  |  1   |  1   | Variable |    2     | Variable |
-+----+------+------+----------+----------+----------+
-*/
-
-type udpServer struct {
-	*net.UDPConn
-	clientAddr *net.UDPAddr
-	dstMap     map[string][]byte
-	rwmu       sync.RWMutex
-	once       sync.Once
-	doneCh     chan error
-}
-
-func newUDPServer(clientAddr *net.UDPAddr) (*udpServer, error) {
-	conn, err := net.ListenUDP("udp", &net.UDPAddr{
-		Port: 0,
-		IP:   net.ParseIP("127.0.0.1"),
-	})
-	if err != nil {
-		return nil, err
+// replyAddr is the address replied for a socket bound by the server. When
+// it listens on all interfaces, the one the client reaches the server on
+// is advertised.
+func (s *Session) replyAddr(addr net.Addr) *AddrSpec {
+	as := newAddrSpecFromAddr(addr)
+	if as.IP.IsUnspecified() {
+		if local := newAddrSpecFromAddr(s.LocalAddr()); local != nil && local.IP != nil {
+			as.IP, as.Type = local.IP, local.Type
+		}
 	}
-	return &udpServer{
-		clientAddr: clientAddr,
-		dstMap:     make(map[string][]byte),
-		UDPConn:    conn,
-		doneCh:     make(chan error, 1),
-	}, nil
+	return as
 }
 
-func (us *udpServer) run(ctx context.Context) error {
-	buf := make([]byte, 1024)
-	buf2 := make([]byte, 1024)
-	for {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case <-us.doneCh:
-			return nil
-		default:
-		}
-
-		n, addr, err := us.ReadFromUDP(buf[0:])
-		if err != nil {
-			return err
+// watchDisconnect calls cancel once the client closes the connection, until
+// stop is called. A byte the client sends meanwhile is kept for the session.
+func (s *Session) watchDisconnect(cancel context.CancelFunc) (stop func()) {
+	b := make([]byte, 1)
+	read := make(chan int, 1)
+	go func() {
+		n, err := s.Conn.Read(b)
+		if n == 0 && err != nil {
+			cancel()
 		}
-		b := buf[:n]
-		if addr.IP.String() == us.clientAddr.IP.String() && addr.Port == us.clientAddr.Port {
-			if b[2] != 0x00 {
-				// TODO: for now do not support FRAG, just log it
-				continue
-			}
-			rbuf := bytes.NewBuffer(b[3:])
-			addrSpec, err := readAddrSpec(rbuf)
-			if err != nil {
-				return err
-			}
-			dstIP, err := addrSpec.resolveIPAddr()
-			if err != nil {
-				return err
-			}
-
-			target := net.UDPAddr{
-				IP:   dstIP,
-				Port: addrSpec.Port,
-			}
-			body := rbuf.Bytes()
-			us.WriteToUDP(body, &target)
-
-			header := append([]byte(nil), buf[:n-len(body)]...)
-			us.setDestHeader(dstIP.String(), header)
-		} else {
-			if h, exist := us.getDestHeader(addr.IP.String()); exist {
-				hLen := len(h)
-				copy(buf2[0:], h[0:hLen])
-				copy(buf2[hLen:], b[0:])
-				if _, err := us.WriteToUDP(buf2[0:hLen+n], us.clientAddr); err != nil {
-					// TODO: log it
-				}
-			} else {
-				// TODO: just log it
-			}
+		read <- n
+	}()
+	return func() {
+		s.Conn.SetReadDeadline(time.Unix(1, 0))
+		n := <-read
+		s.Conn.SetReadDeadline(time.Time{})
+		if n > 0 {
+			s.Conn = newBufferedConn(s.Conn, b[:n])
 		}
 	}
 }
 
-func (us *udpServer) setDestHeader(addr string, header []byte) {
-	us.rwmu.Lock()
-	us.dstMap[addr] = header
-	us.rwmu.Unlock()
-}
-
-func (us *udpServer) getDestHeader(addr string) ([]byte, bool) {
-	us.rwmu.RLock()
-	b, exist := us.dstMap[addr]
-	us.rwmu.RUnlock()
-	return b, exist
-}
+// acceptBindPeer waits for the connection from expected, connections from
+// other hosts are closed. An unspecified expected address accepts any host.
+func (s *Session) acceptBindPeer(ctx context.Context, ln *net.TCPListener, expected net.IP) (net.Conn, error) {
+	timeout := s.srv.BindTimeout
+	if timeout == 0 {
+		timeout = defaultBindTimeout
+	}
+	if err := ln.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
 
-func (us *udpServer) keepAliveWithTCP(ctx context.Context, tcpConn *net.TCPConn) {
-	tcpConn.SetKeepAlive(true)
-	buf := make([]byte, 1024)
-	for {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
 		select {
 		case <-ctx.Done():
-			return
-		case <-us.doneCh:
-			return
-		default:
+			ln.Close()
+		case <-done:
 		}
-		_, err := tcpConn.Read(buf[0:])
+	}()
+
+	for {
+		conn, err := ln.AcceptTCP()
 		if err != nil {
-			// TODO: log the error
-			us.close()
-			return
+			return nil, err
 		}
+		peer := conn.RemoteAddr().(*net.TCPAddr)
+		if expected == nil || expected.IsUnspecified() || expected.Equal(peer.IP) {
+			return conn, nil
+		}
+		conn.Close()
 	}
 }
 
-func (us *udpServer) close() {
-	us.once.Do(func() {
-		close(us.doneCh)
-	})
-}
-
-func (s *Session) handleCmdUDP(ctx context.Context, req *Request) error {
-	dest, err := req.DestAddr.Resolve(ctx)
-	if err != nil {
-		s.sendReply(ReplyInvalidAddressType, nil)
-		return err
-	}
-	assignAddr, err := net.ResolveUDPAddr("udp", dest)
-	if err != nil {
-		s.sendReply(ReplyUnassigned, nil)
-		return err
-	}
-	udpSrv, err := newUDPServer(assignAddr)
-	if err != nil {
-		return err
-	}
-	srvAddr := udpSrv.LocalAddr()
-	lnhost, lnport, _ := net.SplitHostPort(srvAddr.String())
-	port, _ := strconv.Atoi(lnport)
-	as := AddrSpec{
-		IP:   net.ParseIP(lnhost),
-		Port: port,
-		Type: TypeIPV4,
-	}
-	s.sendReply(ReplySuccessed, &as)
-	go udpSrv.keepAliveWithTCP(ctx, s.Conn.(*net.TCPConn))
-	return udpSrv.run(ctx)
-}
-
 func (s *Session) resolverAndDialAddr(ctx context.Context, as *AddrSpec) (net.Conn, error) {
-	addr, err := as.Resolve(ctx)
-	if err != nil {
-		if rErr := s.sendReply(ReplyHostUnreachable, nil); rErr != nil {
+	ob := s.outbound(ctx, as)
+	if ob.reject {
+		if rErr := s.sendReply(ReplyNotAllowed, nil); rErr != nil {
 			return nil, ErrSendReplyFailed
 		}
-		return nil, ErrResolverFailed
+		return nil, ErrRouteRejected
 	}
 
-	dialer := net.Dialer{Timeout: s.srv.DialTimeout}
-	target, err := dialer.DialContext(ctx, "tcp", addr)
+	// the upstream proxies resolve the domain names themselves, the target
+	// may only be known in their networks.
+	addr := as.String()
+	if ob.resolve {
+		ip, err := as.resolveIPAddr()
+		if err != nil {
+			if rErr := s.sendReply(ReplyHostUnreachable, nil); rErr != nil {
+				return nil, ErrSendReplyFailed
+			}
+			return nil, ErrResolverFailed
+		}
+		// the IP dialed is checked, a domain name may resolve to another
+		// one than when the request was checked.
+		if err := s.checkACL(CmdConnect, as, ip); err != nil {
+			return nil, err
+		}
+		addr = net.JoinHostPort(ip.String(), strconv.Itoa(as.Port))
+	} else if err := s.checkRemoteACL(ctx, as); err != nil {
+		return nil, err
+	}
+
+	target, err := s.srv.dial(ctx, ob.dialer, "tcp", addr)
 	if err != nil {
 		errMsg := err.Error()
 		resp := ReplyHostUnreachable
 		if strings.Contains(errMsg, "refused") {
 			resp = ReplyConnectionRefused
-		} else if strings.Contains(errMsg, "network is unreachable") {
+		} else if strings.Contains(errMsg, "network is unreachable") || strings.Contains(errMsg, "network unreachable") {
 			resp = ReplyNetworkUnreachable
 		}
 		if rErr := s.sendReply(resp, nil); rErr != nil {
@@ -380,48 +432,55 @@ func (s *Session) resolverAndDialAddr(ctx context.Context, as *AddrSpec) (net.Co
 		}
 		return nil, ErrResolverFailed
 	}
+	if ob.proxyProtocol != 0 {
+		if err := s.sendProxyHeader(target, ob, addr); err != nil {
+			target.Close()
+			if rErr := s.sendReply(ReplyFailure, nil); rErr != nil {
+				return nil, ErrSendReplyFailed
+			}
+			return nil, err
+		}
+	}
 	return target, nil
 }
 
-func (s *Session) sendReply(code ReplyCode, addr *AddrSpec) error {
-	var (
-		addrType uint8
-		addrBody []byte
-		addrPort uint16
-	)
-	switch {
-	case addr == nil:
-		addrType = TypeIPV4
-		addrBody = []byte{0, 0, 0, 0}
-		addrPort = 0
-
-	case addr.FQDN != "":
-		addrType = addr.Type
-		addrBody = append([]byte{byte(len(addr.FQDN))}, addr.FQDN...)
-		addrPort = uint16(addr.Port)
-
-	case addr.IP.To4() != nil:
-		addrType = addr.Type
-		addrBody = addr.IP.To4()
-		addrPort = uint16(addr.Port)
-
-	case addr.IP.To16() != nil:
-		addrType = addr.Type
-		addrBody = addr.IP.To16()
-		addrPort = uint16(addr.Port)
-	default:
-		return fmt.Errorf("Invalid replied address: %v", addr)
+// sendProxyHeader sends the target dialed at addr through ob the PROXY
+// protocol header of the client.
+func (s *Session) sendProxyHeader(target net.Conn, ob *outbound, addr string) error {
+	host, port, _ := net.SplitHostPort(addr)
+	p, _ := strconv.Atoi(port)
+	ip := net.ParseIP(host)
+	if ip == nil {
+		// the destination is a domain name the upstream proxies resolve,
+		// the unspecified address of the family of the client stands for
+		// it so that the address of the client is still sent.
+		ip = net.IPv6unspecified
+		if src, ok := s.RemoteAddr().(*net.TCPAddr); ok && src.IP.To4() != nil {
+			ip = net.IPv4zero
+		}
+	}
+	dst := &net.TCPAddr{IP: ip, Port: p}
+	var tlvs []proxyTLV
+	if user := s.username(); user != "" && ob.userTLV != 0 {
+		tlvs = append(tlvs, proxyTLV{typ: ob.userTLV, value: []byte(user)})
 	}
+	_, err := target.Write(proxyHeader(ob.proxyProtocol, s.RemoteAddr(), dst, tlvs))
+	return err
+}
 
-	reply := make([]byte, 6+len(addrBody))
-	n := len(reply)
-	reply[0] = Socks5Version
-	reply[1] = byte(code)
-	reply[2] = 0
-	reply[3] = addrType
+func (s *Session) sendReply(code ReplyCode, addr *AddrSpec) error {
+	switch s.version {
+	case Socks4Version:
+		return s.sendSocks4Reply(code, addr)
+	case httpProxyVersion:
+		return s.sendHTTPReply(code)
+	}
 
-	copy(reply[4:n-2], addrBody)
-	copy(reply[n-2:], []byte{uint8(addrPort >> 8), uint8(addrPort) & 255})
-	_, err := s.Write(reply)
+	reply := &Reply{
+		Version:  Socks5Version,
+		Code:     code,
+		BindAddr: addr,
+	}
+	_, err := reply.WriteTo(s)
 	return err
 }
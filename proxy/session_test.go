@@ -5,6 +5,7 @@ import (
 	"context"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"net"
 	"strconv"
 	"testing"
@@ -14,14 +15,13 @@ import (
 )
 
 var testServer = &Server{
-	authenticators: map[AuthType]Authenticator{
-		AuthUserPass: &UserPassAuthenticator{
-			accounts: map[string]string{
-				"si.li": "1234",
-			},
-		},
+	authenticators: map[AuthType]ContextAuthenticator{
+		AuthUserPass: NewUserPassAuthenticator(NewStaticStore(map[string]string{
+			"si.li": "1234",
+		})),
 	},
 	DialTimeout: 300 * time.Millisecond,
+	BindAddress: "127.0.0.1",
 }
 
 func TestSessionAuthenticate(t *testing.T) {
@@ -70,7 +70,8 @@ func TestSession_handleCmdConnect(t *testing.T) {
 	go func() {
 		conn, err := ln.Accept()
 		if err != nil {
-			t.Fatal(err)
+			t.Error(err)
+			return
 		}
 		defer conn.Close()
 
@@ -101,6 +102,12 @@ func TestSession_handleCmdConnect(t *testing.T) {
 	_, err = client.Write(cmd)
 	assert.NoError(t, err)
 
+	reply := make([]byte, 10)
+	_, err = io.ReadFull(client, reply)
+	assert.NoError(t, err)
+	assert.Equal(t, uint8(Socks5Version), reply[0])
+	assert.Equal(t, uint8(ReplySuccessed), reply[1])
+
 	req := []byte("hello, world!")
 	_, err = client.Write(req)
 	assert.NoError(t, err)
@@ -112,55 +119,119 @@ func TestSession_handleCmdConnect(t *testing.T) {
 }
 
 func TestSession_handleCmdBind(t *testing.T) {
-	ln, err := net.Listen("tcp", "127.0.0.1:0")
-	if err != nil {
-		t.Fatal(err)
-	}
-	defer ln.Close()
-	clientListenAddr := ln.Addr().String()
-
-	result := make(chan string)
+	server, client := net.Pipe()
 	go func() {
-		conn, err := ln.Accept()
-		if err != nil {
-			t.Fatal(err)
+		defer server.Close()
+		s := &Session{
+			Conn: server,
+			srv:  testServer,
 		}
-		defer conn.Close()
-
-		req := make([]byte, 13)
-		conn.Read(req)
-		result <- string(req)
+		s.ServeRequest(context.TODO())
 	}()
+	defer client.Close()
+
+	cmd := []byte{5, 2, 0, 1, 127, 0, 0, 1, 0, 0}
+	_, err := client.Write(cmd)
+	assert.NoError(t, err)
+
+	reply1 := make([]byte, 10)
+	_, err = io.ReadFull(client, reply1)
+	assert.NoError(t, err)
+	assert.Equal(t, uint8(ReplySuccessed), reply1[1])
+	assert.Equal(t, TypeIPV4, reply1[3])
+	assert.Equal(t, []byte{127, 0, 0, 1}, reply1[4:8])
+	rport := (int(reply1[8])<<8 | int(reply1[9]))
+
+	connSrv, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", rport))
+	assert.NoError(t, err)
+	defer connSrv.Close()
+
+	// the second reply carries the address of the incoming connection
+	reply2 := make([]byte, 10)
+	_, err = io.ReadFull(client, reply2)
+	assert.NoError(t, err)
+	assert.Equal(t, uint8(ReplySuccessed), reply2[1])
+	peer := connSrv.LocalAddr().(*net.TCPAddr)
+	assert.Equal(t, peer.Port, int(reply2[8])<<8|int(reply2[9]))
 
+	connSrv.Write([]byte("hello, world!"))
+	result := make([]byte, 13)
+	_, err = io.ReadFull(client, result)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello, world!", string(result))
+}
+
+func TestSession_handleCmdBindUnexpectedPeer(t *testing.T) {
+	srv := &Server{
+		authenticators: testServer.authenticators,
+		BindAddress:    "127.0.0.1",
+		BindTimeout:    300 * time.Millisecond,
+	}
 	server, client := net.Pipe()
 	go func() {
 		defer server.Close()
 		s := &Session{
 			Conn: server,
-			srv:  testServer,
+			srv:  srv,
 		}
 		s.ServeRequest(context.TODO())
 	}()
 	defer client.Close()
 
-	_, port, _ := net.SplitHostPort(clientListenAddr)
-	nPort, _ := strconv.Atoi(port)
-	bPort := make([]byte, 2)
-	bPort[0] = uint8(nPort >> 8)
-	bPort[1] = uint8(nPort & 255)
-	cmd := []byte{5, 2, 0, 1, 127, 0, 0, 1, bPort[0], bPort[1]}
-	_, err = client.Write(cmd)
+	// only 192.0.2.1 is expected to connect
+	cmd := []byte{5, 2, 0, 1, 192, 0, 2, 1, 0, 0}
+	_, err := client.Write(cmd)
 	assert.NoError(t, err)
 
 	reply1 := make([]byte, 10)
-	client.Read(reply1)
+	_, err = io.ReadFull(client, reply1)
+	assert.NoError(t, err)
 	rport := (int(reply1[8])<<8 | int(reply1[9]))
 
-	connSrv, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", rport))
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", rport))
 	assert.NoError(t, err)
+	defer conn.Close()
 
-	connSrv.Write([]byte("hello, world!"))
-	assert.Equal(t, "hello, world!", <-result)
+	reply2 := make([]byte, 10)
+	_, err = io.ReadFull(client, reply2)
+	assert.NoError(t, err)
+	assert.Equal(t, uint8(ReplyFailure), reply2[1])
+}
+
+func TestSession_handleCmdBindClientGone(t *testing.T) {
+	srv := &Server{
+		authenticators: testServer.authenticators,
+		BindAddress:    "127.0.0.1",
+		BindTimeout:    time.Minute,
+	}
+	server, client := net.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		defer server.Close()
+		s := &Session{
+			Conn: server,
+			srv:  srv,
+		}
+		done <- s.ServeRequest(context.TODO())
+	}()
+
+	cmd := []byte{5, 2, 0, 1, 127, 0, 0, 1, 0, 0}
+	_, err := client.Write(cmd)
+	assert.NoError(t, err)
+	reply1 := make([]byte, 10)
+	_, err = io.ReadFull(client, reply1)
+	assert.NoError(t, err)
+	rport := (int(reply1[8])<<8 | int(reply1[9]))
+
+	// the listener is closed once the client is gone, before the timeout
+	client.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the BIND session outlived its client")
+	}
+	_, err = net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", rport))
+	assert.Error(t, err)
 }
 
 func TestSession_udpServer(t *testing.T) {
@@ -184,7 +255,7 @@ func TestSession_udpServer(t *testing.T) {
 		conn.WriteTo([]byte("pong"), addr)
 	}()
 
-	srv, err := newUDPServer(src)
+	srv, err := newUDPServer("127.0.0.1", src)
 	assert.NoError(t, err)
 
 	ctx := context.Background()
@@ -196,7 +267,6 @@ func TestSession_udpServer(t *testing.T) {
 	conn, err := net.DialUDP("udp", src, srvAddr)
 	assert.NoError(t, err)
 	defer conn.Close()
-	*src = *conn.LocalAddr().(*net.UDPAddr)
 
 	// client send udp packet
 	buf := new(bytes.Buffer)
@@ -240,3 +310,127 @@ func TestSession_handleCmdUDP(t *testing.T) {
 	strconv.Atoi(backendPort)
 	assert.NotNil(t, backendHost)
 }
+
+func TestSession_handleCmdUDPRemoteClient(t *testing.T) {
+	// the target echoes every datagram
+	target, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	received := make(chan string, 2)
+	go func() {
+		b := make([]byte, 1024)
+		for {
+			n, addr, err := target.ReadFromUDP(b)
+			if err != nil {
+				return
+			}
+			received <- string(b[:n])
+			target.WriteToUDP(b[:n], addr)
+		}
+	}()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		s := &Session{
+			Conn: conn,
+			srv:  testServer,
+		}
+		defer s.Close()
+		s.ServeRequest(context.TODO())
+	}()
+	ctrl, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctrl.Close()
+
+	// the client does not know its UDP address yet
+	_, err = ctrl.Write([]byte{5, 3, 0, 1, 0, 0, 0, 0, 0, 0})
+	assert.NoError(t, err)
+	reply := make([]byte, 10)
+	_, err = io.ReadFull(ctrl, reply)
+	assert.NoError(t, err)
+	assert.Equal(t, uint8(ReplySuccessed), reply[1])
+	relay := &net.UDPAddr{
+		IP:   net.IP(reply[4:8]),
+		Port: int(reply[8])<<8 | int(reply[9]),
+	}
+	assert.Equal(t, "127.0.0.1", relay.IP.String())
+
+	dst := target.LocalAddr().(*net.UDPAddr)
+	header := []byte{0, 0, 0, 1, 127, 0, 0, 1, uint8(dst.Port >> 8), uint8(dst.Port & 255)}
+
+	client, err := net.DialUDP("udp", nil, relay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.Write(append(header, "ping"...))
+	b := make([]byte, 1024)
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := client.Read(b)
+	assert.NoError(t, err)
+	assert.Equal(t, append(header, "ping"...), b[:n])
+	assert.Equal(t, "ping", <-received)
+
+	// another socket of the same host is not the learned client
+	other, err := net.DialUDP("udp", nil, relay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	other.Write(append(header, "pong"...))
+	select {
+	case msg := <-received:
+		t.Errorf("unexpected relayed datagram %q", msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestSession_udpServerFragments(t *testing.T) {
+	target, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+
+	srv, err := newUDPServer("127.0.0.1", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.close()
+	go srv.run(context.Background())
+
+	conn, err := net.DialUDP("udp", nil, srv.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	dst := target.LocalAddr().(*net.UDPAddr)
+	for i, data := range []string{"frag", "mented"} {
+		frag := uint8(i + 1)
+		if i == 1 {
+			frag |= 0x80
+		}
+		header := []byte{0, 0, frag, 1, 127, 0, 0, 1, uint8(dst.Port >> 8), uint8(dst.Port & 255)}
+		conn.Write(append(header, data...))
+	}
+
+	b := make([]byte, 1024)
+	target.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := target.ReadFromUDP(b)
+	assert.NoError(t, err)
+	assert.Equal(t, "fragmented", string(b[:n]))
+}
@@ -0,0 +1,195 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+// SHA-crypt is the "$5$" (SHA-256) and "$6$" (SHA-512) password scheme of
+// glibc crypt(3), see https://www.akkadia.org/drepper/SHA-crypt.txt.
+const (
+	shaCryptSaltLen       = 16
+	shaCryptDefaultRounds = 5000
+	shaCryptMinRounds     = 1000
+	shaCryptMaxRounds     = 999999999
+)
+
+const cryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+var errInvalidSHACrypt = errors.New("socks: invalid SHA-crypt hash")
+
+type shaCryptScheme struct {
+	prefix string
+	new    func() hash.Hash
+	// order is the order the bytes of the digest are encoded in, by groups
+	// of three.
+	order []int
+}
+
+var (
+	sha256Crypt = &shaCryptScheme{
+		prefix: "$5$",
+		new:    sha256.New,
+		order: []int{
+			0, 10, 20, 21, 1, 11, 12, 22, 2, 3, 13, 23, 24, 4, 14,
+			15, 25, 5, 6, 16, 26, 27, 7, 17, 18, 28, 8, 9, 19, 29,
+			31, 30,
+		},
+	}
+	sha512Crypt = &shaCryptScheme{
+		prefix: "$6$",
+		new:    sha512.New,
+		order: []int{
+			0, 21, 42, 22, 43, 1, 44, 2, 23, 3, 24, 45, 25, 46, 4,
+			47, 5, 26, 6, 27, 48, 28, 49, 7, 50, 8, 29, 9, 30, 51,
+			31, 52, 10, 53, 11, 32, 12, 33, 54, 34, 55, 13, 56, 14, 35,
+			15, 36, 57, 37, 58, 16, 59, 17, 38, 18, 39, 60, 40, 61, 19,
+			62, 20, 41, 63,
+		},
+	}
+)
+
+// crypt hashes password with the settings of setting, i.e. the prefix, the
+// optional "rounds=N$" and the salt, which may be followed by a hash.
+func (sc *shaCryptScheme) crypt(password []byte, setting string) (string, error) {
+	if !strings.HasPrefix(setting, sc.prefix) {
+		return "", errInvalidSHACrypt
+	}
+	setting = setting[len(sc.prefix):]
+	rounds, customRounds := shaCryptDefaultRounds, false
+	if strings.HasPrefix(setting, "rounds=") {
+		i := strings.IndexByte(setting, '$')
+		if i < 0 {
+			return "", errInvalidSHACrypt
+		}
+		n, err := strconv.Atoi(setting[len("rounds="):i])
+		if err != nil || n < 0 {
+			return "", errInvalidSHACrypt
+		}
+		rounds, customRounds = n, true
+		if rounds < shaCryptMinRounds {
+			rounds = shaCryptMinRounds
+		} else if rounds > shaCryptMaxRounds {
+			rounds = shaCryptMaxRounds
+		}
+		setting = setting[i+1:]
+	}
+	salt := setting
+	if i := strings.IndexByte(salt, '$'); i >= 0 {
+		salt = salt[:i]
+	}
+	if len(salt) > shaCryptSaltLen {
+		salt = salt[:shaCryptSaltLen]
+	}
+
+	digest := sc.digest(password, []byte(salt), rounds)
+	var b strings.Builder
+	b.WriteString(sc.prefix)
+	if customRounds {
+		b.WriteString("rounds=" + strconv.Itoa(rounds) + "$")
+	}
+	b.WriteString(salt + "$")
+	b.WriteString(sc.encode(digest))
+	return b.String(), nil
+}
+
+func (sc *shaCryptScheme) digest(password, salt []byte, rounds int) []byte {
+	h := sc.new()
+	size := h.Size()
+
+	h.Write(password)
+	h.Write(salt)
+	h.Write(password)
+	alt := h.Sum(nil)
+
+	h.Reset()
+	h.Write(password)
+	h.Write(salt)
+	h.Write(repeatBytes(alt, len(password)))
+	for n := len(password); n > 0; n >>= 1 {
+		if n&1 != 0 {
+			h.Write(alt)
+		} else {
+			h.Write(password)
+		}
+	}
+	a := h.Sum(nil)
+
+	h.Reset()
+	for i := 0; i < len(password); i++ {
+		h.Write(password)
+	}
+	p := repeatBytes(h.Sum(nil), len(password))
+
+	h.Reset()
+	for i := 0; i < 16+int(a[0]); i++ {
+		h.Write(salt)
+	}
+	s := repeatBytes(h.Sum(nil), len(salt))
+
+	c := a
+	for i := 0; i < rounds; i++ {
+		h.Reset()
+		if i&1 != 0 {
+			h.Write(p)
+		} else {
+			h.Write(c[:size])
+		}
+		if i%3 != 0 {
+			h.Write(s)
+		}
+		if i%7 != 0 {
+			h.Write(p)
+		}
+		if i&1 != 0 {
+			h.Write(c[:size])
+		} else {
+			h.Write(p)
+		}
+		c = h.Sum(c[:0])
+	}
+	return c
+}
+
+// encode encodes the digest in the order of the scheme, 4 characters for
+// every 3 bytes, the least significant bits first.
+func (sc *shaCryptScheme) encode(digest []byte) string {
+	var b strings.Builder
+	order := sc.order
+	for len(order) > 0 {
+		var w uint32
+		n := 4
+		switch len(order) {
+		case 1:
+			w, n = uint32(digest[order[0]]), 2
+			order = nil
+		case 2:
+			w, n = uint32(digest[order[0]])<<8|uint32(digest[order[1]]), 3
+			order = nil
+		default:
+			w = uint32(digest[order[0]])<<16 | uint32(digest[order[1]])<<8 | uint32(digest[order[2]])
+			order = order[3:]
+		}
+		for ; n > 0; n-- {
+			b.WriteByte(cryptAlphabet[w&0x3f])
+			w >>= 6
+		}
+	}
+	return b.String()
+}
+
+// repeatBytes repeats b up to n bytes.
+func repeatBytes(b []byte, n int) []byte {
+	out := make([]byte, 0, n)
+	for len(out) < n {
+		if n-len(out) < len(b) {
+			b = b[:n-len(out)]
+		}
+		out = append(out, b...)
+	}
+	return out
+}
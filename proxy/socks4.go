@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net"
+)
+
+// Socks4Version ...
+const Socks4Version = uint8(0x4)
+
+// SOCKS4 reply codes
+const (
+	Socks4Granted          = uint8(0x5A)
+	Socks4Rejected         = uint8(0x5B)
+	Socks4IdentUnreachable = uint8(0x5C)
+	Socks4IdentMismatch    = uint8(0x5D)
+)
+
+const (
+	socks4ReplyVersion = uint8(0x00)
+	socks4MaxFieldLen  = 255
+)
+
+// errors
+var (
+	ErrSocks4FieldTooLong = errors.New("socks4: USERID or hostname too long")
+)
+
+/*
+The SOCKS4 request is sent right after the version byte:
+
+	+----+----+----+----+----+----+----+----+----+----+....+----+
+	| VN | CD | DSTPORT |      DSTIP        | USERID       |NULL|
+	+----+----+----+----+----+----+----+----+----+----+....+----+
+	   1    1      2              4           variable       1
+
+SOCKS4a sets DSTIP to 0.0.0.x (x != 0) and appends the hostname, also
+terminated by NULL, after the USERID.
+*/
+func readSocks4Request(r io.Reader) (*Request, error) {
+	header := make([]byte, 7)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	userID, err := readNullTerminated(r)
+	if err != nil {
+		return nil, err
+	}
+	dest := &AddrSpec{
+		Port: int(header[1])<<8 | int(header[2]),
+	}
+	if isSocks4aIP(header[3:7]) {
+		host, err := readNullTerminated(r)
+		if err != nil {
+			return nil, err
+		}
+		dest.FQDN = host
+		dest.Type = TypeFQDN
+	} else {
+		dest.IP = net.IPv4(header[3], header[4], header[5], header[6])
+		dest.Type = TypeIPV4
+	}
+	req := &Request{
+		Version:  Socks4Version,
+		Command:  header[0],
+		DestAddr: dest,
+		UserID:   userID,
+	}
+	return req, nil
+}
+
+// isSocks4aIP reports whether ip is 0.0.0.x with x != 0.
+func isSocks4aIP(ip []byte) bool {
+	return ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0
+}
+
+func readNullTerminated(r io.Reader) (string, error) {
+	var (
+		buf []byte
+		b   = make([]byte, 1)
+	)
+	for {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", err
+		}
+		if b[0] == 0 {
+			return string(buf), nil
+		}
+		if len(buf) >= socks4MaxFieldLen {
+			return "", ErrSocks4FieldTooLong
+		}
+		buf = append(buf, b[0])
+	}
+}
+
+/*
+The SOCKS4 reply, DSTPORT and DSTIP are only meaningful for BIND:
+
+	+----+----+----+----+----+----+----+----+
+	| VN | CD | DSTPORT |      DSTIP        |
+	+----+----+----+----+----+----+----+----+
+	   1    1      2              4
+*/
+func (s *Session) sendSocks4Reply(code ReplyCode, addr *AddrSpec) error {
+	reply := make([]byte, 8)
+	reply[0] = socks4ReplyVersion
+	reply[1] = Socks4Rejected
+	if code == ReplySuccessed {
+		reply[1] = Socks4Granted
+	}
+	if addr != nil {
+		reply[2] = uint8(addr.Port >> 8)
+		reply[3] = uint8(addr.Port & 255)
+		// An IPv6 or FQDN address can not be carried, leaving 0.0.0.0
+		// tells the client to use the address of the SOCKS server.
+		if ip4 := addr.IP.To4(); ip4 != nil {
+			copy(reply[4:], ip4)
+		}
+	}
+	_, err := s.Write(reply)
+	return err
+}
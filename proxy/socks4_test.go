@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_readSocks4Request(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     []byte
+		wantErr  bool
+		wantCmd  uint8
+		wantIP   string
+		wantFQDN string
+		wantPort int
+		wantUser string
+	}{
+		{
+			name:     "socks4_connect",
+			data:     []byte{1, 4, 56, 127, 0, 0, 1, 'b', 'o', 'b', 0},
+			wantCmd:  CmdConnect,
+			wantIP:   "127.0.0.1",
+			wantPort: 1080,
+			wantUser: "bob",
+		},
+		{
+			name:     "socks4a_bind",
+			data:     append([]byte{2, 0, 80, 0, 0, 0, 1, 0}, []byte("example.com\x00")...),
+			wantCmd:  CmdBind,
+			wantFQDN: "example.com",
+			wantPort: 80,
+		},
+		{
+			name:    "missing_null",
+			data:    []byte{1, 0, 80, 127, 0, 0, 1, 'b'},
+			wantErr: true,
+		},
+		{
+			name:    "userid_too_long",
+			data:    append([]byte{1, 0, 80, 127, 0, 0, 1}, bytes.Repeat([]byte{'a'}, 300)...),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := readSocks4Request(bytes.NewBuffer(tt.data))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readSocks4Request() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			assert.Equal(t, Socks4Version, req.Version)
+			assert.Equal(t, tt.wantCmd, req.Command)
+			assert.Equal(t, tt.wantFQDN, req.DestAddr.FQDN)
+			if tt.wantIP != "" {
+				assert.Equal(t, tt.wantIP, req.DestAddr.IP.String())
+			}
+			assert.Equal(t, tt.wantPort, req.DestAddr.Port)
+			assert.Equal(t, tt.wantUser, req.UserID)
+		})
+	}
+}
+
+func TestSession_socks4Connect(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	server, client := net.Pipe()
+	go func() {
+		defer server.Close()
+		s := &Session{
+			Conn:    server,
+			srv:     testServer,
+			version: Socks4Version,
+		}
+		s.ServeRequest(context.TODO())
+	}()
+	defer client.Close()
+
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	nPort, _ := strconv.Atoi(port)
+	cmd := []byte{1, uint8(nPort >> 8), uint8(nPort & 255)}
+	cmd = append(cmd, 0, 0, 0, 1, 0)
+	cmd = append(cmd, []byte("localhost\x00")...)
+	_, err = client.Write(cmd)
+	assert.NoError(t, err)
+
+	reply := make([]byte, 8)
+	_, err = io.ReadFull(client, reply)
+	assert.NoError(t, err)
+	assert.Equal(t, uint8(0), reply[0])
+	assert.Equal(t, Socks4Granted, reply[1])
+
+	_, err = client.Write([]byte("ping"))
+	assert.NoError(t, err)
+	rsp := make([]byte, 4)
+	_, err = io.ReadFull(client, rsp)
+	assert.NoError(t, err)
+	assert.Equal(t, "ping", string(rsp))
+}
+
+func TestServer_socks4RequiresNoAuth(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+
+	testServer.waitConns.Add(1)
+	go testServer.serveSession(context.TODO(), server, nil)
+
+	_, err := client.Write([]byte{4})
+	assert.NoError(t, err)
+	reply := make([]byte, 8)
+	_, err = io.ReadFull(client, reply)
+	assert.NoError(t, err)
+	assert.Equal(t, Socks4Rejected, reply[1])
+}
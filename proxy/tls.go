@@ -0,0 +1,298 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/remones/gsocks/config"
+)
+
+// The identities of the clients with a verified certificate.
+const (
+	// TLSIdentitySubject is the common name of the subject
+	TLSIdentitySubject = "subject"
+	// TLSIdentitySAN is the first email address, DNS name or URI of the
+	// subject alternative names.
+	TLSIdentitySAN = "san"
+)
+
+const defaultTLSHandshakeTimeout = 10 * time.Second
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// newTLSConfig creates the TLS config of the listener, nil if TLS is not
+// enabled.
+func newTLSConfig(cfg *config.TLS) (*tls.Config, error) {
+	if cfg == nil || !cfg.Enable {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+		NextProtos:   cfg.ALPN,
+	}
+	if v, ok := tlsVersions[cfg.MinVersion]; ok {
+		tlsConfig.MinVersion = v
+	}
+	if cfg.ClientCA != "" {
+		pool, err := loadCertPool(cfg.ClientCA)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		if cfg.RequireClientCert {
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return tlsConfig, nil
+}
+
+// tlsReloader reloads the certificate and the client CAs of the listener
+// from their files, the new ones only apply to the next handshakes.
+type tlsReloader struct {
+	cfg *config.TLS
+	// interval is how often the files are checked for changes, they are
+	// only reloaded by ReloadTLS if 0.
+	interval time.Duration
+	logf     func(format string, args ...interface{})
+	mu       sync.Mutex
+	current  *tls.Config
+	stamps   []fileStamp
+}
+
+// fileStamp is the modification time and size of a file, which change when
+// it is rewritten or replaced.
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func newTLSReloader(cfg *config.TLS) (*tlsReloader, error) {
+	tlsConfig, err := newTLSConfig(cfg)
+	if tlsConfig == nil {
+		return nil, err
+	}
+	r := &tlsReloader{
+		cfg:      cfg,
+		interval: time.Duration(cfg.ReloadInterval) * time.Millisecond,
+		current:  tlsConfig,
+	}
+	r.stamps, _ = r.stat()
+	return r, nil
+}
+
+// files are the files of the certificate and the client CAs
+func (r *tlsReloader) files() []string {
+	files := []string{r.cfg.CertFile, r.cfg.KeyFile}
+	if r.cfg.ClientCA != "" {
+		files = append(files, r.cfg.ClientCA)
+	}
+	return files
+}
+
+func (r *tlsReloader) stat() ([]fileStamp, error) {
+	files := r.files()
+	stamps := make([]fileStamp, len(files))
+	for i, file := range files {
+		fi, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		stamps[i] = fileStamp{modTime: fi.ModTime(), size: fi.Size()}
+	}
+	return stamps, nil
+}
+
+// tlsConfig is the config of the listener, which hands every handshake the
+// config of the last certificate and client CAs loaded.
+func (r *tlsReloader) tlsConfig() *tls.Config {
+	r.mu.Lock()
+	tlsConfig := r.current.Clone()
+	r.mu.Unlock()
+	tlsConfig.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		return r.current, nil
+	}
+	return tlsConfig
+}
+
+// reload loads the files again, the previous certificate and client CAs are
+// kept if they fail to load.
+func (r *tlsReloader) reload() error {
+	stamps, _ := r.stat()
+	tlsConfig, err := newTLSConfig(r.cfg)
+	if err != nil {
+		return fmt.Errorf("socks: reload tls: %w", err)
+	}
+	r.mu.Lock()
+	r.current = tlsConfig
+	r.stamps = stamps
+	r.mu.Unlock()
+	return nil
+}
+
+// changed checks whether a file changed since it was last loaded. A file
+// missing, e.g. while it is replaced, is checked again later.
+func (r *tlsReloader) changed() bool {
+	stamps, err := r.stat()
+	if err != nil {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(stamps) != len(r.stamps) {
+		return true
+	}
+	for i := range stamps {
+		if !stamps[i].modTime.Equal(r.stamps[i].modTime) || stamps[i].size != r.stamps[i].size {
+			return true
+		}
+	}
+	return false
+}
+
+// watch reloads the files once they change, until done is closed.
+func (r *tlsReloader) watch(done <-chan struct{}) {
+	if r.interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		if !r.changed() {
+			continue
+		}
+		if err := r.reload(); err != nil {
+			r.logf("%v", err)
+			// do not retry the same files every tick
+			r.mu.Lock()
+			r.stamps, _ = r.stat()
+			r.mu.Unlock()
+		}
+	}
+}
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("socks: no certificate in %s", file)
+	}
+	return pool, nil
+}
+
+// handshakeTLS runs the handshake of a TLS client of ep within the handshake
+// timeout.
+func (srv *Server) handshakeTLS(ctx context.Context, conn *tls.Conn, ep *endpoint) error {
+	timeout := srv.TLSHandshakeTimeout
+	if ep != nil {
+		timeout = ep.tlsHandshakeTimeout
+	}
+	if timeout <= 0 {
+		timeout = defaultTLSHandshakeTimeout
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	stop := watchContext(ctx, conn)
+	err := conn.Handshake()
+	stop()
+	conn.SetDeadline(time.Time{})
+	return err
+}
+
+// certIdentity is the identity of the verified certificate of the client, nil
+// if it has none or the server does not authenticate the clients with it.
+func (s *Session) certIdentity() *Identity {
+	mode := s.srv.TLSClientIdentity
+	if s.endpoint != nil {
+		mode = s.endpoint.tlsClientIdentity
+	}
+	if mode == "" {
+		return nil
+	}
+	tc, ok := baseConn(s.Conn).(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	state := tc.ConnectionState()
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return certificateIdentity(state.VerifiedChains[0][0], mode)
+}
+
+// certificateIdentity is the identity of cert named by its subject or its
+// SAN, its groups are the organizational units of the subject.
+func certificateIdentity(cert *x509.Certificate, mode string) *Identity {
+	var name string
+	switch mode {
+	case TLSIdentitySubject:
+		name = cert.Subject.CommonName
+	case TLSIdentitySAN:
+		switch {
+		case len(cert.EmailAddresses) > 0:
+			name = cert.EmailAddresses[0]
+		case len(cert.DNSNames) > 0:
+			name = cert.DNSNames[0]
+		case len(cert.URIs) > 0:
+			name = cert.URIs[0].String()
+		}
+	}
+	if name == "" {
+		return nil
+	}
+	return &Identity{
+		Username: name,
+		Groups:   cert.Subject.OrganizationalUnit,
+		Attributes: map[string]string{
+			"subject": cert.Subject.String(),
+			"issuer":  cert.Issuer.String(),
+			"serial":  cert.SerialNumber.Text(16),
+		},
+		Method: AuthNoRequried,
+	}
+}
+
+// connIdentity is the identity the connection of the client authenticates,
+// of its certificate or of the user of its process.
+func (s *Session) connIdentity() *Identity {
+	if id := s.certIdentity(); id != nil {
+		return id
+	}
+	return s.peerIdentity()
+}
+
+// authenticateConn serves the session as the identity of the connection of
+// the client, if it has one.
+func (s *Session) authenticateConn() bool {
+	id := s.connIdentity()
+	if id == nil {
+		return false
+	}
+	s.setIdentity(id)
+	return true
+}
@@ -0,0 +1,175 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/remones/gsocks/config"
+	"github.com/stretchr/testify/assert"
+)
+
+// writeTestCertificate writes the certificate and the key of cert to dir.
+func writeTestCertificate(t *testing.T, dir string, cert tls.Certificate, certPEM []byte) (certFile, keyFile string) {
+	der, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	tlsConfig, err := newTLSConfig(&config.TLS{Enable: false})
+	assert.NoError(t, err)
+	assert.Nil(t, tlsConfig)
+
+	cert, certPEM := newTestCertificate(t)
+	certFile, keyFile := writeTestCertificate(t, t.TempDir(), cert, certPEM)
+	tlsConfig, err = newTLSConfig(&config.TLS{
+		Enable:            true,
+		CertFile:          certFile,
+		KeyFile:           keyFile,
+		ClientCA:          certFile,
+		RequireClientCert: true,
+		MinVersion:        "1.3",
+		ALPN:              []string{"socks5"},
+	})
+	if assert.NoError(t, err) {
+		assert.Len(t, tlsConfig.Certificates, 1)
+		assert.Equal(t, uint16(tls.VersionTLS13), tlsConfig.MinVersion)
+		assert.Equal(t, tls.RequireAndVerifyClientCert, tlsConfig.ClientAuth)
+		assert.Equal(t, []string{"socks5"}, tlsConfig.NextProtos)
+	}
+
+	_, err = newTLSConfig(&config.TLS{Enable: true, CertFile: certFile, KeyFile: keyFile, ClientCA: keyFile})
+	assert.Error(t, err)
+}
+
+func TestSession_AuthenticateCert(t *testing.T) {
+	cert, certPEM := newTestCertificate(t)
+	certFile, keyFile := writeTestCertificate(t, t.TempDir(), cert, certPEM)
+	cfg := config.NewConfig()
+	cfg.Auth.NoRequired = nil
+	cfg.TLS = &config.TLS{
+		Enable:         true,
+		CertFile:       certFile,
+		KeyFile:        keyFile,
+		ClientCA:       certFile,
+		ClientIdentity: TLSIdentitySAN,
+	}
+	srv, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(certPEM)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	for _, withCert := range []bool{true, false} {
+		// net.Pipe would block on the session tickets of TLS 1.3
+		client, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		server, err := ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		clientConfig := &tls.Config{RootCAs: roots, ServerName: "localhost"}
+		if withCert {
+			clientConfig.Certificates = []tls.Certificate{cert}
+		}
+		tc := tls.Client(client, clientConfig)
+		reply := make(chan []byte, 1)
+		go func() {
+			tc.Write([]byte{1, byte(AuthNoRequried)})
+			b := make([]byte, 2)
+			io.ReadFull(tc, b)
+			reply <- b
+		}()
+		sc := tls.Server(server, srv.TLSConfig)
+		if err := srv.handshakeTLS(context.Background(), sc, nil); err != nil {
+			t.Fatal(err)
+		}
+		s := srv.newSession(sc, Socks5Version)
+		ok, err := s.AuthenticateContext(context.Background())
+		if withCert {
+			assert.NoError(t, err)
+			assert.True(t, ok)
+			assert.Equal(t, []byte{Socks5Version, byte(AuthNoRequried)}, <-reply)
+			assert.Equal(t, "localhost", s.username())
+			assert.Equal(t, "CN=gsocks test", s.identity.Attributes["subject"])
+		} else {
+			assert.Equal(t, ErrNoAcceptableAuth, err)
+			assert.False(t, ok)
+			assert.Equal(t, []byte{Socks5Version, byte(AuthNoAccetable)}, <-reply)
+		}
+		s.Close()
+		tc.Close()
+	}
+}
+
+func TestTLSReloader(t *testing.T) {
+	dir := t.TempDir()
+	cert, certPEM := newTestCertificate(t)
+	certFile, keyFile := writeTestCertificate(t, dir, cert, certPEM)
+	r, err := newTLSReloader(&config.TLS{Enable: true, CertFile: certFile, KeyFile: keyFile, ReloadInterval: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var logged int32
+	r.logf = func(string, ...interface{}) { atomic.AddInt32(&logged, 1) }
+	tlsConfig := r.tlsConfig()
+	served := func() []byte {
+		c, err := tlsConfig.GetConfigForClient(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c.Certificates[0].Certificate[0]
+	}
+	assert.Equal(t, cert.Certificate[0], served())
+	assert.False(t, r.changed())
+
+	done := make(chan struct{})
+	defer close(done)
+	go r.watch(done)
+
+	// the new certificate is served once the files change
+	cert2, certPEM2 := newTestCertificate(t)
+	writeTestCertificate(t, dir, cert2, certPEM2)
+	assert.Eventually(t, func() bool {
+		return bytes.Equal(cert2.Certificate[0], served())
+	}, 2*time.Second, 10*time.Millisecond)
+
+	// a broken certificate keeps the previous one
+	if err := ioutil.WriteFile(certFile, []byte("broken"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt32(&logged) > 0
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.Error(t, r.reload())
+	assert.Equal(t, cert2.Certificate[0], served())
+}
@@ -0,0 +1,480 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// UDP filtering behaviours of the relay, see RFC 4787 section 5
+const (
+	UDPFilterAddressAndPortDependent = "address-and-port-dependent"
+	UDPFilterAddressDependent        = "address-dependent"
+	UDPFilterEndpointIndependent     = "endpoint-independent"
+)
+
+const (
+	udpBufSize = 64 * 1024
+	// udpMaxHeader is the longest UDP request header, with a FQDN of 255
+	// octets.
+	udpMaxHeader             = 4 + 1 + 255 + 2
+	maxUDPMappings           = 1024
+	defaultUDPMappingTimeout = 2 * time.Minute
+)
+
+// errors
+var (
+	ErrUDPMappingLimit = errors.New("socks: too many UDP mappings")
+	ErrUDPRelayClosed  = errors.New("socks: UDP relay closed")
+)
+
+/*
+Support for UDP, UDP connection lifetime must be as same as the TCP.
+The UDP request header like it:
++----+------+------+----------+----------+----------+
+|RSV | FRAG | ATYP | DST.ADDR | DST.PORT |   DATA   |
++----+------+------+----------+----------+----------+
+| 2  |  1   |  1   | Variable |    2     | Variable |
++----+------+------+----------+----------+----------+
+
+The relay keeps a NAT table of the client: every destination (ip, port) is
+mapped to a socket of its own, so the replies are told apart by the socket
+they arrive on. A mapping expires when no datagram passed it for the
+mapping timeout.
+*/
+type udpServer struct {
+	*net.UDPConn
+	clientAddr *net.UDPAddr
+	frags      *reassembler
+	// filter is one of the UDPFilter* behaviours, address and port
+	// dependent if empty.
+	filter string
+	// allow drops the datagrams to the denied destinations if not nil
+	allow   func(dest *AddrSpec, ip net.IP) bool
+	timeout time.Duration
+	// listenPacket makes the socket of the mapping of dest
+	listenPacket func(dest *AddrSpec) (net.PacketConn, error)
+
+	mu       sync.Mutex
+	mappings map[string]*udpMapping
+	closed   bool
+	once     sync.Once
+	doneCh   chan error
+}
+
+// udpMapping is the NAT mapping of one destination.
+type udpMapping struct {
+	// accessed atomically, keep them 64-bit aligned
+	packetsOut uint64
+	bytesOut   uint64
+	packetsIn  uint64
+	bytesIn    uint64
+	filtered   uint64
+	lastActive int64
+
+	conn    net.PacketConn
+	key     string
+	dest    *net.UDPAddr
+	header  []byte
+	created time.Time
+}
+
+// UDPMappingStats is the statistics of a NAT mapping of the UDP relay. Out
+// counts the datagrams from the client to the destination, In the replies.
+type UDPMappingStats struct {
+	Client      net.Addr
+	Destination net.Addr
+	// Relay is the address the datagrams to the destination are sent from
+	Relay      net.Addr
+	Created    time.Time
+	LastActive time.Time
+	PacketsOut uint64
+	BytesOut   uint64
+	PacketsIn  uint64
+	BytesIn    uint64
+	// Filtered is the number of datagrams dropped by the filtering
+	Filtered uint64
+}
+
+// newUDPServer listens on host for the datagrams of clientAddr. The port of
+// clientAddr may be 0, it is learned from the first datagram of the client.
+func newUDPServer(host string, clientAddr *net.UDPAddr) (*udpServer, error) {
+	laddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return nil, err
+	}
+	client := *clientAddr
+	return &udpServer{
+		clientAddr:   &client,
+		frags:        newReassembler(0, 0),
+		timeout:      defaultUDPMappingTimeout,
+		listenPacket: listenUDP,
+		mappings:     make(map[string]*udpMapping),
+		UDPConn:      conn,
+		doneCh:       make(chan error, 1),
+	}, nil
+}
+
+// listenUDP makes the socket of a mapping reaching the destination directly.
+func listenUDP(dest *AddrSpec) (net.PacketConn, error) {
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (us *udpServer) run(ctx context.Context) error {
+	buf := make([]byte, udpBufSize)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-us.doneCh:
+			return nil
+		default:
+		}
+
+		n, addr, err := us.ReadFromUDP(buf[0:])
+		if err != nil {
+			select {
+			case <-us.doneCh:
+				return nil
+			default:
+			}
+			return err
+		}
+		// replies arrive on the sockets of the mappings, nothing but the
+		// client is expected here.
+		if !us.fromClient(addr) {
+			continue
+		}
+		us.relayToTarget(buf[:n])
+	}
+}
+
+// relayToTarget sends the datagram b of the client to its destination,
+// malformed datagrams are dropped.
+func (us *udpServer) relayToTarget(b []byte) {
+	if len(b) < 4 {
+		return
+	}
+	rbuf := bytes.NewBuffer(b[3:])
+	addrSpec, err := readAddrSpec(rbuf)
+	if err != nil {
+		return
+	}
+	body := rbuf.Bytes()
+	header := append([]byte(nil), b[:len(b)-len(body)]...)
+	if frag := header[2]; frag != 0x00 {
+		var done bool
+		if body, done = us.frags.add(string(header[3:]), frag, body, time.Now()); !done {
+			return
+		}
+		header[2] = 0x00
+	}
+	dstIP, err := addrSpec.resolveIPAddr()
+	if err != nil {
+		return
+	}
+	if us.allow != nil && !us.allow(addrSpec, dstIP) {
+		return
+	}
+
+	m, err := us.mapping(addrSpec, &net.UDPAddr{IP: dstIP, Port: addrSpec.Port}, header)
+	if err != nil {
+		return
+	}
+	if _, err := m.conn.WriteTo(body, m.dest); err != nil {
+		return
+	}
+	atomic.AddUint64(&m.packetsOut, 1)
+	atomic.AddUint64(&m.bytesOut, uint64(len(body)))
+	m.touch(time.Now())
+}
+
+// fromClient reports whether addr is the client. Datagrams of other hosts,
+// including other ports of the client host, are not relayed to targets.
+func (us *udpServer) fromClient(addr *net.UDPAddr) bool {
+	if !us.clientAddr.IP.Equal(addr.IP) {
+		return false
+	}
+	if us.clientAddr.Port == 0 {
+		us.clientAddr.Port = addr.Port
+		return true
+	}
+	return us.clientAddr.Port == addr.Port
+}
+
+// mapping returns the mapping of dest, it is created with the reply header
+// header if not exist. as is dest as the client addressed it.
+func (us *udpServer) mapping(as *AddrSpec, dest *net.UDPAddr, header []byte) (*udpMapping, error) {
+	key := dest.String()
+	us.mu.Lock()
+	m, ok := us.mappings[key]
+	n := len(us.mappings)
+	us.mu.Unlock()
+	if ok {
+		return m, nil
+	}
+	if n >= maxUDPMappings {
+		return nil, ErrUDPMappingLimit
+	}
+
+	// the socket may be associated with an upstream proxy, which takes a
+	// while, so it is made without the lock. Only the run loop creates
+	// mappings.
+	conn, err := us.listenPacket(as)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	m = &udpMapping{
+		conn:       conn,
+		key:        key,
+		dest:       dest,
+		header:     header,
+		created:    now,
+		lastActive: now.UnixNano(),
+	}
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	if us.closed {
+		conn.Close()
+		return nil, ErrUDPRelayClosed
+	}
+	us.mappings[key] = m
+	go us.serveMapping(m)
+	return m, nil
+}
+
+// serveMapping relays the replies arriving on the socket of m to the client
+// until the mapping expires or the relay is closed.
+func (us *udpServer) serveMapping(m *udpMapping) {
+	defer us.removeMapping(m)
+
+	// the payload is read behind the room of the longest header, so the
+	// header is put in front of it without copying the payload.
+	buf := make([]byte, udpMaxHeader+udpBufSize)
+	for {
+		m.conn.SetReadDeadline(m.lastActiveTime().Add(us.timeout))
+		n, addr, err := m.conn.ReadFrom(buf[udpMaxHeader:])
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				if time.Since(m.lastActiveTime()) >= us.timeout {
+					return
+				}
+				continue
+			}
+			return
+		}
+		// the sources replied by upstream proxies may be domain names
+		src, _ := addr.(*net.UDPAddr)
+		if !us.allowed(m, src) {
+			atomic.AddUint64(&m.filtered, 1)
+			continue
+		}
+		header := m.header
+		if src == nil || !src.IP.Equal(m.dest.IP) || src.Port != m.dest.Port {
+			header = udpHeader(addr)
+		}
+		start := udpMaxHeader - len(header)
+		copy(buf[start:], header)
+		if _, err := us.WriteToUDP(buf[start:udpMaxHeader+n], us.clientAddr); err != nil {
+			// TODO: log it
+			continue
+		}
+		atomic.AddUint64(&m.packetsIn, 1)
+		atomic.AddUint64(&m.bytesIn, uint64(n))
+		m.touch(time.Now())
+	}
+}
+
+// allowed reports whether the datagram from addr passes the filtering of m,
+// addr is nil if it is not an IP address.
+func (us *udpServer) allowed(m *udpMapping, addr *net.UDPAddr) bool {
+	switch {
+	case us.filter == UDPFilterEndpointIndependent:
+		return true
+	case addr == nil:
+		return false
+	case us.filter == UDPFilterAddressDependent:
+		return addr.IP.Equal(m.dest.IP)
+	}
+	return addr.IP.Equal(m.dest.IP) && addr.Port == m.dest.Port
+}
+
+func (us *udpServer) removeMapping(m *udpMapping) {
+	us.mu.Lock()
+	if us.mappings[m.key] == m {
+		delete(us.mappings, m.key)
+	}
+	us.mu.Unlock()
+	m.conn.Close()
+}
+
+// stats returns the statistics of the alive mappings.
+func (us *udpServer) stats() []UDPMappingStats {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	stats := make([]UDPMappingStats, 0, len(us.mappings))
+	for _, m := range us.mappings {
+		client := *us.clientAddr
+		stats = append(stats, UDPMappingStats{
+			Client:      &client,
+			Destination: m.dest,
+			Relay:       m.conn.LocalAddr(),
+			Created:     m.created,
+			LastActive:  m.lastActiveTime(),
+			PacketsOut:  atomic.LoadUint64(&m.packetsOut),
+			BytesOut:    atomic.LoadUint64(&m.bytesOut),
+			PacketsIn:   atomic.LoadUint64(&m.packetsIn),
+			BytesIn:     atomic.LoadUint64(&m.bytesIn),
+			Filtered:    atomic.LoadUint64(&m.filtered),
+		})
+	}
+	return stats
+}
+
+func (m *udpMapping) touch(now time.Time) {
+	atomic.StoreInt64(&m.lastActive, now.UnixNano())
+}
+
+func (m *udpMapping) lastActiveTime() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&m.lastActive))
+}
+
+// udpHeader builds the UDP request header carrying addr.
+func udpHeader(addr net.Addr) []byte {
+	header := []byte{0x00, 0x00, 0x00}
+	as, err := ParseAddrSpec(addr.String())
+	if err != nil {
+		return header
+	}
+	b, _ := as.MarshalBinary()
+	return append(header, b...)
+}
+
+func (us *udpServer) keepAliveWithTCP(ctx context.Context, tcpConn net.Conn) {
+	if tc, ok := tcpConn.(*net.TCPConn); ok {
+		tc.SetKeepAlive(true)
+	}
+	buf := make([]byte, 1024)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-us.doneCh:
+			return
+		default:
+		}
+		_, err := tcpConn.Read(buf[0:])
+		if err != nil {
+			// TODO: log the error
+			us.close()
+			return
+		}
+	}
+}
+
+func (us *udpServer) close() {
+	us.once.Do(func() {
+		close(us.doneCh)
+		us.UDPConn.Close()
+
+		us.mu.Lock()
+		us.closed = true
+		for _, m := range us.mappings {
+			m.conn.Close()
+		}
+		us.mu.Unlock()
+	})
+}
+
+func (s *Session) handleCmdUDP(ctx context.Context, req *Request) error {
+	if _, ok := s.Conn.(*gssConn); ok {
+		s.sendReply(ReplyNotAllowed, nil)
+		return ErrGSSAPIUDP
+	}
+	clientIP, err := req.DestAddr.resolveIPAddr()
+	if err != nil {
+		s.sendReply(ReplyHostUnreachable, nil)
+		return err
+	}
+	// Clients which do not know their address yet send 0.0.0.0, the
+	// address of the TCP connection is expected then.
+	if clientIP == nil || clientIP.IsUnspecified() {
+		remote, ok := s.RemoteAddr().(*net.TCPAddr)
+		if !ok {
+			s.sendReply(ReplyFailure, nil)
+			return ErrBindSocketFailed
+		}
+		clientIP = remote.IP
+	}
+	udpSrv, err := newUDPServer(s.srv.UDPAddress, &net.UDPAddr{
+		IP:   clientIP,
+		Port: req.DestAddr.Port,
+	})
+	if err != nil {
+		s.sendReply(ReplyFailure, nil)
+		return ErrBindSocketFailed
+	}
+	defer udpSrv.close()
+	udpSrv.frags = newReassembler(s.srv.UDPFragQueueSize, s.srv.UDPFragTimeout)
+	udpSrv.filter = s.srv.UDPFilter
+	udpSrv.allow = func(dest *AddrSpec, ip net.IP) bool {
+		return s.checkRules(CmdUDP, dest, ip) != aclDeny
+	}
+	// without routes, every datagram goes through the Dialer of the server
+	if _, ok := s.srv.Dialer.(PacketDialer); len(s.srv.routes) == 0 && s.srv.Dialer != nil && !ok {
+		s.sendReply(ReplyNotAllowed, nil)
+		return ErrUDPNotSupported
+	}
+	udpSrv.listenPacket = func(dest *AddrSpec) (net.PacketConn, error) {
+		return s.listenPacket(ctx, dest)
+	}
+	if s.srv.UDPMappingTimeout > 0 {
+		udpSrv.timeout = s.srv.UDPMappingTimeout
+	}
+	s.srv.trackUDPRelay(udpSrv, true)
+	defer s.srv.trackUDPRelay(udpSrv, false)
+
+	as := s.replyAddr(udpSrv.LocalAddr())
+	if s.srv.UDPAdvertise != nil {
+		as.IP = s.srv.UDPAdvertise
+		as.Type = TypeIPV6
+		if as.IP.To4() != nil {
+			as.Type = TypeIPV4
+		}
+	}
+	if err := s.sendReply(ReplySuccessed, as); err != nil {
+		return ErrSendReplyFailed
+	}
+	go udpSrv.keepAliveWithTCP(ctx, s.Conn)
+	return udpSrv.run(ctx)
+}
+
+// listenPacket makes the socket of the mapping of dest on the outbound of
+// dest, the datagrams of the outbounds not relaying UDP are dropped.
+func (s *Session) listenPacket(ctx context.Context, dest *AddrSpec) (net.PacketConn, error) {
+	ob := s.outbound(ctx, dest)
+	if ob.reject {
+		return nil, ErrRouteRejected
+	}
+	if ob.dialer == nil {
+		return listenUDP(dest)
+	}
+	pd, ok := ob.dialer.(PacketDialer)
+	if !ok {
+		return nil, ErrUDPNotSupported
+	}
+	return pd.ListenPacket(ctx, "udp", "")
+}
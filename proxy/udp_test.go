@@ -0,0 +1,168 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// listenUDPTarget starts a target on ip replying name to every datagram.
+func listenUDPTarget(t *testing.T, ip, name string) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(ip)})
+	if err != nil {
+		t.Skip(err)
+	}
+	go func() {
+		b := make([]byte, 1024)
+		for {
+			_, addr, err := conn.ReadFromUDP(b)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP([]byte(name), addr)
+		}
+	}()
+	return conn
+}
+
+func newTestUDPRelay(t *testing.T, filter string, timeout time.Duration) (*udpServer, *net.UDPConn) {
+	srv, err := newUDPServer("127.0.0.1", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.filter = filter
+	if timeout > 0 {
+		srv.timeout = timeout
+	}
+	go srv.run(context.Background())
+
+	client, err := net.DialUDP("udp", nil, srv.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return srv, client
+}
+
+func readUDPReply(t *testing.T, conn *net.UDPConn) ([]byte, string) {
+	b := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(b)
+	if err != nil {
+		return nil, ""
+	}
+	header := udpHeader(&net.UDPAddr{IP: net.IP(b[4:8]), Port: int(b[8])<<8 | int(b[9])})
+	return b[:len(header)], string(b[len(header):n])
+}
+
+func TestUDPServer_mappings(t *testing.T) {
+	foo := listenUDPTarget(t, "127.0.0.1", "foo")
+	defer foo.Close()
+	bar := listenUDPTarget(t, "127.0.0.1", "bar")
+	defer bar.Close()
+
+	srv, client := newTestUDPRelay(t, "", 0)
+	defer srv.close()
+	defer client.Close()
+
+	replies := make(map[string]string)
+	for _, target := range []*net.UDPConn{foo, bar} {
+		header := udpHeader(target.LocalAddr().(*net.UDPAddr))
+		client.Write(append(header, "ping"...))
+		h, data := readUDPReply(t, client)
+		replies[string(h)] = data
+	}
+	assert.Equal(t, map[string]string{
+		string(udpHeader(foo.LocalAddr().(*net.UDPAddr))): "foo",
+		string(udpHeader(bar.LocalAddr().(*net.UDPAddr))): "bar",
+	}, replies)
+
+	stats := srv.stats()
+	assert.Len(t, stats, 2)
+	for _, st := range stats {
+		assert.Equal(t, uint64(1), st.PacketsOut)
+		assert.Equal(t, uint64(4), st.BytesOut)
+		assert.Equal(t, uint64(1), st.PacketsIn)
+		assert.Equal(t, uint64(3), st.BytesIn)
+	}
+}
+
+func TestUDPServer_filtering(t *testing.T) {
+	// whether the replies from another port of the target host, and from
+	// another host are relayed
+	tests := []struct {
+		filter    string
+		samePort  bool
+		otherHost bool
+	}{
+		{"", false, false},
+		{UDPFilterAddressAndPortDependent, false, false},
+		{UDPFilterAddressDependent, true, false},
+		{UDPFilterEndpointIndependent, true, true},
+	}
+	for _, tt := range tests {
+		target := listenUDPTarget(t, "127.0.0.1", "target")
+		otherPort := listenUDPTarget(t, "127.0.0.1", "other port")
+		otherHost := listenUDPTarget(t, "127.0.0.2", "other host")
+
+		srv, client := newTestUDPRelay(t, tt.filter, 0)
+		client.Write(append(udpHeader(target.LocalAddr().(*net.UDPAddr)), "ping"...))
+		_, data := readUDPReply(t, client)
+		assert.Equal(t, "target", data)
+
+		// the other hosts learn the address of the mapping
+		relay := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: srv.stats()[0].Relay.(*net.UDPAddr).Port}
+		otherPort.WriteToUDP([]byte("other port"), relay)
+		otherHost.WriteToUDP([]byte("other host"), relay)
+
+		want := 0
+		if tt.samePort {
+			want++
+		}
+		if tt.otherHost {
+			want++
+		}
+		got := make(map[string][]byte)
+		for i := 0; i < want; i++ {
+			h, data := readUDPReply(t, client)
+			got[data] = h
+		}
+		assert.Len(t, got, want, tt.filter)
+		if tt.samePort {
+			assert.Equal(t, udpHeader(otherPort.LocalAddr().(*net.UDPAddr)), got["other port"], tt.filter)
+		}
+		assert.Eventually(t, func() bool {
+			return srv.stats()[0].Filtered == uint64(2-want)
+		}, time.Second, 10*time.Millisecond, tt.filter)
+
+		srv.close()
+		client.Close()
+		target.Close()
+		otherPort.Close()
+		otherHost.Close()
+	}
+}
+
+func TestUDPServer_mappingExpiry(t *testing.T) {
+	target := listenUDPTarget(t, "127.0.0.1", "target")
+	defer target.Close()
+
+	srv, client := newTestUDPRelay(t, "", 50*time.Millisecond)
+	defer srv.close()
+	defer client.Close()
+
+	client.Write(append(udpHeader(target.LocalAddr().(*net.UDPAddr)), "ping"...))
+	_, data := readUDPReply(t, client)
+	assert.Equal(t, "target", data)
+	assert.Len(t, srv.stats(), 1)
+
+	time.Sleep(200 * time.Millisecond)
+	assert.Len(t, srv.stats(), 0)
+
+	// a new mapping is created on demand
+	client.Write(append(udpHeader(target.LocalAddr().(*net.UDPAddr)), "ping"...))
+	_, data = readUDPReply(t, client)
+	assert.Equal(t, "target", data)
+}
@@ -0,0 +1,203 @@
+package proxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/remones/gsocks/config"
+)
+
+// unixSocket is the socket file of a unix listener.
+type unixSocket struct {
+	// mode is the permissions of the file, unchanged if 0
+	mode os.FileMode
+	// uid and gid own the file, unchanged if -1
+	uid, gid int
+	// peerIdentity authenticates the clients as the user of their process
+	peerIdentity bool
+}
+
+// peerCred are the credentials of the process of a client of a unix socket
+type peerCred struct {
+	uid, gid uint32
+	pid      int32
+}
+
+// newUnixSocket parses the socket file of cfg, nil if cfg is nil.
+func newUnixSocket(cfg *config.UnixSocket) (*unixSocket, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	us := &unixSocket{uid: -1, gid: -1, peerIdentity: cfg.PeerIdentity}
+	if cfg.Mode != "" {
+		mode, err := strconv.ParseUint(cfg.Mode, 8, 32)
+		if err != nil {
+			return nil, fmt.Errorf("socks: invalid unix socket mode %q", cfg.Mode)
+		}
+		us.mode = os.FileMode(mode) & os.ModePerm
+	}
+	if cfg.Owner != "" {
+		id := cfg.Owner
+		if _, err := strconv.Atoi(id); err != nil {
+			u, err := user.Lookup(cfg.Owner)
+			if err != nil {
+				return nil, fmt.Errorf("socks: unix socket owner: %w", err)
+			}
+			id = u.Uid
+		}
+		us.uid, _ = strconv.Atoi(id)
+	}
+	if cfg.Group != "" {
+		id := cfg.Group
+		if _, err := strconv.Atoi(id); err != nil {
+			g, err := user.LookupGroup(cfg.Group)
+			if err != nil {
+				return nil, fmt.Errorf("socks: unix socket group: %w", err)
+			}
+			id = g.Gid
+		}
+		us.gid, _ = strconv.Atoi(id)
+	}
+	return us, nil
+}
+
+// listen listens on address, the path of a unix socket prefixed by
+// "unix://", or else a TCP "host:port".
+func listen(address string, us *unixSocket) (net.Listener, error) {
+	if !config.IsUnixAddress(address) {
+		return net.Listen("tcp", address)
+	}
+	path := strings.TrimPrefix(address, config.UnixScheme)
+	// the socket file of a previous process which did not remove it is
+	// replaced, unless it is still served.
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("socks: unix socket %s is in use", path)
+		}
+		os.Remove(path)
+	}
+	return listenUnix(path, us)
+}
+
+// listenUnix creates the socket in a private directory next to path, where
+// no one may connect to it before its mode and owner are set, and then
+// moves it to path.
+func listenUnix(path string, us *unixSocket) (net.Listener, error) {
+	dir, err := ioutil.TempDir(filepath.Dir(path), ".gsocks")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	tmp := filepath.Join(dir, "sock")
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmp, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	ln.SetUnlinkOnClose(false)
+	err = us.apply(tmp)
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return &unixListener{Listener: ln, path: path}, nil
+}
+
+// unixListener is a listener of a socket moved to path, which is removed
+// once it is closed.
+type unixListener struct {
+	net.Listener
+	path string
+	once sync.Once
+}
+
+func (l *unixListener) Addr() net.Addr {
+	return &net.UnixAddr{Name: l.path, Net: "unix"}
+}
+
+func (l *unixListener) Close() error {
+	err := l.Listener.Close()
+	l.once.Do(func() { os.Remove(l.path) })
+	return err
+}
+
+// apply sets the mode and the owner of the socket file at path.
+func (us *unixSocket) apply(path string) error {
+	if us == nil {
+		return nil
+	}
+	if us.uid != -1 || us.gid != -1 {
+		if err := os.Chown(path, us.uid, us.gid); err != nil {
+			return err
+		}
+	}
+	if us.mode != 0 {
+		return os.Chmod(path, us.mode)
+	}
+	return nil
+}
+
+// peerIdentity is the identity of the user of the process of the client of
+// a unix socket, nil if its listener does not authenticate the clients so.
+func (s *Session) peerIdentity() *Identity {
+	us := s.srv.unixSocket
+	if s.endpoint != nil {
+		us = s.endpoint.unixSocket
+	}
+	if us == nil || !us.peerIdentity {
+		return nil
+	}
+	uc, ok := baseConn(s.Conn).(*net.UnixConn)
+	if !ok {
+		return nil
+	}
+	cred, err := readPeerCred(uc)
+	if err != nil {
+		s.logf("peer credentials: %v", err)
+		return nil
+	}
+	return peerCredIdentity(cred)
+}
+
+// peerCredIdentity is the identity of the user of cred, named by its
+// username, and its primary group as its group.
+func peerCredIdentity(cred *peerCred) *Identity {
+	uid := strconv.FormatUint(uint64(cred.uid), 10)
+	gid := strconv.FormatUint(uint64(cred.gid), 10)
+	id := &Identity{
+		Username: uid,
+		Groups:   []string{gid},
+		Attributes: map[string]string{
+			"uid": uid,
+			"gid": gid,
+			"pid": strconv.Itoa(int(cred.pid)),
+		},
+		Method: AuthNoRequried,
+	}
+	if u, err := user.LookupId(uid); err == nil {
+		id.Username = u.Username
+	}
+	if g, err := user.LookupGroupId(gid); err == nil {
+		id.Groups = []string{g.Name}
+	}
+	return id
+}
+
+// baseConn returns the connection c wraps to sniff the protocol, if any.
+func baseConn(c net.Conn) net.Conn {
+	if bc, ok := c.(*bufferedConn); ok {
+		return bc.Conn
+	}
+	return c
+}
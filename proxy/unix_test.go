@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+
+	"github.com/remones/gsocks/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListenUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gsocks.sock")
+	us, err := newUnixSocket(&config.UnixSocket{Mode: "0600", Group: strconv.Itoa(os.Getgid())})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := listen(config.UnixScheme+path, us)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(path)
+	if assert.NoError(t, err) {
+		assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+	}
+	assert.Equal(t, path, ln.Addr().String())
+	// the socket is moved from a private directory, which is removed
+	entries, err := ioutil.ReadDir(filepath.Dir(path))
+	if assert.NoError(t, err) {
+		assert.Len(t, entries, 1)
+	}
+
+	// the socket served can not be replaced
+	_, err = listen(config.UnixScheme+path, nil)
+	assert.Error(t, err)
+	ln.Close()
+	_, err = os.Lstat(path)
+	assert.True(t, os.IsNotExist(err))
+
+	// the socket file left by a previous process is replaced
+	ln, err = net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	ln.Close()
+	ln, err = listen(config.UnixScheme+path, nil)
+	if assert.NoError(t, err) {
+		ln.Close()
+	}
+
+	_, err = newUnixSocket(&config.UnixSocket{Owner: "no-such-user-of-gsocks"})
+	assert.Error(t, err)
+}
+
+func TestSession_peerIdentity(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("peer credentials are only supported on Linux")
+	}
+	path := filepath.Join(t.TempDir(), "gsocks.sock")
+	ln, err := listen(config.UnixScheme+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	cfg := config.NewConfig()
+	cfg.Auth.NoRequired = nil
+	cfg.Auth.UserPasswd = &config.UserPasswd{Enable: true}
+	cfg.Listener = []config.Listener{{Address: config.UnixScheme + path, Unix: &config.UnixSocket{PeerIdentity: true}}}
+	srv, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := srv.newSession(conn, Socks5Version)
+	s.endpoint = srv.endpoints[0]
+	defer s.Close()
+	go func() {
+		client.Write([]byte{1, byte(AuthNoRequried)})
+		io.ReadFull(client, make([]byte, 2))
+	}()
+	ok, err := s.AuthenticateContext(context.Background())
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	if assert.NotNil(t, s.identity) {
+		assert.Equal(t, strconv.Itoa(os.Getuid()), s.identity.Attributes["uid"])
+		assert.Equal(t, strconv.Itoa(os.Getpid()), s.identity.Attributes["pid"])
+		assert.NotEmpty(t, s.identity.Username)
+	}
+}
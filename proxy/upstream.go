@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/remones/gsocks/config"
+)
+
+// errors
+var (
+	ErrUDPNotSupported = errors.New("socks: UDP is not relayed through the upstream proxies")
+)
+
+// Dialer connects to the targets of the requests, e.g. through upstream
+// proxies.
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// PacketDialer is implemented by the Dialers which relay UDP too.
+type PacketDialer interface {
+	Dialer
+	ListenPacket(ctx context.Context, network, address string) (net.PacketConn, error)
+}
+
+// UpstreamFunc creates the Dialer of an upstream proxy, forward reaches the
+// proxy and is nil if the proxy is dialed directly.
+type UpstreamFunc func(cfg *config.Upstream, forward Dialer) (Dialer, error)
+
+var (
+	upstreamMu    sync.RWMutex
+	upstreamTypes = make(map[string]UpstreamFunc)
+)
+
+// RegisterUpstream makes an upstream proxy type available to the config,
+// it is called from the init function of the package implementing it,
+// e.g. package client registers "socks5", "socks4a" and "http".
+func RegisterUpstream(typ string, f UpstreamFunc) {
+	upstreamMu.Lock()
+	defer upstreamMu.Unlock()
+	upstreamTypes[typ] = f
+}
+
+// newUpstreamChain creates the Dialer going through the upstreams in order,
+// nil is returned if there are none.
+func newUpstreamChain(upstreams []config.Upstream) (Dialer, error) {
+	upstreamMu.RLock()
+	defer upstreamMu.RUnlock()
+	var d Dialer
+	for i := range upstreams {
+		f, ok := upstreamTypes[upstreams[i].Type]
+		if !ok {
+			return nil, fmt.Errorf("socks: upstream type %q is not registered, the built-in types are by importing %s",
+				upstreams[i].Type, "github.com/remones/gsocks/client")
+		}
+		next, err := f(&upstreams[i], d)
+		if err != nil {
+			return nil, err
+		}
+		d = next
+	}
+	return d, nil
+}
+
+// dial connects to the target address through d, or directly if d is nil.
+func (srv *Server) dial(ctx context.Context, d Dialer, network, address string) (net.Conn, error) {
+	if d == nil {
+		dialer := net.Dialer{Timeout: srv.DialTimeout}
+		return dialer.DialContext(ctx, network, address)
+	}
+	if srv.DialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, srv.DialTimeout)
+		defer cancel()
+	}
+	return d.DialContext(ctx, network, address)
+}